@@ -0,0 +1,158 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// isArchiveName reports whether a file name has a tar extension,
+// possibly followed by a compression extension, or is a .tgz or
+// .zip file.
+func isArchiveName(name string) bool {
+	ext := filepath.Ext(name)
+	if ext == ".tgz" || ext == ".zip" {
+		return true
+	}
+	if slices.Contains(compressionExtensions, ext) {
+		name = strings.TrimSuffix(name, ext)
+	}
+	return filepath.Ext(name) == ".tar"
+}
+
+// isTar reports whether buffered content starts with a tar header,
+// which has the magic ustar at offset 257 in the POSIX and GNU
+// formats.
+func isTar(r *bufio.Reader) bool {
+	header, err := r.Peek(262)
+	return err == nil && string(header[257:262]) == "ustar"
+}
+
+// correctArchive corrects the fastq files in a tar or ZIP archive
+// into files with the same base names in outdir. The files are
+// corrected one after the other while the archive is read, so that
+// it never needs to be unpacked. Other files are skipped with a
+// notice. Like runJobs, it reports each file that failed, and
+// returns the number of failed files.
+func correctArchive(archive, outdir string, failFast bool, correct func(infastq, outfastq string, opts *options) error, opts *options) (failed int) {
+	a := &archiveCorrection{
+		archive:  archive,
+		outdir:   outdir,
+		failFast: failFast,
+		correct:  correct,
+		opts:     opts,
+		outputs:  make(map[string]string),
+	}
+	if isZipName(archive) {
+		failed = a.correctZip()
+	} else {
+		failed = a.correctTar()
+	}
+	return failed + a.finish()
+}
+
+// an archiveCorrection corrects the members of an archive one after
+// the other.
+type archiveCorrection struct {
+	archive, outdir string
+	failFast        bool
+	correct         func(infastq, outfastq string, opts *options) error
+	opts            *options
+	// the names and errors of the fastq members corrected so far
+	names []string
+	errs  []error
+	// the number of other members skipped
+	skipped int
+	// the members that were written to each output, since members
+	// in different directories may have the same base name
+	outputs map[string]string
+}
+
+// correctTar corrects the members of a tar archive, and returns 1
+// if the archive cannot be read, or 0 otherwise.
+func (a *archiveCorrection) correctTar() int {
+	in, err := openInput(a.archive, a.opts.workers)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "correct-platinum-fastq-sequence-identifier:", err)
+		return 1
+	}
+	defer func() { _ = in.Close() }()
+
+	tr := tar.NewReader(in)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return 0
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "correct-platinum-fastq-sequence-identifier: %s: %v\n", a.archive, err)
+			return 1
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		if !a.member(header.Name, header.Size, func() (io.ReadCloser, error) { return io.NopCloser(tr), nil }) {
+			return 0
+		}
+	}
+}
+
+// member corrects a member of the archive with the given size,
+// which open opens, or skips it if it is not a fastq file. It
+// returns false if the correction must stop, because the member
+// failed with failFast.
+func (a *archiveCorrection) member(name string, size int64, open func() (io.ReadCloser, error)) bool {
+	if !isFastqName(name) {
+		fmt.Fprintf(os.Stderr, "Skipping %s in %s, not a fastq file\n", name, a.archive)
+		a.skipped++
+		return true
+	}
+	member := path.Clean(name)
+	infastq := a.archive + "/" + member
+	a.names = append(a.names, infastq)
+	outfastq := filepath.Join(a.outdir, path.Base(member))
+	if other, ok := a.outputs[outfastq]; ok {
+		a.errs = append(a.errs, fmt.Errorf("%s would overwrite the output of %s", outfastq, other))
+	} else {
+		a.outputs[outfastq] = member
+		memberOpts := *a.opts
+		memberOpts.member = func(name string, threads int) (*input, error) {
+			r, err := open()
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+			in, err := newInput(r, name, threads)
+			if err != nil {
+				_ = r.Close()
+				return nil, err
+			}
+			in.closers = append(in.closers, r)
+			in.size = size
+			return in, nil
+		}
+		a.errs = append(a.errs, a.correct(infastq, outfastq, &memberOpts))
+	}
+	return a.errs[len(a.errs)-1] == nil || !a.failFast
+}
+
+// finish reports each member that failed, and a summary, and
+// returns the number of failed members.
+func (a *archiveCorrection) finish() (failed int) {
+	corrected := 0
+	for i, err := range a.errs {
+		if err != nil {
+			failed++
+			fmt.Fprintf(os.Stderr, "correct-platinum-fastq-sequence-identifier: %s: %v\n", a.names[i], err)
+		} else {
+			corrected++
+		}
+	}
+	fmt.Fprintf(os.Stderr, "Corrected %d of %d fastq files in %s, skipped %d other files\n", corrected, len(a.errs), a.archive, a.skipped)
+	return failed
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// TestArchive corrects a tar archive, plain and gzipped, with a
+// fastq member and another file, and checks the corrected member
+// and the notice about the other file.
+func TestArchive(t *testing.T) {
+	dir := t.TempDir()
+	data := platinumFastq(200)
+	reference := filepath.Join(dir, "reference.fastq")
+	if status, stderr := runProgram(t, "seq", writeFixture(t, dir, "in.fastq", data), reference); status != 0 {
+		t.Fatal(stderr)
+	}
+	want, err := os.ReadFile(reference)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	for _, member := range []struct {
+		name string
+		data []byte
+	}{
+		{"run1/ERR194147_1.fastq", data},
+		{"run1/README.txt", []byte("not fastq\n")},
+	} {
+		if err := tw.WriteHeader(&tar.Header{Name: member.name, Mode: 0o644, Size: int64(len(member.data)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(member.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	archives := []string{
+		writeFixture(t, dir, "delivery.tar", archive.Bytes()),
+		writeFixture(t, dir, "delivery.tar.gz", gzipped(t, archive.Bytes())),
+	}
+	for _, name := range archives {
+		for _, mode := range []string{"seq", "par"} {
+			outdir := t.TempDir()
+			status, stderr := runProgram(t, mode, "-outdir", outdir, name)
+			if status != 0 {
+				t.Fatalf("%s, %s: exit status %d: %s", filepath.Base(name), mode, status, stderr)
+			}
+			for _, notice := range []string{
+				"Skipping run1/README.txt in " + name + ", not a fastq file\n",
+				"Corrected 1 of 1 fastq files in " + name + ", skipped 1 other files\n",
+			} {
+				if !strings.Contains(stderr, notice) {
+					t.Errorf("%s, %s: missing %q in %s", filepath.Base(name), mode, notice, stderr)
+				}
+			}
+			outputs := readOutputs(t, outdir)
+			if len(outputs) != 1 || !bytes.Equal(outputs["ERR194147_1.fastq"], want) {
+				t.Errorf("%s, %s: got outputs %q", filepath.Base(name), mode, slices.Sorted(maps.Keys(outputs)))
+			}
+		}
+	}
+}
@@ -0,0 +1,59 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// fileSizeLimit is the environment variable that limits the size of
+// the files that the program writes in runProgram, so that writing
+// fails like on a full disk.
+const fileSizeLimit = "CORRECT_PLATINUM_FILE_SIZE_LIMIT"
+
+func init() {
+	if limit, err := strconv.ParseUint(os.Getenv(fileSizeLimit), 10, 64); err == nil {
+		// the Go runtime ignores SIGXFSZ, so writes past the limit
+		// fail with EFBIG
+		if err := syscall.Setrlimit(syscall.RLIMIT_FSIZE, &syscall.Rlimit{Cur: limit, Max: limit}); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// TestAtomicOutput lets writing the output fail halfway in both
+// modes, and checks that neither the output nor its temporary file
+// are left behind, while an existing output is kept with -force.
+func TestAtomicOutput(t *testing.T) {
+	t.Setenv(fileSizeLimit, strconv.Itoa(64<<10))
+	in := writeFixture(t, t.TempDir(), "in.fastq", platinumFastq(4000))
+	for _, output := range []string{"out.fastq", "out.fastq.gz"} {
+		for _, mode := range []string{"seq", "par"} {
+			dir := t.TempDir()
+			out := filepath.Join(dir, output)
+			status, stderr := runProgram(t, mode, in, out)
+			if status == 0 || !strings.Contains(stderr, out+": file too large") {
+				t.Errorf("%s, %s: exit status %d: %s", output, mode, status, stderr)
+			}
+			if entries, _ := os.ReadDir(dir); len(entries) > 0 {
+				t.Errorf("%s, %s: %s was left behind", output, mode, entries[0].Name())
+			}
+
+			existing := writeFixture(t, dir, output, []byte("precious"))
+			if status, stderr := runProgram(t, mode, "-force", in, out); status == 0 {
+				t.Errorf("%s, %s, -force: %s", output, mode, stderr)
+			}
+			if data, err := os.ReadFile(existing); err != nil || string(data) != "precious" {
+				t.Errorf("%s, %s, -force: the existing output was changed: %q, %v", output, mode, data, err)
+			}
+			if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+				t.Errorf("%s, %s, -force: %d files were left behind", output, mode, len(entries))
+			}
+		}
+	}
+}
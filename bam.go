@@ -0,0 +1,29 @@
+package main
+
+import (
+	"encoding/binary"
+)
+
+// bamHeader returns the header of each BAM output: the SAM header
+// text of samHeader, with no reference sequences, since the records
+// are unaligned.
+func bamHeader(opts *options) []byte {
+	text := samHeader(opts)
+	b := make([]byte, 0, 12+len(text))
+	b = append(b, "BAM\x01"...)
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(text)))
+	b = append(b, text...)
+	return binary.LittleEndian.AppendUint32(b, 0)
+}
+
+// outputHeader returns the header that each output starts with in
+// the output format of the options, or nil for fastq.
+func outputHeader(opts *options) []byte {
+	switch opts.outputFormat {
+	case "sam":
+		return samHeader(opts)
+	case "bam":
+		return bamHeader(opts)
+	}
+	return nil
+}
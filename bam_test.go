@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestBAMOutput writes BAM output in both modes, decodes it with the
+// BGZF reader, and checks the header and the first record against
+// the bytes that the BAM specification gives for them.
+func TestBAMOutput(t *testing.T) {
+	const name = "HSQ1004:134:C0D8DACXX:1:1101:1000:2000"
+	// the first of 100 records is replaced by one with known bases
+	// and qualities, of odd length
+	rest := platinumFastq(100)
+	rest = rest[bytes.Index(rest, []byte("\n@ERR194147.2 "))+1:]
+	input := append([]byte("@ERR194147.1 "+name+"/1\nACGTN\n+\n#+5?I\n"), rest...)
+	text := "@HD\tVN:1.6\tSO:unsorted\tGO:query\n@RG\tID:foo\tSM:bar\n@PG\tID:" + program + "\tPN:" + program + "\n"
+	le := binary.LittleEndian
+	header := le.AppendUint32([]byte("BAM\x01"), uint32(len(text)))
+	header = le.AppendUint32(append(header, text...), 0)
+	var record []byte
+	record = le.AppendUint32(record, uint32(32+len(name)+1+3+5+len("RGZfoo\x00")))
+	// refID, pos, l_read_name, mapq, bin, n_cigar_op, flag, and l_seq
+	record = le.AppendUint32(le.AppendUint32(record, ^uint32(0)), ^uint32(0))
+	record = append(record, byte(len(name)+1), 0, 0x48, 0x12, 0, 0, 77, 0, 5, 0, 0, 0)
+	// next_refID, next_pos, and tlen
+	record = le.AppendUint32(le.AppendUint32(le.AppendUint32(record, ^uint32(0)), ^uint32(0)), 0)
+	record = append(record, name+"\x00"...)
+	// ACGTN as 4-bit codes, and the qualities without their offset
+	record = append(record, 0x12, 0x48, 0xf0, 2, 10, 20, 30, 40)
+	record = append(record, "RGZfoo\x00"...)
+
+	in := writeFixture(t, t.TempDir(), "in.fastq", input)
+	for _, mode := range []string{"seq", "par"} {
+		out := filepath.Join(t.TempDir(), "out.bam")
+		if status, stderr := runProgram(t, mode, "-output-format", "bam", "-read-group", `@RG\tID:foo\tSM:bar`, in, out); status != 0 {
+			t.Fatalf("%s: %s", mode, stderr)
+		}
+		file, err := os.Open(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(newBgzfReader(bufio.NewReader(file)))
+		file.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", mode, err)
+		}
+		if !bytes.HasPrefix(data, header) {
+			t.Fatalf("%s: header %q, want %q", mode, data[:min(len(data), len(header))], header)
+		}
+		if got := data[len(header):]; !bytes.HasPrefix(got, record) {
+			t.Errorf("%s: first record % x, want % x", mode, got[:min(len(got), len(record))], record)
+		}
+		records := 0
+		for left := data[len(header):]; len(left) > 0; records++ {
+			if len(left) < 4 || len(left) < 4+int(le.Uint32(left)) {
+				t.Fatalf("%s: record %d is truncated", mode, records+1)
+			}
+			left = left[4+le.Uint32(left):]
+		}
+		if records != 100 {
+			t.Errorf("%s: %d records, want 100", mode, records)
+		}
+	}
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sync"
+)
+
+// BGZF is the blocked gzip format used by htslib: a series of
+// independent gzip members of at most 64 KiB each, with the total
+// block size recorded in a BC extra subfield, followed by an
+// empty end-of-file block.
+const (
+	bgzfBlockSize    = 0xff00
+	bgzfMaxBlockSize = 0x10000
+	bgzfHeaderSize   = 18
+	bgzfFooterSize   = 8
+)
+
+var bgzfEOF = []byte{
+	0x1f, 0x8b, 0x08, 0x04, 0x00, 0x00, 0x00, 0x00, 0x00, 0xff, 0x06, 0x00, 0x42, 0x43, 0x02, 0x00,
+	0x1b, 0x00, 0x03, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+}
+
+// bgzfWriter compresses everything written to it into BGZF
+// blocks.
+type bgzfWriter struct {
+	w       io.Writer
+	level   int
+	pending []byte
+	block   bytes.Buffer
+	err     error
+}
+
+func newBgzfWriter(w io.Writer, level int) *bgzfWriter {
+	return &bgzfWriter{w: w, level: level, pending: make([]byte, 0, bgzfBlockSize)}
+}
+
+func (bw *bgzfWriter) Write(p []byte) (n int, err error) {
+	if bw.err != nil {
+		return 0, bw.err
+	}
+	for len(p) > 0 {
+		k := copy(bw.pending[len(bw.pending):cap(bw.pending)], p)
+		bw.pending = bw.pending[:len(bw.pending)+k]
+		n += k
+		p = p[k:]
+		if len(bw.pending) == bgzfBlockSize {
+			if bw.err = bw.flushBlock(); bw.err != nil {
+				return n, bw.err
+			}
+		}
+	}
+	return n, nil
+}
+
+func (bw *bgzfWriter) flushBlock() error {
+	bw.block.Reset()
+	if err := compressBgzfBlock(&bw.block, bw.pending, bw.level); err != nil {
+		return err
+	}
+	bw.pending = bw.pending[:0]
+	_, err := bw.w.Write(bw.block.Bytes())
+	return err
+}
+
+// Close writes any pending data and the end-of-file block. It
+// does not close the underlying writer.
+func (bw *bgzfWriter) Close() error {
+	if bw.err != nil {
+		return bw.err
+	}
+	if len(bw.pending) > 0 {
+		if bw.err = bw.flushBlock(); bw.err != nil {
+			return bw.err
+		}
+	}
+	_, bw.err = bw.w.Write(bgzfEOF)
+	if bw.err == nil {
+		bw.err = errors.New("bgzf: writer is closed")
+		return nil
+	}
+	return bw.err
+}
+
+// bgzfFlateWriters are pools of flate writers for each compression
+// level, indexed by level - flate.HuffmanOnly, which are reset for
+// each block rather than allocated anew.
+var bgzfFlateWriters [flate.BestCompression - flate.HuffmanOnly + 1]sync.Pool
+
+// compressBgzfBlock appends a single BGZF block containing data,
+// which must not be longer than bgzfBlockSize, to dst.
+func compressBgzfBlock(dst *bytes.Buffer, data []byte, level int) error {
+	if level < flate.HuffmanOnly || level > flate.BestCompression {
+		return fmt.Errorf("bgzf: invalid compression level %d", level)
+	}
+	start := dst.Len()
+	dst.Write([]byte{0x1f, 0x8b, 0x08, 0x04, 0x00, 0x00, 0x00, 0x00, 0x00, 0xff, 0x06, 0x00, 0x42, 0x43, 0x02, 0x00, 0x00, 0x00})
+	writers := &bgzfFlateWriters[level-flate.HuffmanOnly]
+	fw, _ := writers.Get().(*flate.Writer)
+	if fw == nil {
+		var err error
+		if fw, err = flate.NewWriter(dst, level); err != nil {
+			return err
+		}
+	} else {
+		fw.Reset(dst)
+	}
+	defer writers.Put(fw)
+	if _, err := fw.Write(data); err != nil {
+		return err
+	}
+	if err := fw.Close(); err != nil {
+		return err
+	}
+	if dst.Len()-start+bgzfFooterSize > bgzfMaxBlockSize {
+		// incompressible data; store it instead
+		dst.Truncate(start)
+		return compressBgzfBlock(dst, data, flate.NoCompression)
+	}
+	var footer [bgzfFooterSize]byte
+	binary.LittleEndian.PutUint32(footer[0:], crc32.ChecksumIEEE(data))
+	binary.LittleEndian.PutUint32(footer[4:], uint32(len(data)))
+	dst.Write(footer[:])
+	binary.LittleEndian.PutUint16(dst.Bytes()[start+16:], uint16(dst.Len()-start-1))
+	return nil
+}
+
+// isBgzfHeader reports whether header, the first bytes of a gzip
+// member, starts a BGZF block.
+func isBgzfHeader(header []byte) bool {
+	return len(header) >= 16 &&
+		bytes.HasPrefix(header, gzipMagic) && header[2] == 8 && header[3]&4 != 0 &&
+		binary.LittleEndian.Uint16(header[10:]) >= 6 &&
+		header[12] == 'B' && header[13] == 'C' && binary.LittleEndian.Uint16(header[14:]) == 2
+}
+
+var errBgzfMissingEOF = errors.New("bgzf: missing end-of-file block, the input is probably truncated")
+
+// readBgzfBlock reads the next raw BGZF block from r into buf, and
+// returns it. It returns io.EOF if r is exhausted at a block
+// boundary.
+func readBgzfBlock(r *bufio.Reader, buf []byte) ([]byte, error) {
+	header, err := r.Peek(bgzfHeaderSize)
+	if err == io.EOF && len(header) == 0 {
+		return nil, io.EOF
+	}
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if !isBgzfHeader(header) {
+		return nil, errors.New("bgzf: invalid block header")
+	}
+	size := int(binary.LittleEndian.Uint16(header[16:])) + 1
+	if size < bgzfHeaderSize+bgzfFooterSize {
+		return nil, errors.New("bgzf: invalid block size")
+	}
+	buf = append(buf[:0], make([]byte, size)...)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return buf, nil
+}
+
+// decompressBgzfBlock decompresses a raw BGZF block into data,
+// verifies its checksum, and returns the decompressed bytes.
+func decompressBgzfBlock(block, data []byte, inflater io.ReadCloser) ([]byte, error) {
+	xlen := int(binary.LittleEndian.Uint16(block[10:]))
+	footer := block[len(block)-bgzfFooterSize:]
+	size := int(binary.LittleEndian.Uint32(footer[4:]))
+	if size > bgzfMaxBlockSize || 12+xlen > len(block)-bgzfFooterSize {
+		return nil, errors.New("bgzf: invalid block")
+	}
+	if err := inflater.(flate.Resetter).Reset(bytes.NewReader(block[12+xlen:len(block)-bgzfFooterSize]), nil); err != nil {
+		return nil, err
+	}
+	data = append(data[:0], make([]byte, size)...)
+	if _, err := io.ReadFull(inflater, data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(data) != binary.LittleEndian.Uint32(footer) {
+		return nil, errors.New("bgzf: checksum error")
+	}
+	return data, nil
+}
+
+// bgzfReader decompresses a BGZF stream block by block, and
+// reports an error if the stream does not end with an empty
+// end-of-file block.
+type bgzfReader struct {
+	r        *bufio.Reader
+	inflater io.ReadCloser
+	block    []byte
+	data     []byte
+	pos      int
+	empty    bool
+	err      error
+}
+
+func newBgzfReader(r *bufio.Reader) *bgzfReader {
+	return &bgzfReader{r: r, inflater: flate.NewReader(bytes.NewReader(nil))}
+}
+
+func (br *bgzfReader) Read(p []byte) (int, error) {
+	for br.pos == len(br.data) {
+		if br.err != nil {
+			return 0, br.err
+		}
+		br.block, br.err = readBgzfBlock(br.r, br.block)
+		if br.err == io.EOF {
+			if !br.empty {
+				br.err = errBgzfMissingEOF
+			}
+			continue
+		} else if br.err != nil {
+			continue
+		}
+		br.data, br.err = decompressBgzfBlock(br.block, br.data, br.inflater)
+		br.pos = 0
+		br.empty = len(br.data) == 0
+	}
+	n := copy(p, br.data[br.pos:])
+	br.pos += n
+	return n, nil
+}
+
+// Close releases no resources. Decompression errors are
+// reported by Read only.
+func (br *bgzfReader) Close() error {
+	return nil
+}
+
+// a decompressed BGZF block, or the error that ended the stream
+type bgzfResult struct {
+	data []byte
+	err  error
+}
+
+// a raw BGZF block waiting to be decompressed
+type bgzfTask struct {
+	block  []byte
+	result chan<- bgzfResult
+}
+
+// parallelBgzfReader decompresses a BGZF stream with several
+// workers, and reassembles the decompressed blocks in order.
+type parallelBgzfReader struct {
+	results chan chan bgzfResult
+	done    chan struct{}
+	data    []byte
+	pos     int
+	err     error
+}
+
+// newParallelBgzfReader starts reading raw blocks from r and
+// decompressing them with the given number of workers.
+func newParallelBgzfReader(r *bufio.Reader, workers int) *parallelBgzfReader {
+	br := &parallelBgzfReader{
+		results: make(chan chan bgzfResult, 4*workers),
+		done:    make(chan struct{}),
+	}
+	tasks := make(chan bgzfTask, workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			inflater := flate.NewReader(bytes.NewReader(nil))
+			for task := range tasks {
+				data, err := decompressBgzfBlock(task.block, nil, inflater)
+				task.result <- bgzfResult{data, err}
+			}
+		}()
+	}
+	go func() {
+		defer close(br.results)
+		defer close(tasks)
+		empty := false
+		for {
+			result := make(chan bgzfResult, 1)
+			select {
+			case br.results <- result:
+			case <-br.done:
+				return
+			}
+			block, err := readBgzfBlock(r, nil)
+			if err == io.EOF && !empty {
+				err = errBgzfMissingEOF
+			}
+			if err != nil {
+				result <- bgzfResult{err: err}
+				return
+			}
+			empty = binary.LittleEndian.Uint32(block[len(block)-4:]) == 0
+			select {
+			case tasks <- bgzfTask{block, result}:
+			case <-br.done:
+				return
+			}
+		}
+	}()
+	return br
+}
+
+func (br *parallelBgzfReader) Read(p []byte) (int, error) {
+	for br.pos == len(br.data) {
+		if br.err != nil {
+			return 0, br.err
+		}
+		result := <-<-br.results
+		br.data, br.pos, br.err = result.data, 0, result.err
+	}
+	n := copy(p, br.data[br.pos:])
+	br.pos += n
+	return n, nil
+}
+
+// Close stops reading ahead. Decompression errors are reported by
+// Read only.
+func (br *parallelBgzfReader) Close() error {
+	close(br.done)
+	return nil
+}
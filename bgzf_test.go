@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"math/rand"
+	"runtime"
+	"sync"
+	"testing"
+)
+
+// bgzfTestData are the contents that the BGZF tests compress: empty,
+// within one block, exactly one block, several blocks, and blocks
+// that do not compress and are stored instead.
+func bgzfTestData() map[string][]byte {
+	random := make([]byte, 3*bgzfBlockSize)
+	rand.New(rand.NewSource(1)).Read(random)
+	return map[string][]byte{
+		"empty":          nil,
+		"short":          platinumFastq(10),
+		"one block":      platinumFastq(1000)[:bgzfBlockSize],
+		"several blocks": platinumFastq(2000),
+		"incompressible": random,
+	}
+}
+
+func TestBgzfRoundTrip(t *testing.T) {
+	writers := map[string]func(data []byte, level int) ([]byte, error){
+		"stream": func(data []byte, level int) ([]byte, error) {
+			var out bytes.Buffer
+			w := newBgzfWriter(&out, level)
+			// in odd pieces, which do not line up with the blocks
+			for len(data) > 0 {
+				n := min(len(data), 12345)
+				if _, err := w.Write(data[:n]); err != nil {
+					return nil, err
+				}
+				data = data[n:]
+			}
+			err := w.Close()
+			return out.Bytes(), err
+		},
+		"batches": func(data []byte, level int) ([]byte, error) {
+			var out bytes.Buffer
+			if err := bgzfBlocksCompressor(level)(&out, data); err != nil {
+				return nil, err
+			}
+			out.Write(bgzfEOF)
+			return out.Bytes(), nil
+		},
+	}
+	for name, data := range bgzfTestData() {
+		for writer, write := range writers {
+			for _, level := range []int{0, 1, 6, 9} {
+				compressed, err := write(data, level)
+				if err != nil {
+					t.Fatalf("%s, %s, level %d: %v", name, writer, level, err)
+				}
+				for _, threads := range []int{1, 4} {
+					r, err := newCompressedReader(bufio.NewReader(bytes.NewReader(compressed)), threads)
+					if err != nil {
+						t.Fatal(err)
+					}
+					switch r.(type) {
+					case *bgzfReader, *parallelBgzfReader:
+					default:
+						t.Fatalf("%s, %s, level %d: BGZF not detected, but read with %T", name, writer, level, r)
+					}
+					got, err := io.ReadAll(r)
+					r.Close()
+					if err != nil || !bytes.Equal(got, data) {
+						t.Errorf("%s, %s, level %d, %d threads: read %d bytes of %d, %v", name, writer, level, threads, len(got), len(data), err)
+					}
+				}
+				// BGZF is a valid multi-member gzip stream
+				z, err := gzip.NewReader(bytes.NewReader(compressed))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got, err := io.ReadAll(z); err != nil || !bytes.Equal(got, data) {
+					t.Errorf("%s, %s, level %d: gzip read %d bytes of %d, %v", name, writer, level, len(got), len(data), err)
+				}
+			}
+		}
+	}
+}
+
+func TestBgzfTruncated(t *testing.T) {
+	var out bytes.Buffer
+	if err := bgzfBlocksCompressor(6)(&out, platinumFastq(2000)); err != nil {
+		t.Fatal(err)
+	}
+	complete := out.Bytes()
+	tests := map[string][]byte{
+		"missing end-of-file block": complete,
+		"within a block":            complete[:len(complete)-100],
+	}
+	for name, compressed := range tests {
+		for _, threads := range []int{1, 4} {
+			r, err := newCompressedReader(bufio.NewReader(bytes.NewReader(compressed)), threads)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := io.ReadAll(r); err == nil {
+				t.Errorf("%s, %d threads: no error", name, threads)
+			}
+			r.Close()
+		}
+	}
+}
+
+// batchedFastq splits the records of platinumFastq into batches of
+// about the size that the par mode gives the batch compressors.
+func batchedFastq(records, size int) [][]byte {
+	data := platinumFastq(records)
+	var batches [][]byte
+	for len(data) > 0 {
+		n := min(len(data), size)
+		if i := bytes.IndexByte(data[n:], '@'); i >= 0 && n < len(data) {
+			n += i
+		} else {
+			n = len(data)
+		}
+		batches = append(batches, data[:n])
+		data = data[n:]
+	}
+	return batches
+}
+
+// BenchmarkOutputCompression compares compressing the output of par
+// mode with a single gzip writer in the ordered stage, as it used
+// to be, with compressing its batches in parallel into gzip members or
+// BGZF blocks, and with -parallel-gzip.
+func BenchmarkOutputCompression(b *testing.B) {
+	batches := batchedFastq(20000, 256<<10)
+	size := 0
+	for _, batch := range batches {
+		size += len(batch)
+	}
+	serial := func(newWriter func(io.Writer) (io.WriteCloser, error)) func(b *testing.B) {
+		return func(b *testing.B) {
+			b.SetBytes(int64(size))
+			for i := 0; i < b.N; i++ {
+				w, err := newWriter(io.Discard)
+				if err != nil {
+					b.Fatal(err)
+				}
+				for _, batch := range batches {
+					if _, err := w.Write(batch); err != nil {
+						b.Fatal(err)
+					}
+				}
+				if err := w.Close(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	}
+	parallel := func(compress func(dst *bytes.Buffer, data []byte) error) func(b *testing.B) {
+		return func(b *testing.B) {
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			compressed := make([]bytes.Buffer, len(batches))
+			for i := 0; i < b.N; i++ {
+				var wg sync.WaitGroup
+				next := make(chan int)
+				for range runtime.GOMAXPROCS(0) {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						for j := range next {
+							compressed[j].Reset()
+							if err := compress(&compressed[j], batches[j]); err != nil {
+								b.Error(err)
+							}
+						}
+					}()
+				}
+				for j := range batches {
+					next <- j
+				}
+				close(next)
+				wg.Wait()
+				for j := range compressed {
+					io.Discard.Write(compressed[j].Bytes())
+				}
+			}
+		}
+	}
+	b.Run("gzip writer", serial(func(w io.Writer) (io.WriteCloser, error) {
+		return newGzipWriter(w, 6)
+	}))
+	b.Run("parallel gzip writer", serial(func(w io.Writer) (io.WriteCloser, error) {
+		return newParallelGzipWriter(w, 6, runtime.GOMAXPROCS(0))
+	}))
+	b.Run("gzip members", parallel(gzipMemberCompressor(6)))
+	b.Run("bgzf blocks", parallel(bgzfBlocksCompressor(6)))
+}
+
+// BenchmarkInputDecompression compares decompressing the same input
+// as plain gzip, which one gzip reader decompresses, and as BGZF, of
+// which several workers decompress the blocks.
+func BenchmarkInputDecompression(b *testing.B) {
+	data := platinumFastq(20000)
+	var plain, blocked bytes.Buffer
+	w, err := newGzipWriter(&plain, 6)
+	if err != nil {
+		b.Fatal(err)
+	}
+	w.Write(data)
+	w.Close()
+	bw := newBgzfWriter(&blocked, 6)
+	bw.Write(data)
+	bw.Close()
+	inputs := []struct {
+		name       string
+		compressed []byte
+		threads    int
+	}{
+		{"gzip", plain.Bytes(), runtime.GOMAXPROCS(0)},
+		{"bgzf serial", blocked.Bytes(), 1},
+		{"bgzf parallel", blocked.Bytes(), max(2, runtime.GOMAXPROCS(0))},
+	}
+	for _, input := range inputs {
+		b.Run(input.name, func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				r, err := newCompressedReader(bufio.NewReader(bytes.NewReader(input.compressed)), input.threads)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if n, err := io.Copy(io.Discard, r); err != nil || n != int64(len(data)) {
+					b.Fatalf("read %d bytes of %d, %v", n, len(data), err)
+				}
+				r.Close()
+			}
+		})
+	}
+}
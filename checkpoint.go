@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// a checkpoint records how many records of an output are safely
+// written, so that an interrupted run can be resumed from there
+// instead of starting over. Outputs are then written to the actual
+// file rather than to a temporary file, and only in formats whose
+// batches are independently decodable, so that a resumed run can
+// simply append to what the interrupted run flushed.
+type checkpoint struct {
+	// the checkpoint file
+	name                       string
+	input, output, compression string
+	// the number of records in the output, and its size, as of the
+	// last checkpoint
+	records int
+	bytes   int64
+	// the output file
+	file     *os.File
+	interval time.Duration
+	saved    time.Time
+}
+
+// newCheckpoint prepares a checkpoint for correcting infastq into
+// outfastq, or, with -resume, reads the checkpoint of the run to
+// resume. It returns nil if the options ask for no checkpoint.
+func newCheckpoint(infastq, outfastq string, opts *options) (*checkpoint, error) {
+	if opts.checkpoint == "" {
+		return nil, nil
+	}
+	c := &checkpoint{
+		name:        opts.checkpoint,
+		input:       infastq,
+		output:      outfastq,
+		compression: outputCompression(outfastq, opts),
+		interval:    opts.checkpointInterval,
+		saved:       time.Now(),
+	}
+	if !opts.resume {
+		// cp.open truncates the output
+		if err := opts.checkOverwrite(outfastq); err != nil {
+			return nil, err
+		}
+		for _, name := range []string{c.name, outfastq} {
+			if err := opts.makeParents(name); err != nil {
+				return nil, err
+			}
+		}
+		return c, nil
+	}
+	saved, err := readCheckpoint(opts.checkpoint)
+	if err != nil {
+		return nil, err
+	}
+	for _, field := range []struct{ name, saved, current string }{
+		{"input", saved.input, c.input},
+		{"output", saved.output, c.output},
+		{"compression", saved.compression, c.compression},
+	} {
+		if field.saved != field.current {
+			return nil, fmt.Errorf("%s: cannot resume, the checkpoint is for %s %s, not %s", c.name, field.name, field.saved, field.current)
+		}
+	}
+	c.records, c.bytes = saved.records, saved.bytes
+	return c, nil
+}
+
+// readCheckpoint reads a checkpoint file, which has one
+// tab-separated name and value per line.
+func readCheckpoint(name string) (c checkpoint, err error) {
+	file, err := os.Open(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return c, fmt.Errorf("%s: no checkpoint to resume from, the run either completed or never started", name)
+	} else if err != nil {
+		return c, err
+	}
+	defer closeOnReturn(file, &err)
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), "\t")
+		if !ok {
+			return c, fmt.Errorf("%s: malformed checkpoint line %q", name, scanner.Text())
+		}
+		values[key] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return c, err
+	}
+	c.input, c.output, c.compression = values["input"], values["output"], values["compression"]
+	records, rerr := strconv.Atoi(values["records"])
+	bytes, berr := strconv.ParseInt(values["bytes"], 10, 64)
+	if rerr != nil || berr != nil || records < 0 || bytes < 0 || c.output == "" {
+		return c, fmt.Errorf("%s: malformed checkpoint", name)
+	}
+	c.records, c.bytes = records, bytes
+	return c, nil
+}
+
+// open creates the output, or, when resuming, opens it for
+// appending after the part that the checkpoint covers. Whatever the
+// interrupted run wrote after its last checkpoint is truncated, but
+// an output that is shorter than the checkpoint says cannot be
+// resumed.
+func (c *checkpoint) open(name string, opts *options) (*output, error) {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if opts.resume {
+		flags = os.O_WRONLY
+	}
+	file, err := os.OpenFile(name, flags, 0666)
+	if err != nil {
+		return nil, err
+	}
+	if opts.resume {
+		if err := c.truncate(file); err != nil {
+			_ = file.Close()
+			return nil, err
+		}
+	}
+	c.file = file
+	if !opts.resume {
+		// a run that is interrupted right away can be resumed too
+		if err := c.write(); err != nil {
+			_ = file.Close()
+			return nil, err
+		}
+	}
+	out, err := newBatchOutput(file, []io.Closer{file}, name, opts)
+	if err != nil {
+		return nil, err
+	}
+	if c.bytes > 0 {
+		if w, ok := out.closers[0].(*concatWriter); ok {
+			// the members are appended to those already written
+			w.empty = false
+		}
+	} else if opts.outputFormat != "fastq" {
+		if err := writeHeader(out, outputHeader(opts)); err != nil {
+			_ = out.abort()
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+func (c *checkpoint) truncate(file *os.File) error {
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() < c.bytes {
+		return fmt.Errorf("%s: cannot resume, the output is %d bytes, but checkpoint %s says %d bytes were written", c.output, info.Size(), c.name, c.bytes)
+	}
+	if err := file.Truncate(c.bytes); err != nil {
+		return err
+	}
+	_, err = file.Seek(0, io.SeekEnd)
+	return err
+}
+
+// save writes a checkpoint once the interval since the last one has
+// passed, after making sure that the records written to out so far
+// are on disk.
+func (c *checkpoint) save(out *output, records int) error {
+	if time.Since(c.saved) < c.interval {
+		return nil
+	}
+	if err := out.Flush(); err != nil {
+		return err
+	}
+	if err := c.file.Sync(); err != nil {
+		return err
+	}
+	info, err := c.file.Stat()
+	if err != nil {
+		return err
+	}
+	c.records, c.bytes = records, info.Size()
+	if err := c.write(); err != nil {
+		return err
+	}
+	c.saved = time.Now()
+	return nil
+}
+
+func (c *checkpoint) write() (err error) {
+	file, closers, err := createFile(c.name)
+	if err != nil {
+		return err
+	}
+	out := &output{Writer: bufio.NewWriter(file), closers: closers}
+	defer finishOutput(out, &err)
+	_, err = fmt.Fprintf(out, "input\t%s\noutput\t%s\ncompression\t%s\nrecords\t%d\nbytes\t%d\n", c.input, c.output, c.compression, c.records, c.bytes)
+	return err
+}
+
+// finish removes the checkpoint once the output is complete, since
+// there is nothing left to resume. It is meant to be deferred after
+// the output is finished.
+func (c *checkpoint) finish(err *error) {
+	if *err != nil {
+		return
+	}
+	if rerr := os.Remove(c.name); rerr != nil && !errors.Is(rerr, os.ErrNotExist) {
+		*err = rerr
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestCheckpointResume kills a run with a checkpoint once it saved
+// one, while its input is only partly written, and checks that the
+// resumed run has the same output as a run that is not interrupted.
+func TestCheckpointResume(t *testing.T) {
+	data := platinumFastq(4000)
+	half := bytes.Index(data[len(data)/2:], []byte("\n@")) + len(data)/2 + 1
+	for _, output := range []string{"out.fastq", "out.fastq.gz"} {
+		dir := t.TempDir()
+		reference := filepath.Join(dir, "reference.fastq")
+		if status, stderr := runProgramInput(t, data, "par", "-", reference); status != 0 {
+			t.Fatal(stderr)
+		}
+		want, err := os.ReadFile(reference)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		out, cp := filepath.Join(dir, output), filepath.Join(dir, "checkpoint")
+		cmd := programCommand("par", "-checkpoint", cp, "-checkpoint-interval", "0", "-batch-size", "100", "-", out)
+		stdin, err := cmd.StdinPipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			// the run blocks on the rest of the input until it is
+			// killed
+			_, _ = stdin.Write(data[:half])
+		}()
+		var saved checkpoint
+		for deadline := time.Now().Add(30 * time.Second); saved.records == 0; time.Sleep(10 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				_ = cmd.Process.Kill()
+				t.Fatalf("%s: no checkpoint was saved", output)
+			}
+			saved, _ = readCheckpoint(cp)
+		}
+		if err := cmd.Process.Kill(); err != nil {
+			t.Fatal(err)
+		}
+		_ = cmd.Wait()
+		file, err := os.OpenFile(out, os.O_WRONLY|os.O_APPEND, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// a batch that was written after the last checkpoint
+		if _, err := file.WriteString("partial batch"); err != nil {
+			t.Fatal(err)
+		}
+		if err := file.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		status, stderr := runProgramInput(t, data, "par", "-checkpoint", cp, "-resume", "-", out)
+		if status != 0 {
+			t.Fatalf("%s: resuming after %d records: %s", output, saved.records, stderr)
+		}
+		if got := readDecompressed(t, out); !bytes.Equal(got, want) {
+			t.Errorf("%s: resumed after %d records, got %d bytes, want %d", output, saved.records, len(got), len(want))
+		}
+		if _, err := os.Stat(cp); !os.IsNotExist(err) {
+			t.Errorf("%s: the checkpoint is left behind: %v", output, err)
+		}
+	}
+}
+
+// TestCheckpointMismatch checks that a run is not resumed from a
+// checkpoint that does not fit its output.
+func TestCheckpointMismatch(t *testing.T) {
+	existing := platinumFastq(10)
+	tests := []struct {
+		name  string
+		saved checkpoint
+		err   string
+	}{
+		{"longer than the output", checkpoint{output: "out.fastq", compression: "none", records: 10, bytes: 1 << 20}, fmt.Sprintf("cannot resume, the output is %d bytes, but checkpoint", len(existing))},
+		{"other output", checkpoint{output: "other.fastq", compression: "none", records: 1, bytes: 100}, "cannot resume, the checkpoint is for output"},
+		{"other compression", checkpoint{output: "out.fastq", compression: "gzip", records: 1, bytes: 100}, "cannot resume, the checkpoint is for compression gzip, not none"},
+	}
+	for _, test := range tests {
+		dir := t.TempDir()
+		in := writeFixture(t, dir, "in.fastq", platinumFastq(20))
+		out := writeFixture(t, dir, "out.fastq", existing)
+		saved := test.saved
+		saved.name, saved.input, saved.output = filepath.Join(dir, "checkpoint"), in, filepath.Join(dir, saved.output)
+		if err := saved.write(); err != nil {
+			t.Fatal(err)
+		}
+		status, stderr := runProgram(t, "par", "-checkpoint", saved.name, "-resume", in, out)
+		if status == 0 || !strings.Contains(stderr, test.err) {
+			t.Errorf("%s: exit status %d: %s, want %q", test.name, status, stderr, test.err)
+		}
+		if got, err := os.ReadFile(out); err != nil || !bytes.Equal(got, existing) {
+			t.Errorf("%s: the output was changed: %v", test.name, err)
+		}
+	}
+}
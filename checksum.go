@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// a checksum is computed while an output is written, and written
+// to a sidecar file in the format of md5sum once the output is
+// complete, or for -checksum, printed.
+type checksum struct {
+	hash hash.Hash
+	// the name of the sidecar file, and the file name it lists
+	sidecar, target string
+	// for -checksum, the hash algorithm to print
+	algorithm string
+	// the options, whose -force the sidecar file needs to replace
+	// an existing one
+	opts *options
+}
+
+// checksumHashes are the hash algorithms of -checksum.
+var checksumHashes = map[string]func() hash.Hash{"md5": md5.New, "sha256": sha256.New}
+
+func (c checksum) write() (err error) {
+	if c.sidecar == "" {
+		fmt.Fprintf(os.Stderr, "%s checksum of %s: %x\n", c.algorithm, c.target, c.hash.Sum(nil))
+		return nil
+	}
+	if err := c.opts.checkOverwrite(c.sidecar); err != nil {
+		return err
+	}
+	file, closers, err := createFile(c.sidecar)
+	if err != nil {
+		return err
+	}
+	out := &output{Writer: bufio.NewWriter(file), closers: closers}
+	defer finishOutput(out, &err)
+	_, err = fmt.Fprintf(out, "%x  %s\n", c.hash.Sum(nil), c.target)
+	return err
+}
+
+// an expectedChecksum is the checksum that -expected-checksum expects
+// the input to have, as read before decompression.
+type expectedChecksum struct {
+	algorithm string
+	sum       []byte
+}
+
+// parseExpectedChecksum parses an expected checksum given as
+// algorithm:hex, such as sha256:9f86d0..., with an algorithm of
+// checksumHashes.
+func parseExpectedChecksum(s string) (*expectedChecksum, error) {
+	algorithm, digest, ok := strings.Cut(s, ":")
+	if !ok {
+		return nil, errors.New("expected algorithm:hex, such as sha256:9f86d0...")
+	}
+	newHash, ok := checksumHashes[algorithm]
+	if !ok {
+		return nil, fmt.Errorf("unknown algorithm %q, must be md5 or sha256", algorithm)
+	}
+	sum, err := hex.DecodeString(digest)
+	if err != nil || len(sum) != newHash().Size() {
+		return nil, fmt.Errorf("invalid %s checksum %q", algorithm, digest)
+	}
+	return &expectedChecksum{algorithm, sum}, nil
+}
+
+// verify reads the rest of an input that is checked against an
+// expected checksum while it is read, which the decompressor may
+// have left unread, and fails if its checksum differs. It must be
+// called once the records are read, before the outputs are
+// complete, so that they are aborted instead.
+func (in *input) verify() error {
+	if in.expected == nil {
+		return nil
+	}
+	if _, err := io.Copy(io.Discard, in.raw); err != nil {
+		return err
+	}
+	return in.expected.check(in.name, in.hash.Sum(nil))
+}
+
+// check fails if the checksum of an input differs from the expected
+// one.
+func (e *expectedChecksum) check(name string, sum []byte) error {
+	if !bytes.Equal(sum, e.sum) {
+		return fmt.Errorf("%s checksum of %s is %x, but %x was expected", e.algorithm, name, sum, e.sum)
+	}
+	return nil
+}
+
+// checkFile verifies the checksum of a regular file in a pass of its
+// own, before anything is written, and rewinds it for reading it
+// again.
+func (e *expectedChecksum) checkFile(f *os.File) error {
+	h := checksumHashes[e.algorithm]()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	if err := e.check(f.Name(), h.Sum(nil)); err != nil {
+		return err
+	}
+	_, err := f.Seek(0, io.SeekStart)
+	return err
+}
+
+// plainName returns the name of an output without its compression
+// extension, or "" if it has none.
+func plainName(name string) string {
+	if ext := filepath.Ext(name); slices.Contains(compressionExtensions, ext) {
+		return strings.TrimSuffix(name, ext)
+	}
+	return ""
+}
+
+// startChecksums sets up the checksums that the options ask for on
+// an output written to file: the one to print for -checksum,
+// out.fastq.gz.md5 of the file as it is written for -write-md5, and
+// out.fastq.md5 of its uncompressed content for
+// -write-md5-uncompressed. It returns the writer to
+// write the file through, and, if the output is compressed, the
+// writer to write the uncompressed content through, or nil if its
+// checksum is not needed.
+func startChecksums(file io.Writer, name string, opts *options) (io.Writer, io.Writer, []checksum, error) {
+	var checksums []checksum
+	if opts.checksum != "" {
+		c := checksum{hash: checksumHashes[opts.checksum](), target: name, algorithm: opts.checksum}
+		if isStdio(name) {
+			c.target = "standard output"
+		}
+		checksums = append(checksums, c)
+		file = io.MultiWriter(file, c.hash)
+	}
+	if !opts.writeMD5 && !opts.writeMD5Uncompressed {
+		return file, nil, checksums, nil
+	}
+	if isStdio(name) {
+		return nil, nil, nil, errors.New("cannot write an md5 file for standard output")
+	}
+	base := filepath.Base(name)
+	if outputCompression(name, opts) == "none" {
+		// both checksums are the same
+		c := checksum{hash: md5.New(), sidecar: name + ".md5", target: base, opts: opts}
+		return io.MultiWriter(file, c.hash), nil, append(checksums, c), nil
+	}
+	if opts.writeMD5 {
+		c := checksum{hash: md5.New(), sidecar: name + ".md5", target: base, opts: opts}
+		checksums = append(checksums, c)
+		file = io.MultiWriter(file, c.hash)
+	}
+	var plain io.Writer
+	if opts.writeMD5Uncompressed {
+		c := checksum{hash: md5.New(), sidecar: plainName(name) + ".md5", target: filepath.Base(plainName(name)), opts: opts}
+		if plainName(name) == "" {
+			// without an extension to remove, such as for
+			// -compression gzip out.fastq
+			c.sidecar, c.target = name+".uncompressed.md5", base
+		}
+		checksums = append(checksums, c)
+		plain = c.hash
+	}
+	return file, plain, checksums, nil
+}
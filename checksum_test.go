@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExpectedChecksum(t *testing.T) {
+	dir := t.TempDir()
+	data := platinumFastq(1000)
+	in := writeFixture(t, dir, "in.fastq", data)
+	good := fmt.Sprintf("sha256:%x", sha256.Sum256(data))
+	bad := fmt.Sprintf("sha256:%x", sha256.Sum256(data[1:]))
+	tests := []struct {
+		name     string
+		checksum string
+		input    string
+		failed   bool
+	}{
+		{"file", good, in, false},
+		{"file mismatch", bad, in, true},
+		{"standard input", good, "-", false},
+		{"standard input mismatch", bad, "-", true},
+	}
+	for _, test := range tests {
+		for _, mode := range []string{"seq", "par"} {
+			t.Run(test.name+", "+mode, func(t *testing.T) {
+				out := filepath.Join(t.TempDir(), "out.fastq.gz")
+				var stdin []byte
+				if test.input == "-" {
+					stdin = data
+				}
+				status, stderr := runProgramInput(t, stdin, mode, "-write-md5", "-expected-checksum", test.checksum, test.input, out)
+				if (status != 0) != test.failed {
+					t.Fatalf("exit status %d: %s", status, stderr)
+				}
+				_, err := os.Stat(out)
+				if !test.failed {
+					if err != nil {
+						t.Error(err)
+					}
+					return
+				}
+				if !strings.Contains(stderr, "was expected") {
+					t.Errorf("no mismatch reported: %s", stderr)
+				}
+				if err == nil {
+					t.Error("the output was completed")
+				}
+				if _, err := os.Stat(out + ".md5"); err == nil {
+					t.Error("the md5 of the output was written")
+				}
+				// a local file is checked before any record is read
+				if test.input != "-" && strings.Contains(stderr, "Processed") {
+					t.Errorf("records were processed: %s", stderr)
+				}
+			})
+		}
+	}
+}
+
+// TestWriteMD5 checks that the md5 sidecars of the outputs of both
+// modes hold the md5 of the output, and of its uncompressed content,
+// in the format of md5sum, and that md5sum -c accepts them, where it
+// is installed.
+func TestWriteMD5(t *testing.T) {
+	in := writeFixture(t, t.TempDir(), "in.fastq", platinumFastq(3000))
+	md5sum, _ := exec.LookPath("md5sum")
+	for _, output := range []string{"out.fastq.gz", "out.fastq"} {
+		for _, mode := range []string{"seq", "par"} {
+			dir := t.TempDir()
+			out := filepath.Join(dir, output)
+			if status, stderr := runProgram(t, mode, "-write-md5", "-write-md5-uncompressed", in, out); status != 0 {
+				t.Fatalf("%s, %s: %s", output, mode, stderr)
+			}
+			written, err := os.ReadFile(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sidecars := map[string]string{
+				output + ".md5": fmt.Sprintf("%x  %s\n", md5.Sum(written), output),
+				"out.fastq.md5": fmt.Sprintf("%x  out.fastq\n", md5.Sum(readDecompressed(t, out))),
+			}
+			for sidecar, want := range sidecars {
+				if got, err := os.ReadFile(filepath.Join(dir, sidecar)); err != nil || string(got) != want {
+					t.Errorf("%s, %s: %s is %q, %v, want %q", output, mode, sidecar, got, err, want)
+				}
+			}
+			if md5sum == "" {
+				continue
+			}
+			cmd := exec.Command(md5sum, "-c", output+".md5")
+			cmd.Dir = dir
+			if result, err := cmd.CombinedOutput(); err != nil {
+				t.Errorf("%s, %s: md5sum -c: %v: %s", output, mode, err, result)
+			}
+		}
+	}
+}
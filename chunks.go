@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"math"
+	"path"
+	"slices"
+	"strings"
+)
+
+// a chunk of the output, with the number of records written to it
+type chunk struct {
+	name    string
+	records int
+}
+
+// chunkedOutput writes to a single output, or, with a chunk size,
+// to a series of numbered outputs with at most that many records
+// each. The next chunk is only created once a record does not fit
+// into the current one.
+type chunkedOutput struct {
+	name      string
+	chunkSize int
+	opts      *options
+	// open creates the output for a chunk
+	open func(name string, opts *options) (*output, error)
+	// the batch compressor of all chunks, if batches are
+	// compressed by the caller
+	compressor *batchCompressor
+	out        *output
+	chunks     []chunk
+}
+
+// newChunkedOutput creates the first output, with open, and
+// chunks of chunkSize records, or a single output if chunkSize
+// is 0.
+func newChunkedOutput(name string, chunkSize int, opts *options, open func(name string, opts *options) (*output, error)) (*chunkedOutput, error) {
+	if chunkSize > 0 && isStdio(name) {
+		return nil, fmt.Errorf("cannot write chunks to standard output")
+	}
+	c := &chunkedOutput{name: name, chunkSize: chunkSize, opts: opts, open: open}
+	if chunkSize > 0 && !opts.dryRun {
+		if err := opts.checkOverwrite(manifestName(name)); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.nextChunk(); err != nil {
+		return nil, err
+	}
+	c.compressor = c.out.compressor
+	return c, nil
+}
+
+// chunkName derives the name of a chunk from the name of a
+// complete output, by inserting the chunk number before the fastq
+// and compression extensions: out.fastq.gz becomes
+// out_0001.fastq.gz.
+func chunkName(name string, index int) string {
+	base, ext := splitFastqExtensions(name)
+	return fmt.Sprintf("%s_%04d%s", base, index, ext)
+}
+
+// splitFastqExtensions splits a name into the part before its
+// fastq, SAM, or BAM and compression extensions, and those extensions.
+func splitFastqExtensions(name string) (base, ext string) {
+	base = name
+	if e := path.Ext(base); slices.Contains(compressionExtensions, e) {
+		base = strings.TrimSuffix(base, e)
+	}
+	if e := path.Ext(base); slices.Contains(fastqExtensions, e) || e == ".sam" || e == ".bam" {
+		base = strings.TrimSuffix(base, e)
+	}
+	return base, name[len(base):]
+}
+
+func (c *chunkedOutput) nextChunk() (err error) {
+	name := c.name
+	if c.chunkSize > 0 {
+		name = chunkName(c.name, len(c.chunks)+1)
+	}
+	if c.out, err = c.open(name, c.opts); err != nil {
+		return err
+	}
+	c.chunks = append(c.chunks, chunk{name: name})
+	// the checkpoint writes the header unless a resumed output
+	// already starts with it
+	if c.opts.outputFormat != "fastq" && c.opts.checkpoint == "" {
+		return writeHeader(c.out, outputHeader(c.opts))
+	}
+	return nil
+}
+
+// writeHeader writes a header to an output before any batches,
+// compressed with the output's batch compressor, if it has one.
+func writeHeader(out *output, header []byte) error {
+	if out.compressor == nil {
+		_, err := out.Write(header)
+		return err
+	}
+	var compressed bytes.Buffer
+	if err := out.compressor.compress(&compressed, header); err != nil {
+		return err
+	}
+	if out.plain != nil {
+		_, _ = out.plain.Write(header)
+	}
+	out.uncompressed.Add(int64(len(header)))
+	_, err := out.Write(compressed.Bytes())
+	return err
+}
+
+// next returns the output for the next n records. With a chunk
+// size, the records must fit into a single chunk, which the
+// callers ensure by splitting batches at the room that is left.
+func (c *chunkedOutput) next(n int) (*output, error) {
+	current := &c.chunks[len(c.chunks)-1]
+	if c.chunkSize > 0 && current.records > 0 && current.records+n > c.chunkSize {
+		if err := c.out.Close(); err != nil {
+			return nil, err
+		}
+		if err := c.nextChunk(); err != nil {
+			return nil, err
+		}
+		current = &c.chunks[len(c.chunks)-1]
+	}
+	current.records += n
+	return c.out, nil
+}
+
+// manifestName returns the name of the file that lists the chunks
+// of an output: out.fastq.gz has out.chunks.tsv.
+func manifestName(name string) string {
+	base, _ := splitFastqExtensions(name)
+	return base + ".chunks.tsv"
+}
+
+// writeManifest lists the names of the chunks and their numbers
+// of records, separated by a tab, one chunk per line.
+func (c *chunkedOutput) writeManifest() (err error) {
+	file, closers, err := createFile(manifestName(c.name))
+	if err != nil {
+		return err
+	}
+	out := &output{Writer: bufio.NewWriter(file), closers: closers}
+	defer finishOutput(out, &err)
+	for _, chunk := range c.chunks {
+		if _, err := fmt.Fprintf(out, "%s\t%d\n", chunk.name, chunk.records); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// finish closes the current output, and writes the manifest of
+// the chunks, or aborts the current output if err holds an error.
+// It is meant to be deferred.
+func (c *chunkedOutput) finish(err *error) {
+	if c.out == nil {
+		// the next chunk could not be created, after the previous
+		// one was closed
+		return
+	}
+	if finishOutput(c.out, err); *err == nil && c.chunkSize > 0 && !c.opts.dryRun {
+		*err = c.writeManifest()
+	}
+}
+
+// room returns the number of records that the next batch can have
+// without crossing a chunk boundary.
+func (c *chunkedOutput) room() int {
+	if c.chunkSize == 0 {
+		return math.MaxInt
+	}
+	if current := c.chunks[len(c.chunks)-1].records; current < c.chunkSize {
+		return c.chunkSize - current
+	}
+	return c.chunkSize
+}
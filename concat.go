@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// correctConcatenated corrects several inputs into a single output,
+// one after the other, so that the output holds the corrected
+// records of each input in the order of the inputs, as if they were
+// corrected separately and concatenated. In par mode, each input
+// gets its own pipeline, whose batches are all written before the
+// next input is opened.
+func correctConcatenated(infastqs []string, outfastq string, parallel bool, opts *options) (err error) {
+	start := time.Now()
+	how := "sequentially"
+	if parallel {
+		how = "in parallel"
+	}
+	if opts.dryRun {
+		fmt.Fprintf(os.Stderr, "Checking platinum fastq sequence identifiers %s: %s\n", how, strings.Join(infastqs, ", "))
+	} else {
+		fmt.Fprintf(os.Stderr, "Correcting platinum fastq sequence identifiers %s: %s to %s\n", how, strings.Join(infastqs, ", "), outfastq)
+	}
+
+	open := openOutput
+	if parallel {
+		open = openBatchOutput
+	}
+	chunks, err := newChunkedOutput(outfastq, opts.chunkSize, opts, open)
+	if err != nil {
+		return err
+	}
+	defer chunks.finish(&err)
+	qc, err := newQCSample(opts, open)
+	if err != nil {
+		return err
+	}
+	if qc != nil {
+		defer qc.finish(&err)
+	}
+
+	w := batchWriter{chunks: chunks}
+	for _, infastq := range infastqs {
+		var err error
+		if parallel {
+			err = correctConcatenatedParallel(infastq, &w, qc, opts)
+		} else {
+			err = correctConcatenatedSequential(infastq, chunks, qc, opts)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", infastq, err)
+		}
+	}
+	if !opts.dryRun {
+		records := 0
+		for _, chunk := range chunks.chunks {
+			records += chunk.records
+		}
+		fmt.Fprintf(os.Stderr, "Concatenated %s records from %d inputs into %s in %.1fs\n", groupDigits(int64(records)), len(infastqs), outfastq, time.Since(start).Seconds())
+	}
+	return nil
+}
+
+// correctConcatenatedSequential corrects one of the inputs of
+// correctConcatenated in seq mode.
+func correctConcatenatedSequential(infastq string, chunks *chunkedOutput, qc *qcSample, opts *options) (err error) {
+	input, err := opts.open(infastq, 1)
+	if err != nil {
+		return err
+	}
+	defer closeOnReturn(input, &err)
+	return correctInputSequential(infastq, input, chunks, qc, time.Now(), opts)
+}
+
+// correctConcatenatedParallel corrects one of the inputs of
+// correctConcatenated in par mode. w splits its batches at the
+// chunk boundaries, after the records that it already wrote.
+func correctConcatenatedParallel(infastq string, w *batchWriter, qc *qcSample, opts *options) (err error) {
+	start := time.Now()
+	src, err := newSource(infastq, opts)
+	if err != nil {
+		return err
+	}
+	defer closeOnReturn(src, &err)
+	src.progress = startProgress(infastq, src.input, start, opts)
+	defer src.progress.cancel()
+	return correctSourceParallel(src, w, qc, nil, start, opts)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestConcat corrects two inputs into a single output in both modes,
+// and checks that the output is the same as correcting them
+// separately and concatenating the results, and that a failure names
+// the input it happened in.
+func TestConcat(t *testing.T) {
+	dir := t.TempDir()
+	inputs := []string{
+		writeFixture(t, dir, "lane1.fastq", platinumMates(1000, '1')),
+		writeFixture(t, dir, "lane2.fastq.gz", gzipped(t, platinumMates(700, '2'))),
+	}
+	var want []byte
+	for _, in := range inputs {
+		out := filepath.Join(t.TempDir(), "out.fastq")
+		if status, stderr := runProgram(t, "seq", in, out); status != 0 {
+			t.Fatal(stderr)
+		}
+		want = append(want, readDecompressed(t, out)...)
+	}
+	bad := writeFixture(t, dir, "bad.fastq", []byte("@ERR194147.1\nACGT\n+\nIIII\n"))
+	for _, name := range []string{"out.fastq", "out.fastq.gz"} {
+		for _, mode := range []string{"seq", "par"} {
+			out := filepath.Join(t.TempDir(), name)
+			status, stderr := runProgram(t, mode, "-concat", "-batch-size", "300", inputs[0], inputs[1], out)
+			if status != 0 {
+				t.Fatalf("%s, %s: %s", name, mode, stderr)
+			}
+			if got := readDecompressed(t, out); !bytes.Equal(got, want) {
+				t.Errorf("%s, %s: got %d bytes, want the %d bytes of the separate outputs", name, mode, len(got), len(want))
+			}
+			if summary := "Concatenated 1 700 records from 2 inputs into " + out + " in "; !strings.Contains(stderr, summary) {
+				t.Errorf("%s, %s: stderr %q does not contain %q", name, mode, stderr, summary)
+			}
+
+			out = filepath.Join(t.TempDir(), name)
+			status, stderr = runProgram(t, mode, "-concat", inputs[0], bad, out)
+			if want := bad + ": record 1: malformed identifier line, missing suffix"; status != 1 || !strings.Contains(stderr, want) {
+				t.Errorf("%s, %s: exit status %d: %s, want %q", name, mode, status, stderr, want)
+			}
+			if entries, _ := filepath.Glob(filepath.Join(filepath.Dir(out), "*")); len(entries) > 0 {
+				t.Errorf("%s, %s: a failed run left %v behind", name, mode, entries)
+			}
+		}
+	}
+}
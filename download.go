@@ -0,0 +1,189 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// isURL reports whether an input name is a URL rather than a file
+// name.
+func isURL(name string) bool {
+	u, err := url.Parse(name)
+	if err != nil {
+		return false
+	}
+	switch u.Scheme {
+	case "http", "https", "ftp", "s3":
+		return true
+	}
+	return false
+}
+
+// openURL starts downloading a URL.
+func openURL(name string) (*download, error) {
+	u, err := url.Parse(name)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "ftp":
+		return openFTP(u)
+	case "s3":
+		d, err := openS3(u)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		return d, nil
+	}
+	return openHTTP(name)
+}
+
+// errResourceChanged reports that a download cannot be resumed,
+// because the resource changed in the meantime.
+var errResourceChanged = errors.New("the resource changed while resuming the download")
+
+// downloadIdleTimeout limits how long a read of a download may wait
+// for data. A transfer that stalls for longer is treated as
+// interrupted, and resumed if possible.
+var downloadIdleTimeout = time.Minute
+
+// downloadMaxRetries is the number of times in a row an
+// interrupted download is resumed without making progress before
+// giving up.
+const downloadMaxRetries = 5
+
+// downloadRetryDelay is how much longer each attempt in a row to
+// resume a download waits before it starts.
+var downloadRetryDelay = time.Second
+
+// download streams a remote resource. If the transfer is
+// interrupted before the resource is complete, and the protocol
+// allows starting at an offset, it resumes the transfer where it
+// left off.
+type download struct {
+	// open starts transferring the resource at the given offset,
+	// which is only nonzero if resumable is set
+	open      func(offset int64) (io.ReadCloser, error)
+	resumable bool
+	body      io.ReadCloser
+	// bytes of the resource read so far
+	offset int64
+	// the size of the resource, or -1 if unknown
+	size    int64
+	retries int
+}
+
+func (d *download) Read(p []byte) (int, error) {
+	for {
+		n, err := d.body.Read(p)
+		d.offset += int64(n)
+		if n > 0 {
+			d.retries = 0
+		}
+		if err == io.EOF {
+			// some protocols only report an incomplete transfer
+			// when it is closed
+			body := d.body
+			d.body = nil
+			if err = body.Close(); err == nil {
+				err = io.EOF
+				if d.size >= 0 && d.offset < d.size {
+					err = io.ErrUnexpectedEOF
+				}
+			}
+		}
+		if err == nil || err == io.EOF {
+			return n, err
+		}
+		if rerr := d.resume(err); rerr != nil {
+			return n, d.error(rerr)
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// error annotates an error with how far the download got.
+func (d *download) error(err error) error {
+	if d.size >= 0 {
+		return fmt.Errorf("after %d of %d bytes: %w", d.offset, d.size, err)
+	}
+	return fmt.Errorf("after %d bytes: %w", d.offset, err)
+}
+
+// resume continues an interrupted download, or returns the error
+// that interrupted it if that is not possible.
+func (d *download) resume(cause error) error {
+	if d.body != nil {
+		_ = d.body.Close()
+		d.body = nil
+	}
+	if !d.resumable {
+		return cause
+	}
+	err := fmt.Errorf("no progress after resuming %d times", downloadMaxRetries)
+	for ; d.retries < downloadMaxRetries; d.retries++ {
+		time.Sleep(time.Duration(d.retries) * downloadRetryDelay)
+		var body io.ReadCloser
+		if body, err = d.open(d.offset); errors.Is(err, errResourceChanged) {
+			break
+		} else if err != nil {
+			continue
+		}
+		d.body = body
+		d.retries++
+		return nil
+	}
+	return fmt.Errorf("%w, and resuming failed: %v", cause, err)
+}
+
+func (d *download) Close() error {
+	if d.body == nil {
+		return nil
+	}
+	return d.body.Close()
+}
+
+// idleTimeoutBody closes a body that does not deliver data within
+// downloadIdleTimeout of a read, for bodies without read deadlines,
+// such as those of HTTP responses, which closing unblocks.
+type idleTimeoutBody struct {
+	body     io.ReadCloser
+	timeout  time.Duration
+	timer    *time.Timer
+	timedOut atomic.Bool
+}
+
+func newIdleTimeoutBody(body io.ReadCloser) *idleTimeoutBody {
+	b := &idleTimeoutBody{body: body, timeout: downloadIdleTimeout}
+	b.timer = time.AfterFunc(b.timeout, func() {
+		b.timedOut.Store(true)
+		_ = b.body.Close()
+	})
+	b.timer.Stop()
+	return b
+}
+
+func (b *idleTimeoutBody) Read(p []byte) (int, error) {
+	b.timer.Reset(b.timeout)
+	n, err := b.body.Read(p)
+	b.timer.Stop()
+	if b.timedOut.Load() {
+		return n, fmt.Errorf("no data received for %v: %w", b.timeout, os.ErrDeadlineExceeded)
+	}
+	return n, err
+}
+
+func (b *idleTimeoutBody) Close() error {
+	b.timer.Stop()
+	if b.timedOut.Load() {
+		return nil
+	}
+	return b.body.Close()
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// stallingServer serves data, but the first requests stop sending
+// halfway, and then stall or drop the connection. It supports range
+// requests if resumable is set.
+func stallingServer(t *testing.T, data []byte, interruptions int, stall, resumable bool) (*httptest.Server, *atomic.Int32) {
+	var requests atomic.Int32
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(requests.Add(1))
+		offset := 0
+		if rng := r.Header.Get("Range"); rng != "" {
+			if !resumable || r.Header.Get("If-Range") != `"v1"` {
+				t.Errorf("unexpected Range %q", rng)
+			}
+			offset, _ = strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(rng, "bytes="), "-"))
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, len(data)-1, len(data)))
+			w.Header().Set("Content-Length", strconv.Itoa(len(data)-offset))
+			w.WriteHeader(http.StatusPartialContent)
+		} else {
+			if resumable {
+				w.Header().Set("Accept-Ranges", "bytes")
+			}
+			w.Header().Set("ETag", `"v1"`)
+			w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		}
+		rest := data[offset:]
+		if n > interruptions {
+			_, _ = w.Write(rest)
+			return
+		}
+		_, _ = w.Write(rest[:len(rest)/2])
+		w.(http.Flusher).Flush()
+		if stall {
+			select {
+			case <-done:
+			case <-r.Context().Done():
+			}
+			return
+		}
+		// drop the connection without completing the body
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		_ = conn.Close()
+	}))
+	t.Cleanup(func() {
+		close(done)
+		server.Close()
+	})
+	return server, &requests
+}
+
+func TestHTTPDownload(t *testing.T) {
+	defer func(timeout time.Duration) { downloadIdleTimeout = timeout }(downloadIdleTimeout)
+	downloadIdleTimeout = 200 * time.Millisecond
+	data := platinumFastq(2000)
+	tests := []struct {
+		name          string
+		interruptions int
+		stall         bool
+		resumable     bool
+		failed        bool
+	}{
+		{"complete", 0, false, true, false},
+		{"dropped", 2, false, true, false},
+		{"stalled", 2, true, true, false},
+		{"stalled without ranges", 1, true, false, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server, requests := stallingServer(t, data, test.interruptions, test.stall, test.resumable)
+			d, err := openHTTP(server.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			start := time.Now()
+			got, err := io.ReadAll(d)
+			d.Close()
+			if test.failed {
+				if err == nil || !strings.Contains(err.Error(), "no data received") {
+					t.Fatalf("got %v", err)
+				}
+				return
+			}
+			if err != nil || !bytes.Equal(got, data) {
+				t.Fatalf("read %d bytes of %d after %d requests: %v", len(got), len(data), requests.Load(), err)
+			}
+			if int(requests.Load()) != test.interruptions+1 {
+				t.Errorf("%d requests, want %d", requests.Load(), test.interruptions+1)
+			}
+			if elapsed := time.Since(start); test.stall && elapsed > time.Duration(test.interruptions)*downloadIdleTimeout+5*time.Second {
+				t.Errorf("took %v", elapsed)
+			}
+		})
+	}
+}
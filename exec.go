@@ -0,0 +1,286 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// fifoBufferSize is how many bytes a fifoWriter holds in memory for
+// a pipe that is not read fast enough.
+var fifoBufferSize = 64 << 20
+
+// a fifoWriter writes to a named pipe from a goroutine of its own,
+// and queues what is written to it in the meantime, up to
+// fifoBufferSize bytes. The child of exec mode may read its pipes in
+// any order, such as bwa mem, which reads a batch of one mate file
+// and then the same number of mates from the other, or even one
+// after the other, such as cat. Since the paired pipeline writes each
+// batch to one output and then to the other, blocking on a full pipe
+// could then block it forever, so with spill, what does not fit in
+// memory is queued in a temporary file instead. Without spill, Write
+// blocks until the pipe is read.
+type fifoWriter struct {
+	mutex sync.Mutex
+	// signaled when the queue grows, shrinks, or ends
+	ready  sync.Cond
+	queue  []fifoChunk
+	closed bool
+	err    error
+	// the number of bytes queued in memory
+	pending int
+	// with spill, the temporary file for what does not fit in
+	// memory, and the offset to queue its next chunk at
+	spill     bool
+	spillFile *os.File
+	spillEnd  int64
+	// closed once the pipe is closed, after which err is final
+	done chan struct{}
+}
+
+// a fifoChunk is what one Write queued, in memory, or if data is
+// nil, the size bytes at offset in the temporary file.
+type fifoChunk struct {
+	data         []byte
+	offset, size int64
+}
+
+// newFifoWriter returns a fifoWriter that writes to the pipe that
+// open opens, from the goroutine of the writer, so that opening it
+// may block without blocking the writes until the queue is full.
+func newFifoWriter(open func() (*os.File, error), spill bool) *fifoWriter {
+	w := &fifoWriter{spill: spill, done: make(chan struct{})}
+	w.ready.L = &w.mutex
+	go w.run(open)
+	return w
+}
+
+func (w *fifoWriter) run(open func() (*os.File, error)) {
+	defer close(w.done)
+	file, err := open()
+	for err == nil {
+		w.mutex.Lock()
+		for len(w.queue) == 0 && !w.closed {
+			w.ready.Wait()
+		}
+		queue := w.queue
+		w.queue = nil
+		w.mutex.Unlock()
+		if len(queue) == 0 {
+			err = file.Close()
+			break
+		}
+		for _, chunk := range queue {
+			if chunk.data != nil {
+				_, err = file.Write(chunk.data)
+			} else {
+				_, err = io.Copy(file, io.NewSectionReader(w.spillFile, chunk.offset, chunk.size))
+			}
+			if err != nil {
+				_ = file.Close()
+				break
+			}
+			w.mutex.Lock()
+			w.pending -= len(chunk.data)
+			if chunk.data == nil && chunk.offset+chunk.size == w.spillEnd {
+				// everything in the file is written, so it can
+				// be reused from the start
+				w.spillEnd = 0
+				err = w.spillFile.Truncate(0)
+			}
+			w.ready.Broadcast()
+			w.mutex.Unlock()
+			if err != nil {
+				break
+			}
+		}
+	}
+	w.mutex.Lock()
+	w.err, w.queue, w.pending = err, nil, 0
+	if w.spillFile != nil {
+		_ = w.spillFile.Close()
+	}
+	w.ready.Broadcast()
+	w.mutex.Unlock()
+}
+
+func (w *fifoWriter) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	for !w.spill && w.err == nil && !w.closed && w.pending >= fifoBufferSize {
+		w.ready.Wait()
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+	if w.closed {
+		return 0, os.ErrClosed
+	}
+	if w.spill && w.pending+len(p) > fifoBufferSize {
+		if err := w.spillChunk(p); err != nil {
+			return 0, err
+		}
+	} else {
+		w.queue = append(w.queue, fifoChunk{data: append([]byte(nil), p...)})
+		w.pending += len(p)
+	}
+	w.ready.Broadcast()
+	return len(p), nil
+}
+
+// spillChunk queues p in the temporary file, which it creates first
+// if needed. The file is removed right away, so that it is gone once
+// it is closed, however the program ends.
+func (w *fifoWriter) spillChunk(p []byte) error {
+	if w.spillFile == nil {
+		file, err := os.CreateTemp("", program+"-")
+		if err != nil {
+			return err
+		}
+		_ = os.Remove(file.Name())
+		w.spillFile = file
+	}
+	if _, err := w.spillFile.WriteAt(p, w.spillEnd); err != nil {
+		return err
+	}
+	w.queue = append(w.queue, fifoChunk{offset: w.spillEnd, size: int64(len(p))})
+	w.spillEnd += int64(len(p))
+	return nil
+}
+
+// Close closes the pipe once everything queued is written, without
+// waiting for that, since the child may only read this pipe after
+// the others are closed. The child sees the end of its input once it
+// has read everything.
+func (w *fifoWriter) Close() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.closed = true
+	w.ready.Broadcast()
+	return w.err
+}
+
+// Abort discards what is still queued, and closes the pipe.
+func (w *fifoWriter) Abort() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.queue, w.pending, w.closed = nil, 0, true
+	w.ready.Broadcast()
+	return nil
+}
+
+// wait waits until the pipe is closed, and returns the first error
+// writing to it.
+func (w *fifoWriter) wait() error {
+	<-w.done
+	return w.err
+}
+
+// execPlaceholders are replaced in the command of exec mode by the
+// named pipes that the corrected mates are written to.
+var execPlaceholders = []string{"{r1}", "{r2}"}
+
+// correctExec corrects one input, or two mate files, into named
+// pipes, and runs command with the pipes substituted for {r1} and
+// {r2}, so that it reads the corrected records as they are written,
+// without them ever being stored. If either the correction or the
+// command fails, the other is stopped as well. It returns the exit
+// status of the command, or 1 if the correction failed while the
+// command succeeded or could not be started.
+func correctExec(infastqs, command []string, opts *options) (status int, err error) {
+	dir, err := os.MkdirTemp("", program+"-")
+	if err != nil {
+		return 1, err
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	fifos := make([]string, len(infastqs))
+	var readers []io.Closer
+	defer func() { _ = closeAll(readers) }()
+	for i := range infastqs {
+		fifos[i] = filepath.Join(dir, fmt.Sprintf("r%d.fastq", i+1))
+		reader, err := createFifo(fifos[i])
+		if err != nil {
+			return 1, err
+		}
+		readers = append(readers, reader)
+	}
+	args := make([]string, len(command))
+	for i, arg := range command {
+		for j, fifo := range fifos {
+			arg = strings.ReplaceAll(arg, execPlaceholders[j], fifo)
+		}
+		args[i] = arg
+	}
+
+	var writers []*fifoWriter
+	execOpts := *opts
+	execOpts.create = func(name string) (io.Writer, []io.Closer, error) {
+		w := newFifoWriter(func() (*os.File, error) { return openFifo(name) }, true)
+		writers = append(writers, w)
+		return w, []io.Closer{w}, nil
+	}
+
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Start(); err != nil {
+		return 1, err
+	}
+	// the readers are now closed once the command exits, since
+	// writing to the pipes fails once nothing reads them anymore
+	keepers := readers
+	readers = nil
+	exited := make(chan error, 1)
+	go func() {
+		err := cmd.Wait()
+		_ = closeAll(keepers)
+		exited <- err
+	}()
+	corrected := make(chan error, 1)
+	go func() {
+		if len(infastqs) == 2 {
+			corrected <- correctPairedParallel(infastqs[0], infastqs[1], fifos, &execOpts)
+		} else {
+			corrected <- correctPlatinumFastqSequenceIdentifierParallel(infastqs[0], fifos[0], &execOpts)
+		}
+	}()
+
+	var waitErr error
+	killed := false
+	select {
+	case err = <-corrected:
+		if err != nil {
+			killed = cmd.Process.Kill() == nil
+		}
+		waitErr = <-exited
+	case waitErr = <-exited:
+		if err = <-corrected; err != nil {
+			err = fmt.Errorf("%s exited before reading all records: %w", args[0], err)
+		}
+	}
+	for _, w := range writers {
+		if werr := w.wait(); err == nil {
+			err = werr
+		}
+	}
+
+	var exitErr *exec.ExitError
+	switch {
+	case waitErr == nil && err != nil:
+		return 1, err
+	case waitErr == nil:
+		return 0, nil
+	case killed:
+		return 1, err
+	case errors.As(waitErr, &exitErr) && exitErr.Exited():
+		// any failure of the correction is most likely because the
+		// command stopped reading
+		return exitErr.ExitCode(), fmt.Errorf("%s: %w", args[0], waitErr)
+	}
+	return 1, fmt.Errorf("%s: %w", args[0], waitErr)
+}
@@ -0,0 +1,137 @@
+//go:build unix
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFifoWriter(t *testing.T) {
+	defer func(size int) { fifoBufferSize = size }(fifoBufferSize)
+	fifoBufferSize = 16 << 10
+	chunk := bytes.Repeat([]byte("ACGT"), 1024)
+	const chunks = 100
+	for _, spill := range []bool{false, true} {
+		r, pipe, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := newFifoWriter(func() (*os.File, error) { return pipe, nil }, spill)
+		written := make(chan error, 1)
+		go func() {
+			for range chunks {
+				if _, err := w.Write(chunk); err != nil {
+					written <- err
+					return
+				}
+			}
+			written <- w.Close()
+		}()
+		// nothing reads the pipe yet, which holds much less than
+		// what is written
+		select {
+		case err := <-written:
+			if !spill {
+				t.Fatalf("writing without spill did not block until the pipe was read: %v", err)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(200 * time.Millisecond):
+			if spill {
+				t.Fatal("writing with spill blocked")
+			}
+		}
+		w.mutex.Lock()
+		if w.pending > fifoBufferSize+len(chunk) {
+			t.Errorf("spill %v: %d bytes queued in memory", spill, w.pending)
+		}
+		w.mutex.Unlock()
+		got, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := w.wait(); err != nil {
+			t.Fatal(err)
+		}
+		if !spill {
+			if err := <-written; err != nil {
+				t.Fatal(err)
+			}
+		}
+		if !bytes.Equal(got, bytes.Repeat(chunk, chunks)) {
+			t.Errorf("spill %v: read %d bytes of %d", spill, len(got), chunks*len(chunk))
+		}
+		r.Close()
+	}
+}
+
+func TestFifoWriterReaderGone(t *testing.T) {
+	r, pipe, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+	w := newFifoWriter(func() (*os.File, error) { return pipe, nil }, false)
+	var werr error
+	for i := 0; i < 1000 && werr == nil; i++ {
+		_, werr = w.Write(make([]byte, 1<<20))
+	}
+	if werr == nil {
+		t.Error("writing to a pipe that nothing reads did not fail")
+	}
+	w.Close()
+	if err := w.wait(); err == nil {
+		t.Error("wait did not report the failure")
+	}
+}
+
+func TestExec(t *testing.T) {
+	dir := t.TempDir()
+	mate1 := writeFixture(t, dir, "in_1.fastq", platinumMates(2000, '1'))
+	mate2 := writeFixture(t, dir, "in_2.fastq", platinumMates(2000, '2'))
+	var corrected [2][]byte
+	for i, in := range []string{mate1, mate2} {
+		out := filepath.Join(dir, filepath.Base(in)+".corrected")
+		if status, stderr := runProgram(t, "seq", in, out); status != 0 {
+			t.Fatal(stderr)
+		}
+		corrected[i], _ = os.ReadFile(out)
+	}
+	out := filepath.Join(dir, "out.fastq")
+	tests := []struct {
+		name   string
+		args   []string
+		status int
+		want   []byte
+		stderr string
+	}{
+		{"cat", []string{"-1", mate1, "--", "sh", "-c", "cat {r1} > " + out}, 0, corrected[0], ""},
+		{"cat pairs in order", []string{"-1", mate1, "-2", mate2, "--", "sh", "-c", "cat {r1} {r2} > " + out}, 0, append(corrected[0][:len(corrected[0]):len(corrected[0])], corrected[1]...), ""},
+		{"wc", []string{"-1", mate1, "-2", mate2, "--", "sh", "-c", "test $(cat {r2} | wc -l) -eq 8000 && test $(wc -l < {r1}) -eq 8000"}, 0, nil, ""},
+		{"exit status", []string{"-1", mate1, "--", "sh", "-c", "exit 3 # {r1}"}, 3, nil, "exit status 3"},
+		{"exits early", []string{"-1", mate1, "--", "head", "-c", "10", "{r1}"}, 1, nil, "broken pipe"},
+		{"correction fails", []string{"-1", filepath.Join(dir, "missing.fastq"), "--", "cat", "{r1}"}, 1, nil, "missing.fastq"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			os.Remove(out)
+			status, stderr := runProgram(t, append([]string{"exec"}, test.args...)...)
+			if status != test.status || !strings.Contains(stderr, test.stderr) {
+				t.Fatalf("exit status %d, want %d: %s", status, test.status, stderr)
+			}
+			if test.want == nil {
+				return
+			}
+			if got, err := os.ReadFile(out); err != nil || !bytes.Equal(got, test.want) {
+				t.Errorf("command read %d bytes, want %d, %v", len(got), len(test.want), err)
+			}
+		})
+	}
+}
@@ -0,0 +1,130 @@
+// Package fastq reads and writes the records of fastq files, whose
+// identifier lines end in a mate suffix, or are the ones that Casava
+// 1.8 writes.
+package fastq
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// A Record is an entry in a fastq file.
+type Record struct {
+	Identifier, Sequence, Qualities string
+	// the mate suffix of the identifier, 1 or 2, which is kept once
+	// the identifier is corrected
+	Mate byte
+	// the corrected identifier, if the reader of the record already
+	// derived it, so that it is not derived again
+	Corrected string
+}
+
+// PairName returns the identifier of a record without a comment, and
+// without a mate suffix that it still ends in, so that both mates of
+// a pair have the same name.
+func (r Record) PairName() string {
+	name := r.Identifier
+	if i := strings.IndexAny(name, " \t"); i >= 0 {
+		name = name[:i]
+	}
+	if n := len(name); n >= 2 && name[n-2] == '/' && name[n-1] == r.Mate {
+		return name[:n-2]
+	}
+	return name
+}
+
+// readError annotates an error from reading the input with the
+// number of complete records read before it.
+func readError(err error, records int) error {
+	if err == nil {
+		return nil
+	}
+	return fmt.Errorf("after %d complete records: %w", records, err)
+}
+
+// lengthMismatch describes a record whose sequence and qualities
+// lines differ in length.
+func lengthMismatch(bases, qualities int) string {
+	return fmt.Sprintf("sequence and qualities differ in length, %d bases but %d qualities", bases, qualities)
+}
+
+// identifierProblem describes what is wrong with the identifier
+// line of a record, or returns "" if it is well-formed. Casava 1.8
+// identifier lines are checked by casavaProblem instead.
+func identifierProblem(line []byte) string {
+	if !bytes.HasPrefix(line, []byte("@")) {
+		return "malformed identifier line, missing initial @ sign"
+	}
+	if !(bytes.HasSuffix(line, []byte("/1")) || bytes.HasSuffix(line, []byte("/2"))) {
+		return "malformed identifier line, missing suffix"
+	}
+	return ""
+}
+
+// intermediateProblem describes what is wrong with the
+// intermediate line of a record, or returns "" if it is
+// well-formed.
+func intermediateProblem(line []byte) string {
+	if !bytes.HasPrefix(line, []byte("+")) {
+		return "malformed intermediate line, missing initial + sign"
+	}
+	return ""
+}
+
+// missingLines describes a record that ends after the given number
+// of lines.
+var missingLines = [...]string{"missing identifier line", "missing sequence line", "missing intermediate line", "missing qualities line"}
+
+// ParseRecord parses a fastq record from a block of four lines, of
+// which the last may lack its newline. It checks the record like a
+// Scanner does, and reports problems with the same messages, without
+// a record number.
+func ParseRecord(block []byte) (Record, error) {
+	lines := bytes.Split(bytes.TrimSuffix(block, []byte("\n")), []byte("\n"))
+	if len(block) == 0 {
+		lines = nil
+	}
+	if len(lines) < len(missingLines) {
+		return Record{}, errors.New(missingLines[len(lines)])
+	}
+	if len(lines) > len(missingLines) {
+		return Record{}, fmt.Errorf("expected four lines, but got %d", len(lines))
+	}
+	for i, line := range lines {
+		// like bufio.ScanLines
+		lines[i] = bytes.TrimSuffix(line, []byte("\r"))
+	}
+	if problem := identifierProblem(lines[0]); problem != "" && casavaProblem(lines[0]) != "" {
+		return Record{}, errors.New(problem)
+	}
+	if problem := intermediateProblem(lines[2]); problem != "" {
+		return Record{}, errors.New(problem)
+	}
+	if len(lines[1]) != len(lines[3]) {
+		return Record{}, errors.New(lengthMismatch(len(lines[1]), len(lines[3])))
+	}
+	return Record{Identifier: string(lines[0]), Sequence: string(lines[1]), Qualities: string(lines[3])}, nil
+}
+
+// casavaProblem describes why an identifier line is not one that
+// Casava 1.8 writes, such as
+// @HSQ1004:134:C0D8DACXX:1:1101:1000:2000 1:N:0:ATCACG, or returns ""
+// if it is one. Its name has the instrument, run, flowcell, lane,
+// tile, x, and y fields, and its comment starts with the number of
+// the mate instead of the line ending in a mate suffix.
+func casavaProblem(line []byte) string {
+	name, comment, ok := bytes.Cut(line, []byte(" "))
+	if !ok || !bytes.HasPrefix(line, []byte("@")) {
+		return "not a Casava 1.8 identifier line, missing comment"
+	}
+	if n := bytes.Count(name, []byte(":")); n != 6 && n != 7 {
+		// an eighth field is a UMI
+		return "not a Casava 1.8 identifier line, its name does not have seven or eight fields"
+	}
+	if len(comment) < 4 || (comment[0] != '1' && comment[0] != '2') || comment[1] != ':' || (comment[2] != 'Y' && comment[2] != 'N') || comment[3] != ':' {
+		return "not a Casava 1.8 identifier line, its comment does not start with the mate and the filter flag"
+	}
+	return ""
+}
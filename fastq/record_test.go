@@ -0,0 +1,49 @@
+package fastq
+
+import "testing"
+
+func TestParseRecord(t *testing.T) {
+	const id = "@ERR194147.1 HSQ1004:134:C0D8DACXX:1:1101:1000:2000/1"
+	tests := []struct {
+		name  string
+		block string
+		want  Record
+		err   string
+	}{
+		{"lf", id + "\nACGT\n+\nIIII\n", Record{Identifier: id, Sequence: "ACGT", Qualities: "IIII"}, ""},
+		{"no final newline", id + "\nACGT\n+\nIIII", Record{Identifier: id, Sequence: "ACGT", Qualities: "IIII"}, ""},
+		{"crlf", id + "\r\nACGT\r\n+\r\nIIII\r\n", Record{Identifier: id, Sequence: "ACGT", Qualities: "IIII"}, ""},
+		{"casava", "@HSQ1004:134:C0D8DACXX:1:1101:1000:2000 1:N:0:ACGT\nAC\n+\nII\n", Record{Identifier: "@HSQ1004:134:C0D8DACXX:1:1101:1000:2000 1:N:0:ACGT", Sequence: "AC", Qualities: "II"}, ""},
+		{"empty", "", Record{}, "missing identifier line"},
+		{"missing qualities line", id + "\nACGT\n+\n", Record{}, "missing qualities line"},
+		{"five lines", id + "\nACGT\n+\nIIII\n@\n", Record{}, "expected four lines, but got 5"},
+		{"missing suffix", "@ERR194147.1\nACGT\n+\nIIII\n", Record{}, "malformed identifier line, missing suffix"},
+		{"malformed intermediate line", id + "\nACGT\n-\nIIII\n", Record{}, "malformed intermediate line, missing initial + sign"},
+		{"length mismatch", id + "\nACGT\n+\nIII\n", Record{}, "sequence and qualities differ in length, 4 bases but 3 qualities"},
+	}
+	for _, test := range tests {
+		r, err := ParseRecord([]byte(test.block))
+		if r != test.want || (err == nil) != (test.err == "") || err != nil && err.Error() != test.err {
+			t.Errorf("%s: got %q, %v, want %q, %q", test.name, r, err, test.want, test.err)
+		}
+	}
+}
+
+func TestPairName(t *testing.T) {
+	tests := []struct {
+		r    Record
+		want string
+	}{
+		{Record{Identifier: "HSQ1004:134:C0D8DACXX:1:1101:1000:2000", Mate: '1'}, "HSQ1004:134:C0D8DACXX:1:1101:1000:2000"},
+		{Record{Identifier: "HSQ1004:134:C0D8DACXX:1:1101:1000:2000/2", Mate: '2'}, "HSQ1004:134:C0D8DACXX:1:1101:1000:2000"},
+		{Record{Identifier: "HSQ1004:134:C0D8DACXX:1:1101:1000:2000/1 ERR194147.1", Mate: '1'}, "HSQ1004:134:C0D8DACXX:1:1101:1000:2000"},
+		{Record{Identifier: "HSQ1004:134:C0D8DACXX:1:1101:1000:2000\tBC:Z:ACGT", Mate: '2'}, "HSQ1004:134:C0D8DACXX:1:1101:1000:2000"},
+		// a suffix of the other mate is part of the name
+		{Record{Identifier: "HSQ1004:134:C0D8DACXX:1:1101:1000:2000/2", Mate: '1'}, "HSQ1004:134:C0D8DACXX:1:1101:1000:2000/2"},
+	}
+	for _, test := range tests {
+		if got := test.r.PairName(); got != test.want {
+			t.Errorf("%q: got %q, want %q", test.r.Identifier, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package fastq
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// A Scanner reads fastq records from an io.Reader, like bufio.Scanner
+// reads lines. Each record is checked like ParseRecord checks it, and
+// the first malformed record stops the scan, with an error that
+// gives its number. A read error on the input is a more likely cause
+// of a malformed record, so it takes precedence. Lines may end in
+// CRLF, as written on Windows: bufio.ScanLines drops the carriage
+// return before any check sees the line, so it never ends up in the
+// sequence or the qualities. Whether the identifier lines are the
+// ones that Casava 1.8 writes is decided by the first record, and the
+// other records must then be the same.
+type Scanner struct {
+	lines                *bufio.Scanner
+	identifier, sequence string
+	qualities            []byte
+	records              int
+	casava               bool
+	done                 bool
+	err                  error
+	// with Multiline, the buffer that wrapped lines are joined in
+	multiline bool
+	wrapped   []byte
+}
+
+// NewScanner returns a Scanner that reads from r.
+func NewScanner(r io.Reader) *Scanner {
+	return &Scanner{lines: bufio.NewScanner(r)}
+}
+
+// Multiline makes the Scanner accept records whose sequence and
+// qualities are wrapped over several lines, as some legacy fastq
+// writers do. It must be called before the first call of Scan.
+func (s *Scanner) Multiline() {
+	s.multiline = true
+}
+
+// Scan advances to the next record, which is then available through
+// Record. It returns false at the end of the input, or once a record
+// is malformed or reading fails, after which Err reports why.
+func (s *Scanner) Scan() bool {
+	if s.done {
+		return false
+	}
+	if !s.lines.Scan() {
+		s.done = true
+		s.err = readError(s.lines.Err(), s.records)
+		return false
+	}
+	s.records++
+	if problem := s.identifierProblem(s.lines.Bytes()); problem != "" {
+		if s.records == 1 && !bytes.HasPrefix(s.lines.Bytes(), []byte("@")) {
+			// most likely not fastq at all, such as a compressed
+			// file of another kind
+			problem = "the input does not look like fastq, its first line does not start with an @ sign"
+		}
+		return s.fail(problem)
+	}
+	s.identifier = s.lines.Text()
+	var problem string
+	if s.multiline {
+		problem = s.scanWrapped()
+	} else {
+		problem = s.scanLines()
+	}
+	if problem != "" {
+		return s.fail(problem)
+	}
+	if len(s.sequence) != len(s.qualities) {
+		return s.fail(lengthMismatch(len(s.sequence), len(s.qualities)))
+	}
+	return true
+}
+
+// identifierProblem checks an identifier line like the function of the
+// same name does, or like casavaProblem does if the first record has
+// a Casava 1.8 identifier line.
+func (s *Scanner) identifierProblem(line []byte) string {
+	problem, casava := identifierProblem(line), casavaProblem(line)
+	if s.records == 1 {
+		s.casava = problem != "" && casava == ""
+	}
+	switch {
+	case s.casava && casava != "" && problem == "":
+		return "identifier line with a mate suffix, but the first record has a Casava 1.8 identifier line"
+	case s.casava:
+		return casava
+	case problem != "" && casava == "":
+		return "Casava 1.8 identifier line, but the first record has a mate suffix"
+	}
+	return problem
+}
+
+// scanLines reads the sequence, intermediate, and qualities lines
+// of a record, and returns what is wrong with them, if anything.
+func (s *Scanner) scanLines() string {
+	if !s.lines.Scan() {
+		return missingLines[1]
+	}
+	s.sequence = s.lines.Text()
+	if !s.lines.Scan() {
+		return missingLines[2]
+	}
+	if problem := intermediateProblem(s.lines.Bytes()); problem != "" {
+		return problem
+	}
+	if !s.lines.Scan() {
+		return missingLines[3]
+	}
+	s.qualities = s.lines.Bytes()
+	return ""
+}
+
+// scanWrapped is scanLines for records whose sequence and qualities
+// may be wrapped over several lines. The sequence ends at the next
+// line that starts with a + or @ sign, which must be the
+// intermediate line. Since qualities may start with either sign,
+// they end once there are as many of them as there are bases
+// instead.
+func (s *Scanner) scanWrapped() string {
+	s.wrapped = s.wrapped[:0]
+	for lines := 0; ; lines++ {
+		if !s.lines.Scan() {
+			if lines == 0 {
+				return missingLines[1]
+			}
+			return missingLines[2]
+		}
+		line := s.lines.Bytes()
+		if len(line) > 0 && (line[0] == '+' || line[0] == '@') {
+			break
+		}
+		s.wrapped = append(s.wrapped, line...)
+	}
+	if problem := intermediateProblem(s.lines.Bytes()); problem != "" {
+		return problem
+	}
+	s.sequence = string(s.wrapped)
+	s.wrapped = s.wrapped[:0]
+	for lines := 0; lines == 0 || len(s.wrapped) < len(s.sequence); lines++ {
+		if !s.lines.Scan() {
+			if lines == 0 {
+				return missingLines[3]
+			}
+			break
+		}
+		s.wrapped = append(s.wrapped, s.lines.Bytes()...)
+	}
+	s.qualities = s.wrapped
+	return ""
+}
+
+func (s *Scanner) fail(message string) bool {
+	s.done = true
+	if s.err = readError(s.lines.Err(), s.records-1); s.err == nil {
+		s.err = fmt.Errorf("record %d: %s", s.records, message)
+	}
+	return false
+}
+
+// Record returns the current record, with its identifier line as it
+// is, including the initial @ sign.
+func (s *Scanner) Record() Record {
+	return Record{Identifier: s.identifier, Sequence: s.sequence, Qualities: string(s.qualities)}
+}
+
+// Sequence returns the sequence of the current record.
+func (s *Scanner) Sequence() string {
+	return s.sequence
+}
+
+// Qualities returns the qualities of the current record, which may
+// be modified in place before Record is called. They are only valid
+// until the next call of Scan.
+func (s *Scanner) Qualities() []byte {
+	return s.qualities
+}
+
+// Casava reports whether the identifier lines are the ones that
+// Casava 1.8 writes, once the first record is scanned.
+func (s *Scanner) Casava() bool {
+	return s.casava
+}
+
+// Records returns the number of records scanned so far, including a
+// malformed one.
+func (s *Scanner) Records() int {
+	return s.records
+}
+
+// Err returns the error that stopped the scan, or nil at the end of
+// the input.
+func (s *Scanner) Err() error {
+	return s.err
+}
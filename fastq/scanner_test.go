@@ -0,0 +1,88 @@
+package fastq
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestScanner(t *testing.T) {
+	const (
+		id1 = "@ERR194147.1 HSQ1004:134:C0D8DACXX:1:1101:1000:2000/1"
+		id2 = "@ERR194147.2 HSQ1004:134:C0D8DACXX:1:1101:1001:2000/1"
+	)
+	tests := []struct {
+		name    string
+		input   string
+		records int
+		err     string
+	}{
+		{"lf", id1 + "\nACGT\n+\nIIII\n" + id2 + "\nAC\n+\nII\n", 2, ""},
+		{"no final newline", id1 + "\nACGT\n+\nIIII", 1, ""},
+		{"crlf", id1 + "\r\nACGT\r\n+\r\nIIII\r\n" + id2 + "\r\nAC\r\n+\r\nII\r\n", 2, ""},
+		{"crlf without final newline", id1 + "\r\nACGT\r\n+\r\nIIII\r", 1, ""},
+		{"crlf intermediate line", id1 + "\nACGT\n+\r\nIIII\n", 1, ""},
+		{"mixed", id1 + "\r\nACGT\n+\r\nIIII\n" + id2 + "\nAC\r\n+\nII\r\n", 2, ""},
+		{"empty", "", 0, ""},
+		{"not fastq", "ACGT\n", 0, "record 1: the input does not look like fastq"},
+		{"missing suffix", "@ERR194147.1\nACGT\n+\nIIII\n", 0, "record 1: malformed identifier line, missing suffix"},
+		{"missing intermediate line", id1 + "\nACGT\n", 0, "record 1: missing intermediate line"},
+		{"missing qualities line", id1 + "\nACGT\n+\n", 0, "record 1: missing qualities line"},
+		// with Multiline, the sequence goes on until the input ends
+		{"malformed intermediate line", id1 + "\nACGT\n-\nIIII\n", 0, "record 1: m"},
+		{"length mismatch", id1 + "\nACGT\n+\nIII\n" + id2 + "\nAC\n+\nII\n", 0, "record 1:"},
+		{"second record", id1 + "\nACGT\n+\nIIII\n" + id2 + "\nAC\n+\nI\n", 1, "record 2:"},
+		{"casava after suffix", id1 + "\nACGT\n+\nIIII\n@HSQ1004:134:C0D8DACXX:1:1101:1000:2000 1:N:0:ACGT\nAC\n+\nII\n", 1, "record 2: Casava 1.8 identifier line, but the first record has a mate suffix"},
+		{"suffix after casava", "@HSQ1004:134:C0D8DACXX:1:1101:1000:2000 1:N:0:ACGT\nACGT\n+\nIIII\n" + id2 + "\nAC\n+\nII\n", 1, "record 2: identifier line with a mate suffix, but the first record has a Casava 1.8 identifier line"},
+	}
+	for _, test := range tests {
+		for _, multiline := range []bool{false, true} {
+			s := NewScanner(strings.NewReader(test.input))
+			if multiline {
+				s.Multiline()
+			}
+			records := 0
+			for s.Scan() {
+				records++
+				r := s.Record()
+				if strings.ContainsAny(r.Identifier+r.Sequence+r.Qualities, "\r\n") {
+					t.Errorf("%s, multiline %v: record %d has a line ending: %q", test.name, multiline, records, r)
+				}
+			}
+			err := s.Err()
+			if records != test.records || (err == nil) != (test.err == "") || err != nil && !strings.HasPrefix(err.Error(), test.err) {
+				t.Errorf("%s, multiline %v: %d records, %v, want %d records, %q", test.name, multiline, records, err, test.records, test.err)
+			}
+		}
+	}
+}
+
+func TestScannerWrapped(t *testing.T) {
+	const id = "@ERR194147.1 HSQ1004:134:C0D8DACXX:1:1101:1000:2000/1"
+	tests := []struct {
+		name                string
+		input               string
+		sequence, qualities string
+		err                 string
+	}{
+		{"four lines", id + "\nACGTAC\n+\nIIIIII\n", "ACGTAC", "IIIIII", ""},
+		{"wrapped", id + "\nACG\nTA\nC\n+\nIII\nIII\n", "ACGTAC", "IIIIII", ""},
+		{"qualities start with @", id + "\nACG\nTAC\n+\n@II\n@II\n", "ACGTAC", "@II@II", ""},
+		{"qualities start with +", id + "\nACG\nTAC\n+\n+II\n+II\n", "ACGTAC", "+II+II", ""},
+		{"crlf", id + "\r\nACG\r\nTAC\r\n+\r\nIII\r\n@II\r\n", "ACGTAC", "III@II", ""},
+		{"too many qualities", id + "\nACG\n+\nII\nII\n", "", "", "record 1:"},
+		{"missing qualities", id + "\nACG\nTAC\n+\nIII\n", "", "", "record 1:"},
+	}
+	for _, test := range tests {
+		s := NewScanner(strings.NewReader(test.input))
+		s.Multiline()
+		if !s.Scan() {
+			if test.err == "" || !strings.HasPrefix(s.Err().Error(), test.err) {
+				t.Errorf("%s: %v, want %q", test.name, s.Err(), test.err)
+			}
+			continue
+		}
+		if r := s.Record(); test.err != "" || r.Sequence != test.sequence || r.Qualities != test.qualities {
+			t.Errorf("%s: got %q and %q, want %q and %q, %q", test.name, r.Sequence, r.Qualities, test.sequence, test.qualities, test.err)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package fastq
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Writer is implemented by the buffered writers that records are
+// written to, which like bufio.Writer keep returning the first error
+// that occurred.
+type Writer interface {
+	io.Writer
+	io.ByteWriter
+	io.StringWriter
+}
+
+// RecordWriter writes records in fastq format, or as unaligned SAM
+// or BAM records. It is the counterpart of ParseRecord.
+type RecordWriter struct {
+	w           Writer
+	format      string
+	readGroupID string
+}
+
+// NewRecordWriter returns a RecordWriter that writes to w, such as
+// a bufio.Writer or a bytes.Buffer, in format, which is fastq, sam,
+// or bam. SAM and BAM records are tagged with the read group
+// readGroupID, unless it is "".
+func NewRecordWriter(w Writer, format, readGroupID string) RecordWriter {
+	return RecordWriter{w: w, format: format, readGroupID: readGroupID}
+}
+
+// WriteRecord writes a record, whose identifier does not include
+// the initial @ sign, with an empty intermediate line. Only the
+// first error of the underlying writer is returned, after the whole
+// record is written.
+func (rw RecordWriter) WriteRecord(r Record) error {
+	switch rw.format {
+	case "sam":
+		return rw.writeSAM(r)
+	case "bam":
+		return rw.writeBAM(r)
+	}
+	_ = rw.w.WriteByte('@')
+	_, _ = rw.w.WriteString(r.Identifier)
+	_ = rw.w.WriteByte('\n')
+	_, _ = rw.w.WriteString(r.Sequence)
+	_, _ = rw.w.WriteString("\n+\n")
+	_, _ = rw.w.WriteString(r.Qualities)
+	return rw.w.WriteByte('\n')
+}
+
+// samFlags are the flags of the unaligned records of SAM output for
+// the first and the second mate: paired, unmapped, mate unmapped,
+// and first or last segment.
+var samFlags = map[byte]string{'1': "77", '2': "141"}
+
+// writeSAM writes a record as an unaligned SAM record, named after
+// its PairName, since the mates of a pair share their QNAME.
+func (rw RecordWriter) writeSAM(r Record) error {
+	sequence, qualities := r.Sequence, r.Qualities
+	if sequence == "" {
+		sequence, qualities = "*", "*"
+	}
+	_, _ = rw.w.WriteString(r.PairName())
+	_ = rw.w.WriteByte('\t')
+	_, _ = rw.w.WriteString(samFlags[r.Mate])
+	_, _ = rw.w.WriteString("\t*\t0\t0\t*\t*\t0\t0\t")
+	_, _ = rw.w.WriteString(sequence)
+	_ = rw.w.WriteByte('\t')
+	_, _ = rw.w.WriteString(qualities)
+	if rw.readGroupID != "" {
+		_, _ = rw.w.WriteString("\tRG:Z:")
+		_, _ = rw.w.WriteString(rw.readGroupID)
+	}
+	return rw.w.WriteByte('\n')
+}
+
+// bamBases are the bases in the order of their 4-bit codes in BAM
+// records.
+const bamBases = "=ACMGRSVTWYHKDBN"
+
+// bamBaseCodes maps each sequence character to its 4-bit code, with
+// lower case the same as upper case, and anything else, such as .
+// and -, as N.
+var bamBaseCodes = func() (codes [256]byte) {
+	for i := range codes {
+		codes[i] = 15
+	}
+	for i, base := range []byte(bamBases) {
+		codes[base] = byte(i)
+		codes[base|0x20] = byte(i)
+	}
+	return codes
+}()
+
+// bamFlags are the flags of samFlags as numbers.
+var bamFlags = map[byte]uint16{'1': 77, '2': 141}
+
+// the bin of unmapped records, for position -1
+const bamUnmappedBin = 4680
+
+// the longest read name that BAM records can hold, as that length
+// plus its terminating NUL must fit into a byte
+const bamMaxReadName = 254
+
+// writeBAM writes a record as an unaligned BAM record, with the same
+// fields as writeSAM. It is written uncompressed, and is compressed
+// into BGZF blocks together with the records around it.
+func (rw RecordWriter) writeBAM(r Record) error {
+	name := r.PairName()
+	if len(name) > bamMaxReadName {
+		return fmt.Errorf("identifier %s is too long for BAM, which allows at most %d characters", name, bamMaxReadName)
+	}
+	n := len(r.Sequence)
+	size := 32 + len(name) + 1 + (n+1)/2 + n
+	if rw.readGroupID != "" {
+		size += 3 + len(rw.readGroupID) + 1
+	}
+	b := make([]byte, 0, 4+size)
+	le := binary.LittleEndian
+	b = le.AppendUint32(b, uint32(size))
+	// refID and pos
+	b = le.AppendUint32(b, ^uint32(0))
+	b = le.AppendUint32(b, ^uint32(0))
+	// l_read_name, mapq, bin, n_cigar_op, flag, and l_seq
+	b = append(b, byte(len(name)+1), 0)
+	b = le.AppendUint16(b, bamUnmappedBin)
+	b = le.AppendUint16(b, 0)
+	b = le.AppendUint16(b, bamFlags[r.Mate])
+	b = le.AppendUint32(b, uint32(n))
+	// next_refID, next_pos, and tlen
+	b = le.AppendUint32(b, ^uint32(0))
+	b = le.AppendUint32(b, ^uint32(0))
+	b = le.AppendUint32(b, 0)
+	b = append(b, name...)
+	b = append(b, 0)
+	for i := 0; i < n; i += 2 {
+		code := bamBaseCodes[r.Sequence[i]] << 4
+		if i+1 < n {
+			code |= bamBaseCodes[r.Sequence[i+1]]
+		}
+		b = append(b, code)
+	}
+	for i := 0; i < n; i++ {
+		q := r.Qualities[i]
+		if q < 33 {
+			q = 33
+		}
+		b = append(b, q-33)
+	}
+	if rw.readGroupID != "" {
+		b = append(b, "RGZ"...)
+		b = append(b, rw.readGroupID...)
+		b = append(b, 0)
+	}
+	_, err := rw.w.Write(b)
+	return err
+}
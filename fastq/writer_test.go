@@ -0,0 +1,26 @@
+package fastq
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestRecordWriter(t *testing.T) {
+	r := Record{Identifier: "HSQ1004:134:C0D8DACXX:1:1101:1000:2000 ERR194147.1", Sequence: "ACGT", Qualities: "IIII", Mate: '2'}
+	tests := []struct {
+		format, readGroupID string
+		r                   Record
+		want                string
+	}{
+		{"fastq", "", r, "@HSQ1004:134:C0D8DACXX:1:1101:1000:2000 ERR194147.1\nACGT\n+\nIIII\n"},
+		{"sam", "", r, "HSQ1004:134:C0D8DACXX:1:1101:1000:2000\t141\t*\t0\t0\t*\t*\t0\t0\tACGT\tIIII\n"},
+		{"sam", "foo", r, "HSQ1004:134:C0D8DACXX:1:1101:1000:2000\t141\t*\t0\t0\t*\t*\t0\t0\tACGT\tIIII\tRG:Z:foo\n"},
+		{"sam", "", Record{Identifier: "a/1", Mate: '1'}, "a\t77\t*\t0\t0\t*\t*\t0\t0\t*\t*\n"},
+	}
+	for _, test := range tests {
+		var b bytes.Buffer
+		if err := NewRecordWriter(&b, test.format, test.readGroupID).WriteRecord(test.r); err != nil || b.String() != test.want {
+			t.Errorf("%s, read group %q: got %q, %v, want %q", test.format, test.readGroupID, b.String(), err, test.want)
+		}
+	}
+}
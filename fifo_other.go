@@ -0,0 +1,18 @@
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// createFifo fails, since named pipes are only supported on Unix.
+func createFifo(name string) (*os.File, error) {
+	return nil, errors.New("exec mode requires named pipes, which are only supported on Unix")
+}
+
+// openFifo fails like createFifo.
+func openFifo(name string) (*os.File, error) {
+	return createFifo(name)
+}
@@ -0,0 +1,25 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// createFifo creates a named pipe, and opens it for reading without
+// blocking. As long as the returned reader is open, opening the
+// pipe for writing does not block either, but once it is closed,
+// writes fail when nothing else reads the pipe.
+func createFifo(name string) (*os.File, error) {
+	if err := syscall.Mkfifo(name, 0600); err != nil {
+		return nil, &os.PathError{Op: "mkfifo", Path: name, Err: err}
+	}
+	return os.OpenFile(name, os.O_RDONLY|syscall.O_NONBLOCK, 0)
+}
+
+// openFifo opens a named pipe for writing, which fails rather than
+// blocks if nothing reads it.
+func openFifo(name string) (*os.File, error) {
+	return os.OpenFile(name, os.O_WRONLY|syscall.O_NONBLOCK, 0)
+}
@@ -0,0 +1,72 @@
+//go:build unix
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestNamedPipeOutput(t *testing.T) {
+	dir := t.TempDir()
+	mate1 := writeFixture(t, dir, "in_1.fastq", platinumMates(20000, '1'))
+	mate2 := writeFixture(t, dir, "in_2.fastq", platinumMates(20000, '2'))
+	var corrected [2][]byte
+	for i, in := range []string{mate1, mate2} {
+		out := filepath.Join(dir, filepath.Base(in)+".corrected")
+		if status, stderr := runProgram(t, "seq", in, out); status != 0 {
+			t.Fatal(stderr)
+		}
+		corrected[i], _ = os.ReadFile(out)
+	}
+	tests := []struct {
+		name    string
+		args    []string
+		outputs int
+	}{
+		{"seq", []string{"seq", mate1}, 1},
+		{"par", []string{"par", mate1}, 1},
+		{"seq paired", []string{"seq", "-paired", mate1, mate2}, 2},
+		{"par paired", []string{"par", "-paired", mate1, mate2}, 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var pipes []string
+			reads := make(chan []byte, test.outputs)
+			for i := range test.outputs {
+				pipe := filepath.Join(t.TempDir(), "out.fastq")
+				if err := syscall.Mkfifo(pipe, 0o600); err != nil {
+					t.Fatal(err)
+				}
+				pipes = append(pipes, pipe)
+				go func() {
+					data, _ := readPipe(pipe)
+					reads <- append([]byte{byte(i)}, data...)
+				}()
+			}
+			if status, stderr := runProgram(t, append(test.args, pipes...)...); status != 0 {
+				t.Fatal(stderr)
+			}
+			for range test.outputs {
+				data := <-reads
+				if !bytes.Equal(data[1:], corrected[data[0]]) {
+					t.Errorf("pipe %d: read %d bytes, want %d", data[0]+1, len(data)-1, len(corrected[data[0]]))
+				}
+			}
+		})
+	}
+}
+
+// readPipe reads a named pipe until whatever writes it closes it.
+func readPipe(name string) ([]byte, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return io.ReadAll(file)
+}
@@ -0,0 +1,917 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	stdbzip2 "compress/bzip2"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dsnet/compress/bzip2"
+	"github.com/klauspost/compress/zstd"
+	"github.com/klauspost/pgzip"
+	"github.com/ulikunitz/xz"
+)
+
+var (
+	gzipMagic  = []byte{0x1f, 0x8b}
+	bzip2Magic = []byte("BZh")
+	xzMagic    = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+	zstdMagic  = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// newCompressedReader returns a decompressor for the format that
+// the magic bytes at the start of r indicate, or nil if r does
+// not start with any known magic bytes. BGZF input is decompressed
+// with the given number of threads.
+func newCompressedReader(r *bufio.Reader, threads int) (io.ReadCloser, error) {
+	magic, _ := r.Peek(16)
+	switch {
+	case isBgzfHeader(magic):
+		if threads > 1 {
+			return newParallelBgzfReader(r, threads), nil
+		}
+		return newBgzfReader(r), nil
+	case bytes.HasPrefix(magic, gzipMagic):
+		return newGzipMembersReader(r)
+	case bytes.HasPrefix(magic, bzip2Magic):
+		return io.NopCloser(stdbzip2.NewReader(r)), nil
+	case bytes.HasPrefix(magic, xzMagic):
+		reader, err := xz.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(reader), nil
+	case bytes.HasPrefix(magic, zstdMagic):
+		decoder, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	}
+	return nil, nil
+}
+
+// gzipMembersReader decompresses a gzip stream that consists of
+// one or more concatenated members, which may be separated by
+// zero padding. Any other data after a member is an error.
+type gzipMembersReader struct {
+	r       *bufio.Reader
+	z       *gzip.Reader
+	members int
+}
+
+func newGzipMembersReader(r *bufio.Reader) (*gzipMembersReader, error) {
+	z, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	z.Multistream(false)
+	return &gzipMembersReader{r: r, z: z, members: 1}, nil
+}
+
+func (gr *gzipMembersReader) Read(p []byte) (n int, err error) {
+	for {
+		n, err = gr.z.Read(p)
+		if err != io.EOF {
+			return
+		}
+		if err = gr.nextMember(); err != nil || n > 0 {
+			return
+		}
+	}
+}
+
+// nextMember skips padding after the current member, and starts
+// decompressing the next one. It returns io.EOF if there is none.
+func (gr *gzipMembersReader) nextMember() error {
+	for {
+		b, err := gr.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		if b != 0 {
+			break
+		}
+	}
+	_ = gr.r.UnreadByte()
+	if magic, _ := gr.r.Peek(len(gzipMagic)); !bytes.Equal(magic, gzipMagic) {
+		return fmt.Errorf("gzip: unexpected data after member %d", gr.members)
+	}
+	if err := gr.z.Reset(gr.r); err != nil {
+		return err
+	}
+	gr.z.Multistream(false)
+	gr.members++
+	return nil
+}
+
+// Close releases no resources. Unlike gzip.Reader.Close, it
+// does not return decompression errors again that Read already
+// reported.
+func (gr *gzipMembersReader) Close() error {
+	return nil
+}
+
+// compressions lists the valid values for the -compression
+// flag.
+var compressions = []string{"auto", "none", "gzip", "bgzf", "bzip2", "zstd"}
+
+// compressionFromName determines the output compression from
+// the extension of a file name.
+func compressionFromName(name string) string {
+	switch {
+	case strings.HasSuffix(name, ".gz"):
+		return "gzip"
+	case strings.HasSuffix(name, ".bz2"):
+		return "bzip2"
+	case strings.HasSuffix(name, ".zst"):
+		return "zstd"
+	}
+	return "none"
+}
+
+// outputCompression determines the compression format for an
+// output from the options, or else from its name.
+func outputCompression(name string, opts *options) string {
+	if opts.compression == "auto" {
+		return compressionFromName(name)
+	}
+	return opts.compression
+}
+
+// newCompressedWriter returns a compressor for the format that
+// the options, or else the extension of the output name, ask
+// for, or nil if the output should be written as plain text.
+func newCompressedWriter(w io.Writer, name string, opts *options) (io.WriteCloser, error) {
+	switch compression := outputCompression(name, opts); compression {
+	case "none":
+		return nil, nil
+	case "gzip":
+		if opts.parallelGzip {
+			return newParallelGzipWriter(w, opts.compressLevel, opts.workers)
+		}
+		return newGzipWriter(w, opts.compressLevel)
+	case "bgzf":
+		return newBgzfWriter(w, opts.compressLevel), nil
+	case "bzip2":
+		return bzip2.NewWriter(w, nil)
+	case "zstd":
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(opts.zstdLevel)))
+	default:
+		return nil, fmt.Errorf("unknown compression %q", compression)
+	}
+}
+
+// batchCompressor compresses batches of output independently of
+// each other into members that can simply be concatenated, so
+// that the parallel mode can compress batches concurrently.
+type batchCompressor struct {
+	compress func(dst *bytes.Buffer, data []byte) error
+	// end terminates a concatenation of members, given whether
+	// there were any
+	end func(w io.Writer, empty bool) error
+}
+
+// gzipHeader is the header of all gzip output, without a
+// modification time or original name, and with the OS byte set to
+// unknown, so that the same input and options give byte-identical
+// outputs, on any machine. compress/gzip writes this header by
+// default, but setting it explicitly keeps it that way.
+var gzipHeader = gzip.Header{OS: 255}
+
+// newGzipWriter returns a gzip writer that writes gzipHeader.
+func newGzipWriter(w io.Writer, level int) (*gzip.Writer, error) {
+	writer, err := gzip.NewWriterLevel(w, level)
+	if err != nil {
+		return nil, err
+	}
+	writer.Header = gzipHeader
+	return writer, nil
+}
+
+// newParallelGzipWriter returns a gzip writer for -parallel-gzip,
+// which compresses blocks of 1 MB with up to workers goroutines, and
+// writes the same header as newGzipWriter. The output is a single
+// gzip member, which any gzip reader can read.
+func newParallelGzipWriter(w io.Writer, level, workers int) (*pgzip.Writer, error) {
+	writer, err := pgzip.NewWriterLevel(w, level)
+	if err != nil {
+		return nil, err
+	}
+	// pgzip writes the zero time as a time in 2042, rather than as
+	// no modification time
+	writer.Header = pgzip.Header{OS: gzipHeader.OS, ModTime: time.Unix(0, 0)}
+	if err := writer.SetConcurrency(1<<20, workers); err != nil {
+		return nil, err
+	}
+	return writer, nil
+}
+
+// gzipMemberCompressor returns a function that appends a gzip
+// member containing data to dst, compressed at the given level.
+func gzipMemberCompressor(level int) func(dst *bytes.Buffer, data []byte) error {
+	writers := sync.Pool{New: func() interface{} {
+		writer, _ := newGzipWriter(nil, level)
+		return writer
+	}}
+	return func(dst *bytes.Buffer, data []byte) error {
+		writer := writers.Get().(*gzip.Writer)
+		defer writers.Put(writer)
+		// Reset resets the header as well
+		writer.Reset(dst)
+		writer.Header = gzipHeader
+		if _, err := writer.Write(data); err != nil {
+			return err
+		}
+		return writer.Close()
+	}
+}
+
+// bgzfBlocksCompressor returns a function that appends as many
+// BGZF blocks as needed for data to dst, compressed at the given
+// level.
+func bgzfBlocksCompressor(level int) func(dst *bytes.Buffer, data []byte) error {
+	return func(dst *bytes.Buffer, data []byte) error {
+		for len(data) > 0 {
+			n := min(len(data), bgzfBlockSize)
+			if err := compressBgzfBlock(dst, data[:n], level); err != nil {
+				return err
+			}
+			data = data[n:]
+		}
+		return nil
+	}
+}
+
+// newBatchCompressor returns a batch compressor for the output
+// format, or nil if the format is not compressed, or cannot be
+// compressed in batches.
+func newBatchCompressor(name string, opts *options) *batchCompressor {
+	switch outputCompression(name, opts) {
+	case "gzip":
+		compress := gzipMemberCompressor(opts.compressLevel)
+		return &batchCompressor{
+			compress: compress,
+			end: func(w io.Writer, empty bool) error {
+				if !empty {
+					return nil
+				}
+				// an empty file is not a valid gzip stream
+				var member bytes.Buffer
+				if err := compress(&member, nil); err != nil {
+					return err
+				}
+				_, err := w.Write(member.Bytes())
+				return err
+			},
+		}
+	case "bgzf":
+		return &batchCompressor{
+			compress: bgzfBlocksCompressor(opts.compressLevel),
+			end: func(w io.Writer, _ bool) error {
+				_, err := w.Write(bgzfEOF)
+				return err
+			},
+		}
+	}
+	return nil
+}
+
+// concatWriter passes through already compressed members, and
+// terminates them once it is closed. It does not close the
+// underlying writer.
+type concatWriter struct {
+	io.Writer
+	compressor *batchCompressor
+	empty      bool
+}
+
+func (w *concatWriter) Write(p []byte) (int, error) {
+	if len(p) > 0 {
+		w.empty = false
+	}
+	return w.Writer.Write(p)
+}
+
+func (w *concatWriter) Close() error {
+	return w.compressor.end(w.Writer, w.empty)
+}
+
+// input is a possibly decompressed fastq stream together with
+// the underlying resources that need to be closed once it is
+// fully read.
+type input struct {
+	io.Reader
+	closers []io.Closer
+	// the number of bytes read from the underlying file so far,
+	// before decompression, and after it
+	bytesRead, uncompressedRead atomic.Int64
+	// the size of the underlying file before decompression, or
+	// -1 if unknown
+	size int64
+	// with -expected-checksum, the checksum that the underlying
+	// file must have, and the hash of it, computed as it is read
+	// through raw
+	name     string
+	expected *expectedChecksum
+	hash     hash.Hash
+	raw      io.Reader
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n *atomic.Int64
+}
+
+func (r countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n.Add(int64(n))
+	return n, err
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n *atomic.Int64
+}
+
+func (w countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n.Add(int64(n))
+	return n, err
+}
+
+// isStdio reports whether a file name refers to standard input
+// or standard output rather than an actual file.
+func isStdio(name string) bool {
+	return name == "" || name == "-"
+}
+
+// openInput opens a fastq file for reading, or standard input if
+// the name is empty or "-", or downloads it if the name is an
+// HTTP(S) or FTP URL, or reads a member of a ZIP archive if the name
+// selects one, as in in.zip::member. The input is transparently
+// decompressed when it starts with gzip (including BGZF), bzip2,
+// xz, or zstd magic bytes; otherwise it is read as plain text.
+// BGZF input is decompressed with the given number of threads.
+// Decompression errors are reported with the name of the input.
+func openInput(name string, threads int) (*input, error) {
+	return openCheckedInput(name, threads, nil)
+}
+
+// openCheckedInput is like openInput, but also checks the input
+// against an expected checksum, if any: a regular file before it is
+// opened for reading, and otherwise while it is read, for verify to
+// check.
+func openCheckedInput(name string, threads int, expected *expectedChecksum) (*input, error) {
+	var file io.Reader
+	var closers []io.Closer
+	size := int64(-1)
+	switch {
+	case isStdio(name):
+		file = os.Stdin
+		name = "standard input"
+	case isZipMember(name):
+		if expected != nil {
+			return nil, fmt.Errorf("%s: cannot verify the checksum of a ZIP member, only of a whole file", name)
+		}
+		archive, member, _ := splitZipMember(name)
+		return openZipMember(name, archive, member, threads)
+	case isURL(name):
+		r, err := openURL(name)
+		if err != nil {
+			return nil, err
+		}
+		file = r
+		closers = append(closers, r)
+		size = r.size
+	default:
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		file = f
+		closers = append(closers, f)
+		if info, err := f.Stat(); err == nil && info.Mode().IsRegular() {
+			size = info.Size()
+			// a regular file can be read twice, so it is verified
+			// before any output is written
+			if expected != nil {
+				if err := expected.checkFile(f); err != nil {
+					_ = f.Close()
+					return nil, err
+				}
+				expected = nil
+			}
+		}
+	}
+	var h hash.Hash
+	if expected != nil {
+		h = checksumHashes[expected.algorithm]()
+		file = io.TeeReader(file, h)
+	}
+	in, err := newInput(file, name, threads)
+	if err != nil {
+		_ = closeAll(closers)
+		return nil, err
+	}
+	in.closers = append(in.closers, closers...)
+	in.size = size
+	in.name, in.expected, in.hash, in.raw = name, expected, h, file
+	return in, nil
+}
+
+// newInput is like openInput, but reads from an already opened
+// file, which it does not close, and whose size is unknown.
+func newInput(file io.Reader, name string, threads int) (*input, error) {
+	in := &input{size: -1}
+	buffered := bufio.NewReader(countingReader{file, &in.bytesRead})
+	reader, err := newCompressedReader(buffered, threads)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	if reader == nil {
+		// the name of the input says nothing about its content, so
+		// unknown content is only recognized here
+		if magic, err := buffered.Peek(4); err == nil && string(magic) == "PK\x03\x04" {
+			return nil, fmt.Errorf("%s: is a ZIP archive, select a member as in %s%sname.fastq.gz, or correct all of them with -outdir", name, name, zipMemberSeparator)
+		}
+		// tar archives are read with -outdir, and the scanner rejects
+		// them as fastq
+		if first, err := buffered.Peek(1); err == nil && first[0] != '@' && !isTar(buffered) {
+			return nil, fmt.Errorf("%s: does not look like fastq, or like gzip, BGZF, bzip2, xz, or zstd compressed fastq, as it starts with %q", name, first[0])
+		}
+		in.Reader = buffered
+		// errors of files already include their names
+		if _, ok := file.(*os.File); !ok {
+			in.Reader = namedReader{buffered, name}
+		}
+		in.Reader = countingReader{in.Reader, &in.uncompressedRead}
+		return in, nil
+	}
+	in.Reader = countingReader{decompressionReader{reader, name, &in.bytesRead}, &in.uncompressedRead}
+	in.closers = []io.Closer{reader}
+	return in, nil
+}
+
+func (in *input) Close() error {
+	return closeAll(in.closers)
+}
+
+// namedReader prefixes read errors with the name of the input
+// they occurred in.
+type namedReader struct {
+	io.Reader
+	name string
+}
+
+func (r namedReader) Read(p []byte) (n int, err error) {
+	n, err = r.Reader.Read(p)
+	if err != nil && err != io.EOF {
+		err = fmt.Errorf("%s: %w", r.name, err)
+	}
+	return
+}
+
+// decompressionReader is like namedReader for decompressed input,
+// and also reports how many compressed bytes were read when
+// decompression failed. Since the compressed input is read ahead,
+// this is only exact for truncated input, where it is the size of
+// the input.
+type decompressionReader struct {
+	io.Reader
+	name      string
+	bytesRead *atomic.Int64
+}
+
+func (r decompressionReader) Read(p []byte) (n int, err error) {
+	n, err = r.Reader.Read(p)
+	switch {
+	case err == nil || err == io.EOF:
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		err = fmt.Errorf("%s: compressed input is truncated after %d bytes: %w", r.name, r.bytesRead.Load(), err)
+	default:
+		err = fmt.Errorf("%s: decompression failed after %d compressed bytes: %w", r.name, r.bytesRead.Load(), err)
+	}
+	return
+}
+
+// output is a buffered, possibly compressed fastq stream
+// together with the underlying resources that need to be
+// flushed and closed once it is fully written.
+type output struct {
+	*bufio.Writer
+	closers []io.Closer
+	// if not nil, batches must be compressed with this before
+	// they are written
+	compressor *batchCompressor
+	// the checksums to write once the output is complete
+	checksums []checksum
+	// if not nil, the uncompressed content of batches must be
+	// written to this
+	plain io.Writer
+	// with -stats, the name of the output, and the number of bytes
+	// written to it, and before compression
+	name                string
+	stats               bool
+	bytes, uncompressed atomic.Int64
+	// whether to flush the output after each batch, so that what
+	// reads a named pipe gets the records as they are corrected
+	flush bool
+}
+
+// createTemp creates a hidden temporary file in the same directory
+// as name, such as .out.fastq.gz.tmp-1x2y3z for out.fastq.gz, so
+// that it can be renamed to name once it is complete.
+func createTemp(name string) (*os.File, error) {
+	dir, base := filepath.Split(name)
+	for {
+		temp := filepath.Join(dir, "."+base+".tmp-"+strconv.FormatUint(rand.Uint64(), 36))
+		file, err := os.OpenFile(temp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+		if errors.Is(err, os.ErrExist) {
+			continue
+		}
+		return file, tempError(err, name)
+	}
+}
+
+// tempError reports errors of a temporary file, such as a missing
+// directory or a full disk, for the actual file instead.
+func tempError(err error, name string) error {
+	var pathErr *os.PathError
+	if errors.As(err, &pathErr) {
+		pathErr.Path = name
+	}
+	return err
+}
+
+// atomicFile writes to a temporary file that only replaces the
+// actual file once it is closed successfully, so that a failed or
+// interrupted run does not leave a partial output behind that looks
+// complete.
+type atomicFile struct {
+	*os.File
+	name string
+}
+
+func (f atomicFile) Write(p []byte) (int, error) {
+	n, err := f.File.Write(p)
+	return n, tempError(err, f.name)
+}
+
+// Close closes the temporary file, and renames it to the actual
+// file, or removes it if either fails.
+func (f atomicFile) Close() error {
+	err := f.File.Close()
+	if err == nil {
+		err = os.Rename(f.File.Name(), f.name)
+	}
+	if err != nil {
+		_ = os.Remove(f.File.Name())
+	}
+	return err
+}
+
+// Abort closes and removes the temporary file, and leaves the
+// actual file untouched.
+func (f atomicFile) Abort() error {
+	_ = f.File.Close()
+	if err := os.Remove(f.File.Name()); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// inPlaceFile is a file that is written in place with -no-atomic,
+// for file systems that do not support renaming, so that an
+// interrupted run leaves it partial. It is still removed when it is
+// aborted.
+type inPlaceFile struct {
+	*os.File
+}
+
+// Abort closes and removes the file.
+func (f inPlaceFile) Abort() error {
+	_ = f.File.Close()
+	if err := os.Remove(f.File.Name()); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// createFile creates a file for writing, or returns standard
+// output if the name is empty or "-", or starts uploading to S3 if
+// the name is an s3:// URL. Files are written to a temporary file
+// first, which replaces the actual file when it is closed, and is
+// removed when it is aborted instead. Devices and named pipes are
+// written to directly, the latter with createNamedPipe.
+func createFile(name string) (io.Writer, []io.Closer, error) {
+	return createFileInPlace(name, false)
+}
+
+// createFileInPlace is createFile, but with inPlace, writes files in
+// place instead of to a temporary file.
+func createFileInPlace(name string, inPlace bool) (io.Writer, []io.Closer, error) {
+	if isStdio(name) {
+		return os.Stdout, nil, nil
+	}
+	if isS3URL(name) {
+		up, err := createS3(name)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", name, err)
+		}
+		return up, []io.Closer{up}, nil
+	}
+	if isURL(name) {
+		return nil, nil, fmt.Errorf("%s: only s3:// URLs can be written to", name)
+	}
+	if info, err := os.Stat(name); err == nil && info.Mode()&os.ModeNamedPipe != 0 {
+		pipe := createNamedPipe(name)
+		return pipe, []io.Closer{pipe}, nil
+	}
+	if info, err := os.Stat(name); err == nil && !info.Mode().IsRegular() {
+		// devices such as /dev/null cannot be replaced
+		file, err := os.OpenFile(name, os.O_WRONLY|os.O_TRUNC, 0666)
+		if err != nil {
+			return nil, nil, err
+		}
+		return file, []io.Closer{file}, nil
+	}
+	// replace the target of a symbolic link rather than the link
+	if target, err := filepath.EvalSymlinks(name); err == nil {
+		name = target
+	}
+	if inPlace {
+		file, err := os.Create(name)
+		if err != nil {
+			return nil, nil, err
+		}
+		return inPlaceFile{file}, []io.Closer{inPlaceFile{file}}, nil
+	}
+	file, err := createTemp(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	atomic := atomicFile{file, name}
+	return atomic, []io.Closer{atomic}, nil
+}
+
+// namedPipes are the named pipes that outputs are written to with
+// createNamedPipe, which are only waited for once all of them are
+// closed. Outputs are closed in no particular order, such as the
+// second mate file before the first, but what reads them may read
+// them in any order, such as cat, which only reads the second once it
+// has read all of the first, so waiting for each pipe as it is closed
+// could block forever, even if the rest of the second fits in its
+// queue.
+var namedPipes struct {
+	mutex   sync.Mutex
+	open    int
+	writers []*fifoWriter
+}
+
+// A namedPipe is an output to an existing named pipe, created with
+// mkfifo, which is written to through a fifoWriter without spill, so
+// that writing a batch to one of several outputs only blocks once
+// fifoBufferSize bytes wait for whatever reads them. If that stops
+// reading early, writing fails rather than blocks.
+type namedPipe struct {
+	*fifoWriter
+}
+
+// createNamedPipe opens a named pipe for writing, which waits for
+// something to read it without blocking the writes until its queue
+// is full.
+func createNamedPipe(name string) namedPipe {
+	w := newFifoWriter(func() (*os.File, error) { return os.OpenFile(name, os.O_WRONLY, 0) }, false)
+	namedPipes.mutex.Lock()
+	defer namedPipes.mutex.Unlock()
+	namedPipes.open++
+	namedPipes.writers = append(namedPipes.writers, w)
+	return namedPipe{w}
+}
+
+// Close closes the pipe once everything queued is written, and if it
+// is the last open one, waits until all pipes are written, and
+// returns the first error writing to them.
+func (p namedPipe) Close() error {
+	err := p.fifoWriter.Close()
+	if werr := p.release(false); err == nil {
+		err = werr
+	}
+	return err
+}
+
+// Abort discards what is still queued, and closes the pipe, after
+// which the pipe is not waited for.
+func (p namedPipe) Abort() error {
+	_ = p.fifoWriter.Abort()
+	return p.release(true)
+}
+
+// release marks the pipe as closed, and removes it from the pipes to
+// wait for if it is aborted. If no other pipes are open, it waits for
+// the remaining writers to finish.
+func (p namedPipe) release(aborted bool) (err error) {
+	namedPipes.mutex.Lock()
+	namedPipes.open--
+	if aborted {
+		namedPipes.writers = slices.DeleteFunc(namedPipes.writers, func(w *fifoWriter) bool { return w == p.fifoWriter })
+	}
+	var writers []*fifoWriter
+	if namedPipes.open == 0 {
+		writers, namedPipes.writers = namedPipes.writers, nil
+	}
+	namedPipes.mutex.Unlock()
+	for _, w := range writers {
+		if werr := w.wait(); err == nil {
+			err = werr
+		}
+	}
+	return err
+}
+
+// createOutput creates a fastq file for writing, or writes to
+// standard output if the name is empty or "-". The output is
+// compressed as requested by the options, or else based on the
+// extension of the name: gzip for .gz, bzip2 for .bz2, zstd for
+// .zst, and plain text otherwise.
+func createOutput(name string, opts *options) (*output, error) {
+	file, closers, err := opts.createFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return newOutput(file, closers, name, opts)
+}
+
+// newOutput is like createOutput, but writes to an already
+// created file, which is closed with closers.
+func newOutput(file io.Writer, closers []io.Closer, name string, opts *options) (*output, error) {
+	file, plain, checksums, err := startChecksums(file, name, opts)
+	if err != nil {
+		_ = abortAll(closers)
+		return nil, err
+	}
+	out := &output{closers: closers, checksums: checksums, name: name, stats: opts.stats != "", flush: isPipe(closers)}
+	file = countingWriter{file, &out.bytes}
+	writer, err := newCompressedWriter(file, name, opts)
+	if err != nil {
+		_ = abortAll(closers)
+		return nil, err
+	}
+	if writer == nil {
+		out.Writer = bufio.NewWriter(countingWriter{file, &out.uncompressed})
+		return out, nil
+	}
+	var w io.Writer = writer
+	if plain != nil {
+		w = io.MultiWriter(writer, plain)
+	}
+	out.Writer = bufio.NewWriter(countingWriter{w, &out.uncompressed})
+	out.closers = append([]io.Closer{writer}, closers...)
+	return out, nil
+}
+
+// createBatchOutput is like createOutput, except that if the
+// output format can be compressed in batches, compression is
+// left to the caller, which must use out.compressor on each batch
+// before writing it.
+func createBatchOutput(name string, opts *options) (*output, error) {
+	file, closers, err := opts.createFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return newBatchOutput(file, closers, name, opts)
+}
+
+// newBatchOutput is like createBatchOutput, but writes to an
+// already created file, which is closed with closers.
+func newBatchOutput(file io.Writer, closers []io.Closer, name string, opts *options) (*output, error) {
+	compressor := newBatchCompressor(name, opts)
+	if compressor == nil {
+		return newOutput(file, closers, name, opts)
+	}
+	file, plain, checksums, err := startChecksums(file, name, opts)
+	if err != nil {
+		_ = abortAll(closers)
+		return nil, err
+	}
+	out := &output{
+		closers:    closers,
+		compressor: compressor,
+		checksums:  checksums,
+		plain:      plain,
+		name:       name,
+		stats:      opts.stats != "",
+		flush:      isPipe(closers),
+	}
+	// the uncompressed bytes are counted as batches are written
+	writer := &concatWriter{Writer: countingWriter{file, &out.bytes}, compressor: compressor, empty: true}
+	out.Writer = bufio.NewWriter(writer)
+	out.closers = append([]io.Closer{writer}, closers...)
+	return out, nil
+}
+
+// isPipe reports whether the closers of an output close a named pipe,
+// of exec mode or created with mkfifo.
+func isPipe(closers []io.Closer) bool {
+	return slices.ContainsFunc(closers, func(c io.Closer) bool {
+		switch c.(type) {
+		case *fifoWriter, namedPipe:
+			return true
+		}
+		return false
+	})
+}
+
+// discardOutput returns an output that silently drops
+// everything written to it.
+func discardOutput() *output {
+	return &output{Writer: bufio.NewWriter(io.Discard)}
+}
+
+// Close flushes and closes the output, and then writes its
+// checksums. Once flushing or closing fails, the remaining closers
+// are aborted like in abort, since what they would complete is
+// incomplete.
+func (out *output) Close() error {
+	err := out.Flush()
+	for i, closer := range out.closers {
+		if err != nil {
+			_ = abortAll(out.closers[i:])
+			return err
+		}
+		err = closer.Close()
+	}
+	for _, c := range out.checksums {
+		if err != nil {
+			break
+		}
+		err = c.write()
+	}
+	if err == nil && out.stats {
+		addOutputStats(out)
+	}
+	return err
+}
+
+// abort releases the resources of an output that failed, without
+// flushing it.
+func (out *output) abort() error {
+	return abortAll(out.closers)
+}
+
+// abortAll aborts or otherwise closes all closers in order, and
+// returns the first error encountered, if any. Closers that can be
+// aborted, such as S3 uploads and temporary files, are aborted
+// instead of closed, so that the partial output does not appear as
+// if it were complete.
+func abortAll(closers []io.Closer) (err error) {
+	for _, closer := range closers {
+		var cerr error
+		if a, ok := closer.(interface{ Abort() error }); ok {
+			cerr = a.Abort()
+		} else {
+			cerr = closer.Close()
+		}
+		if err == nil {
+			err = cerr
+		}
+	}
+	return
+}
+
+// finishOutput closes out if err holds no error, and otherwise
+// aborts it. It is meant to be deferred.
+func finishOutput(out *output, err *error) {
+	if *err != nil {
+		_ = out.abort()
+		return
+	}
+	*err = out.Close()
+}
+
+// closeAll closes all closers in order, and returns the first
+// error encountered, if any.
+func closeAll(closers []io.Closer) (err error) {
+	for _, closer := range closers {
+		if cerr := closer.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dsnet/compress/bzip2"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// gzipped compresses data as a gzip member.
+func gzipped(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// compressed compresses data with one of the writers of the
+// compression libraries.
+func compressed(t *testing.T, data []byte, newWriter func(io.Writer) (io.WriteCloser, error)) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := newWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestInputDecompression(t *testing.T) {
+	data := platinumFastq(1000)
+	half := bytes.Index(data[len(data)/2:], []byte("\n@")) + len(data)/2 + 1
+	var bgzf bytes.Buffer
+	w := newBgzfWriter(&bgzf, 6)
+	w.Write(data)
+	w.Close()
+	tests := []struct {
+		name  string
+		input []byte
+		err   string
+	}{
+		{"plain", data, ""},
+		{"gzip", gzipped(t, data), ""},
+		{"gzip members", append(gzipped(t, data[:half]), gzipped(t, data[half:])...), ""},
+		{"gzip members with an empty one", append(append(gzipped(t, data[:half]), gzipped(t, nil)...), gzipped(t, data[half:])...), ""},
+		{"gzip members with zero padding", append(append(gzipped(t, data[:half]), make([]byte, 100)...), gzipped(t, data[half:])...), ""},
+		{"gzip with trailing data", append(gzipped(t, data), "garbage"...), "unexpected data after member 1"},
+		{"truncated gzip", gzipped(t, data)[:1000], "compressed input is truncated"},
+		{"bgzf", bgzf.Bytes(), ""},
+		{"bzip2", compressed(t, data, func(w io.Writer) (io.WriteCloser, error) { return bzip2.NewWriter(w, nil) }), ""},
+		{"xz", compressed(t, data, func(w io.Writer) (io.WriteCloser, error) { return xz.NewWriter(w) }), ""},
+		{"zstd", compressed(t, data, func(w io.Writer) (io.WriteCloser, error) { return zstd.NewWriter(w) }), ""},
+		{"not fastq", []byte("ACGT\n"), "does not look like fastq"},
+	}
+	dir := t.TempDir()
+	for _, test := range tests {
+		for _, threads := range []int{1, 4} {
+			name := writeFixture(t, dir, strings.ReplaceAll(test.name, " ", "_"), test.input)
+			in, err := openInput(name, threads)
+			var got []byte
+			if err == nil {
+				got, err = io.ReadAll(in)
+				in.Close()
+			}
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("%s, %d threads: got %v, want %q", test.name, threads, err, test.err)
+				}
+				continue
+			}
+			if err != nil || !bytes.Equal(got, data) {
+				t.Errorf("%s, %d threads: read %d bytes of %d, %v", test.name, threads, len(got), len(data), err)
+			}
+		}
+	}
+}
+
+// TestContentSniffing runs both modes on inputs whose names do not
+// match their content, and checks that compression is recognized by
+// the content, and that content that is neither fastq nor compressed
+// is rejected with an error that says so.
+func TestContentSniffing(t *testing.T) {
+	dir := t.TempDir()
+	data := platinumFastq(1000)
+	reference := filepath.Join(dir, "reference.fastq")
+	if status, stderr := runProgram(t, "seq", writeFixture(t, dir, "in.fastq", data), reference); status != 0 {
+		t.Fatal(stderr)
+	}
+	want, err := os.ReadFile(reference)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	if err := tw.WriteHeader(&tar.Header{Name: "run1/ERR194147_1.fastq", Mode: 0o644, Size: int64(len(data)), Typeflag: tar.TypeReg}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	gzipFastq := writeFixture(t, dir, "gzip.fastq", gzipped(t, data))
+	plainGz := writeFixture(t, dir, "plain.fastq.gz", data)
+	text := writeFixture(t, dir, "text.fastq.gz", []byte("hello\n"))
+	tarFastq := writeFixture(t, dir, "tar.fastq", archive.Bytes())
+	tests := []struct {
+		name  string
+		input string
+		err   string
+	}{
+		{"gzip named .fastq", gzipFastq, ""},
+		{"plain named .gz", plainGz, ""},
+		{"neither fastq nor compressed", text, text + ": does not look like fastq, or like gzip, BGZF, bzip2, xz, or zstd compressed fastq, as it starts with 'h'\n"},
+		{"tar without -outdir", tarFastq, "record 1: the input does not look like fastq, its first line does not start with an @ sign\n"},
+	}
+	for _, test := range tests {
+		for _, mode := range []string{"seq", "par"} {
+			out := filepath.Join(t.TempDir(), "out.fastq")
+			status, stderr := runProgram(t, mode, test.input, out)
+			if test.err != "" {
+				if status != 1 || !strings.HasSuffix(stderr, test.err) {
+					t.Errorf("%s, %s: exit status %d: %s, want %q", test.name, mode, status, stderr, test.err)
+				}
+				continue
+			}
+			if status != 0 {
+				t.Fatalf("%s, %s: %s", test.name, mode, stderr)
+			}
+			if got, err := os.ReadFile(out); err != nil || !bytes.Equal(got, want) {
+				t.Errorf("%s, %s: read %d bytes of %d, %v", test.name, mode, len(got), len(want), err)
+			}
+		}
+	}
+}
+
+// TestCompressionModes runs both modes on plain and gzipped inputs,
+// including multi-member gzip, into plain and compressed outputs, and
+// checks that they all hold the same records.
+func TestCompressionModes(t *testing.T) {
+	dir := t.TempDir()
+	data := platinumFastq(3000)
+	half := bytes.Index(data[len(data)/2:], []byte("\n@")) + len(data)/2 + 1
+	inputs := []string{
+		writeFixture(t, dir, "in.fastq", data),
+		writeFixture(t, dir, "in.fastq.gz", gzipped(t, data)),
+		writeFixture(t, dir, "members.fastq.gz", append(gzipped(t, data[:half]), gzipped(t, data[half:])...)),
+	}
+	reference := filepath.Join(dir, "reference.fastq")
+	if status, stderr := runProgram(t, "seq", inputs[0], reference); status != 0 {
+		t.Fatal(stderr)
+	}
+	want, _ := os.ReadFile(reference)
+	for _, input := range inputs {
+		for _, output := range []string{"out.fastq", "out.fastq.gz", "out.fastq.bgz", "out.fastq.zst"} {
+			for _, mode := range []string{"seq", "par"} {
+				out := filepath.Join(t.TempDir(), output)
+				args := []string{mode}
+				if strings.HasSuffix(output, ".bgz") {
+					args = append(args, "-compression", "bgzf")
+				}
+				if status, stderr := runProgram(t, append(args, input, out)...); status != 0 {
+					t.Fatalf("%s to %s, %s: %s", filepath.Base(input), output, mode, stderr)
+				}
+				in, err := openInput(out, 1)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, err := io.ReadAll(in)
+				in.Close()
+				if err != nil || !bytes.Equal(got, want) {
+					t.Errorf("%s to %s, %s: read %d bytes of %d, %v", filepath.Base(input), output, mode, len(got), len(want), err)
+				}
+			}
+		}
+	}
+}
+
+// TestReproducibleOutput runs par mode twice on the same input, with
+// different numbers of workers, and checks that the gzip and BGZF
+// outputs have the same SHA256, and that their gzip headers have no
+// modification time or name, and an unknown OS.
+func TestReproducibleOutput(t *testing.T) {
+	in := writeFixture(t, t.TempDir(), "in.fastq", platinumFastq(5000))
+	for _, args := range [][]string{{"par"}, {"par", "-compression", "bgzf"}, {"seq", "-parallel-gzip"}} {
+		var sums [2][sha256.Size]byte
+		for i, workers := range []string{"1", "4"} {
+			out := filepath.Join(t.TempDir(), "out.fastq.gz")
+			if status, stderr := runProgram(t, append(args, "-num-workers", workers, in, out)...); status != 0 {
+				t.Fatalf("%v: %s", args, stderr)
+			}
+			data, err := os.ReadFile(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sums[i] = sha256.Sum256(data)
+			// the header of the first member
+			z, err := gzip.NewReader(bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !z.ModTime.IsZero() || z.Name != "" || z.OS != 255 {
+				t.Errorf("%v: gzip header with modification time %v, name %q, OS %d", args, z.ModTime, z.Name, z.OS)
+			}
+		}
+		if sums[0] != sums[1] {
+			t.Errorf("%v: sha256 %x, then %x", args, sums[0], sums[1])
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/jlaffaye/ftp"
+)
+
+// ftpTimeout limits how long connecting to an FTP server may take.
+const ftpTimeout = time.Minute
+
+// ftpResponse closes the control connection of a transfer
+// together with its data connection. Closing the data connection
+// reports an error if the server did not confirm that the
+// transfer is complete within downloadIdleTimeout, as it does not
+// after a stalled transfer.
+type ftpResponse struct {
+	*ftp.Response
+	conn *ftp.ServerConn
+}
+
+// Read reads from the data connection, with a deadline of
+// downloadIdleTimeout from now, so that a stalled transfer is
+// resumed.
+func (r ftpResponse) Read(p []byte) (int, error) {
+	if err := r.SetDeadline(time.Now().Add(downloadIdleTimeout)); err != nil {
+		return 0, err
+	}
+	return r.Response.Read(p)
+}
+
+func (r ftpResponse) Close() error {
+	err := r.Response.Close()
+	_ = r.conn.Quit()
+	return err
+}
+
+// openFTP starts downloading an ftp:// URL in passive mode, with
+// the user name and password from the URL, or else anonymously.
+// An interrupted download is resumed with the REST command.
+func openFTP(u *url.URL) (*download, error) {
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "21")
+	}
+	user, password := "anonymous", "anonymous"
+	if u.User != nil {
+		user = u.User.Username()
+		password, _ = u.User.Password()
+	}
+	// the size is only needed to detect that a transfer ended
+	// early, and not all servers support the SIZE command
+	size := int64(-1)
+	open := func(offset int64) (io.ReadCloser, error) {
+		conn, err := ftp.Dial(host, ftp.DialWithTimeout(ftpTimeout), ftp.DialWithShutTimeout(downloadIdleTimeout))
+		if err != nil {
+			return nil, err
+		}
+		if err := conn.Login(user, password); err != nil {
+			_ = conn.Quit()
+			return nil, err
+		}
+		if offset == 0 {
+			if n, err := conn.FileSize(u.Path); err == nil {
+				size = n
+			}
+		}
+		resp, err := conn.RetrFrom(u.Path, uint64(offset))
+		if err != nil {
+			_ = conn.Quit()
+			return nil, err
+		}
+		return ftpResponse{resp, conn}, nil
+	}
+	body, err := open(0)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", u.Redacted(), err)
+	}
+	return &download{open: open, resumable: true, body: body, size: size}, nil
+}
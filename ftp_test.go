@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// ftpServer is an in-process FTP server for a single file, which
+// supports passive mode with EPSV and resuming with REST. The first
+// transfers stop halfway, and then stall or drop the data
+// connection. It can also report a larger size than it has data for,
+// like a file that is truncated on the server.
+type ftpServer struct {
+	data []byte
+	// the size that SIZE reports
+	size          int
+	interruptions int
+	stall         bool
+	transfers     atomic.Int32
+	// the offsets that transfers asked for with REST
+	offsets chan int
+	done    chan struct{}
+}
+
+// newFTPServer starts an ftpServer for data, and returns its URL
+// for the file.
+func newFTPServer(t *testing.T, s *ftpServer) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.offsets, s.done = make(chan int, 100), make(chan struct{})
+	t.Cleanup(func() {
+		close(s.done)
+		_ = ln.Close()
+	})
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return "ftp://" + ln.Addr().String() + "/in.fastq"
+}
+
+func (s *ftpServer) serve(conn net.Conn) {
+	defer conn.Close()
+	go func() {
+		<-s.done
+		_ = conn.Close()
+	}()
+	r := bufio.NewReader(conn)
+	reply := func(format string, args ...any) {
+		fmt.Fprintf(conn, format+"\r\n", args...)
+	}
+	reply("220 ready")
+	var data net.Listener
+	offset := 0
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		command, arg, _ := strings.Cut(strings.TrimSpace(line), " ")
+		switch command {
+		case "USER":
+			reply("331 password please")
+		case "PASS":
+			reply("230 logged in")
+		case "FEAT":
+			reply("211-Features:\r\n EPSV\r\n REST STREAM\r\n SIZE\r\n211 End")
+		case "TYPE":
+			reply("200 binary")
+		case "SIZE":
+			reply("213 %d", s.size)
+		case "EPSV":
+			if data, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+				reply("425 cannot open data connection")
+				continue
+			}
+			reply("229 Entering Extended Passive Mode (|||%d|)", data.Addr().(*net.TCPAddr).Port)
+		case "REST":
+			offset, _ = strconv.Atoi(arg)
+			reply("350 restarting at %d", offset)
+		case "RETR":
+			s.offsets <- offset
+			s.retrieve(conn, data, offset, reply)
+			data, offset = nil, 0
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("502 %s not implemented", command)
+		}
+	}
+}
+
+// retrieve sends the file from offset on the data connection.
+func (s *ftpServer) retrieve(conn net.Conn, data net.Listener, offset int, reply func(string, ...any)) {
+	if data == nil {
+		reply("425 use EPSV first")
+		return
+	}
+	defer data.Close()
+	reply("150 sending in.fastq")
+	dc, err := data.Accept()
+	if err != nil {
+		return
+	}
+	defer dc.Close()
+	rest := s.data[min(offset, len(s.data)):]
+	if int(s.transfers.Add(1)) > s.interruptions {
+		_, _ = dc.Write(rest)
+		_ = dc.Close()
+		reply("226 transfer complete")
+		return
+	}
+	_, _ = dc.Write(rest[:len(rest)/2])
+	if s.stall {
+		<-s.done
+		return
+	}
+	_ = dc.Close()
+	reply("426 transfer aborted")
+}
+
+func TestFTPDownload(t *testing.T) {
+	defer func(timeout, delay time.Duration) {
+		downloadIdleTimeout, downloadRetryDelay = timeout, delay
+	}(downloadIdleTimeout, downloadRetryDelay)
+	downloadIdleTimeout, downloadRetryDelay = 200*time.Millisecond, time.Millisecond
+	data := platinumFastq(2000)
+	tests := []struct {
+		name          string
+		size          int
+		interruptions int
+		stall         bool
+		// the number of transfers, and the error
+		transfers int
+		err       string
+	}{
+		{"complete", len(data), 0, false, 1, ""},
+		{"dropped", len(data), 2, false, 3, ""},
+		{"stalled", len(data), 2, true, 3, ""},
+		{"truncated", len(data) + 1000, 0, false, 1 + downloadMaxRetries, fmt.Sprintf("after %d of %d bytes: unexpected EOF", len(data), len(data)+1000)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := &ftpServer{data: data, size: test.size, interruptions: test.interruptions, stall: test.stall}
+			d, err := openURL(newFTPServer(t, server))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := io.ReadAll(d)
+			d.Close()
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("got %v, want %q", err, test.err)
+				}
+			} else if err != nil || !bytes.Equal(got, data) {
+				t.Fatalf("read %d bytes of %d after %d transfers: %v", len(got), len(data), server.transfers.Load(), err)
+			}
+			if n := int(server.transfers.Load()); n != test.transfers {
+				t.Errorf("%d transfers, want %d", n, test.transfers)
+			}
+			// each transfer resumes where the previous one stopped
+			for want, i := 0, 0; i < test.transfers; i++ {
+				if offset := <-server.offsets; offset != want {
+					t.Errorf("transfer %d started at %d, want %d", i+1, offset, want)
+				}
+				want += len(data[want:]) / 2
+				if i >= test.interruptions {
+					want = len(data)
+				}
+			}
+		})
+	}
+}
+
+// TestFTPConnectionError checks that an FTP server that cannot be
+// reached is reported with the URL.
+func TestFTPConnectionError(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := "ftp://" + ln.Addr().String() + "/in.fastq"
+	_ = ln.Close()
+	if _, err := openURL(url); err == nil || !strings.HasPrefix(err.Error(), url+": ") {
+		t.Errorf("got %v, want an error for %s", err, url)
+	}
+}
+
+// TestFTPInput runs both modes on a gzipped input on an FTP server,
+// and checks that they have the same output as for a local copy.
+func TestFTPInput(t *testing.T) {
+	dir := t.TempDir()
+	data := gzipped(t, platinumFastq(1000))
+	reference := filepath.Join(dir, "reference.fastq")
+	if status, stderr := runProgram(t, "seq", writeFixture(t, dir, "in.fastq.gz", data), reference); status != 0 {
+		t.Fatal(stderr)
+	}
+	want, err := os.ReadFile(reference)
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := newFTPServer(t, &ftpServer{data: data, size: len(data)}) + ".gz"
+	for _, mode := range []string{"seq", "par"} {
+		out := filepath.Join(dir, mode+".fastq")
+		if status, stderr := runProgram(t, mode, url, out); status != 0 {
+			t.Fatalf("%s: %s", mode, stderr)
+		}
+		if got, err := os.ReadFile(out); err != nil || !bytes.Equal(got, want) {
+			t.Errorf("%s: got %d bytes, want %d, %v", mode, len(got), len(want), err)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var httpClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		ResponseHeaderTimeout: time.Minute,
+	},
+}
+
+// openHTTP starts downloading an HTTP(S) URL. A body that stalls for
+// downloadIdleTimeout is closed. The download can be resumed if the
+// server supports range requests, and identifies the version of the
+// resource with an ETag or Last-Modified header, so that a resumed
+// download continues the same version.
+func openHTTP(url string) (*download, error) {
+	resp, err := httpClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	validator := resp.Header.Get("ETag")
+	if validator == "" {
+		validator = resp.Header.Get("Last-Modified")
+	}
+	return &download{
+		open: func(offset int64) (io.ReadCloser, error) {
+			return resumeHTTP(url, offset, validator)
+		},
+		resumable: resp.Header.Get("Accept-Ranges") == "bytes" && validator != "",
+		body:      newIdleTimeoutBody(resp.Body),
+		size:      resp.ContentLength,
+	}, nil
+}
+
+// resumeHTTP requests the remainder of a resource, starting at
+// offset, provided it still has the given ETag or Last-Modified
+// validator.
+func resumeHTTP(url string, offset int64, validator string) (io.ReadCloser, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	req.Header.Set("If-Range", validator)
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		_ = resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			return nil, errResourceChanged
+		}
+		return nil, fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	if contentRange := resp.Header.Get("Content-Range"); !strings.HasPrefix(contentRange, fmt.Sprintf("bytes %d-", offset)) {
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("unexpected Content-Range %q when resuming the download", contentRange)
+	}
+	return newIdleTimeoutBody(resp.Body), nil
+}
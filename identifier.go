@@ -0,0 +1,450 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"text/template"
+)
+
+// parseIDRegex compiles the regular expression of -id-regex, which
+// must have a capture group named id.
+func parseIDRegex(s string) (*regexp.Regexp, error) {
+	re, err := regexp.Compile(s)
+	if err != nil {
+		return nil, err
+	}
+	if re.SubexpIndex("id") < 0 {
+		return nil, fmt.Errorf("regexp %q lacks a capture group named id, as in (?P<id>...)", s)
+	}
+	return re, nil
+}
+
+// matchIDRegex matches -id-regex against an identifier line without
+// its initial @ sign and its mate suffix, and returns what the id
+// group captures, and whether that is a usable identifier.
+func matchIDRegex(identifier string, opts *options) (string, bool) {
+	line := identifier[1 : len(identifier)-2]
+	m := opts.idRegex.FindStringSubmatchIndex(line)
+	group := 2 * opts.idRegex.SubexpIndex("id")
+	if m == nil || m[group] < 0 || m[group] == m[group+1] {
+		return "", false
+	}
+	return line[m[group]:m[group+1]], true
+}
+
+// identifierFields are what -id-template is evaluated against, for
+// an identifier line such as @ERR194147.1 HSQ1004:134:C0D8DACXX:1:1101:1000:2000/1:
+// the original identifier up to the first space, ERR194147.1, the
+// comment after it without the mate suffix,
+// HSQ1004:134:C0D8DACXX:1:1101:1000:2000, the mate suffix, /1, and
+// the number of the mate, 1.
+type identifierFields struct {
+	Original, Comment, Suffix string
+	ReadNum                   int
+}
+
+// parseIDTemplate parses the template of -id-template, which can
+// use split, as strings.Split, besides the usual functions.
+func parseIDTemplate(s string) (*template.Template, error) {
+	return template.New("id-template").Funcs(template.FuncMap{"split": strings.Split}).Parse(s)
+}
+
+// executeIDTemplate evaluates -id-template for an identifier line,
+// and checks that the result can be an identifier.
+func executeIDTemplate(identifier string, opts *options) (string, error) {
+	line := identifier[1 : len(identifier)-2]
+	fields := identifierFields{Original: line, Suffix: identifier[len(identifier)-2:], ReadNum: int(identifier[len(identifier)-1] - '0')}
+	if i := strings.IndexByte(line, ' '); i >= 0 {
+		fields.Original, fields.Comment = line[:i], line[i+1:]
+	}
+	var b strings.Builder
+	if err := opts.idTemplate.Execute(&b, fields); err != nil {
+		return "", err
+	}
+	id := b.String()
+	if id == "" {
+		return "", errors.New("-id-template gives an empty identifier")
+	}
+	if strings.ContainsAny(id, " \t\r\n") {
+		return "", fmt.Errorf("-id-template gives identifier %q, which contains white space", id)
+	}
+	return id, nil
+}
+
+// rewriteIdentifier matches -rewrite against an identifier line
+// without its initial @ sign, mate suffix included, and returns the
+// corrected identifier that -replace gives from the matches, and
+// whether the line matched. Lines that do not match are kept without
+// their mate suffix, for -rewrite-nomatch keep.
+func rewriteIdentifier(identifier string, opts *options) (string, bool) {
+	line := strings.TrimPrefix(identifier, "@")
+	m := opts.rewrite.FindStringSubmatchIndex(line)
+	if m == nil {
+		if n := len(line); n >= 2 && line[n-2] == '/' {
+			line = line[:n-2]
+		}
+		return line, false
+	}
+	return string(opts.rewrite.ExpandString(nil, opts.replace, line, m)), true
+}
+
+// nameTokens are the tokens of -name-template: the fields of the
+// Illumina identifier in the comment, and those that follow them in
+// the fields that nameFields parses.
+var nameTokens = append(illuminaFields[:], "original", "comment", "mate", "index")
+
+const (
+	tokenOriginal = len(illuminaFields) + iota
+	tokenComment
+	tokenMate
+	tokenIndex
+)
+
+// A nameTemplate is a parsed -name-template, a sequence of literal
+// text and tokens.
+type nameTemplate []namePart
+
+// a namePart is the literal text of a nameTemplate, or if token is
+// not -1, the index of the token in nameTokens.
+type namePart struct {
+	literal string
+	token   int
+}
+
+// parseNameTemplate parses the template of -name-template, in which
+// the tokens of nameTokens are given in braces, such as {lane}, and
+// all other text is literal. Unknown tokens are rejected here, so
+// that they are found before any input is read.
+func parseNameTemplate(s string) (nameTemplate, error) {
+	var t nameTemplate
+	for rest := s; rest != ""; {
+		i := strings.IndexByte(rest, '{')
+		if i < 0 {
+			t = append(t, namePart{literal: rest, token: -1})
+			break
+		}
+		if i > 0 {
+			t = append(t, namePart{literal: rest[:i], token: -1})
+		}
+		name, after, ok := strings.Cut(rest[i+1:], "}")
+		if !ok {
+			return nil, fmt.Errorf("template %q has a { without a }", s)
+		}
+		token := slices.Index(nameTokens, name)
+		if token < 0 {
+			return nil, fmt.Errorf("template %q has unknown token {%s}, must be one of {%s}", s, name, strings.Join(nameTokens, "}, {"))
+		}
+		t = append(t, namePart{token: token})
+		rest = after
+	}
+	if t == nil {
+		return nil, errors.New("empty template")
+	}
+	return t, nil
+}
+
+// nameFields parses an identifier line with a mate suffix into the
+// fields that the tokens of -name-template stand for, such as
+// HSQ1004, 134, C0D8DACXX, 1, 1101, 1000, 2000, ERR194147.1,
+// HSQ1004:134:C0D8DACXX:1:1101:1000:2000#ATCACG, 1, and ATCACG for
+// @ERR194147.1 HSQ1004:134:C0D8DACXX:1:1101:1000:2000#ATCACG/1. The
+// fields of the Illumina identifier are "" unless the comment, up to
+// a space, has all seven of them.
+func nameFields(identifier string) (fields [len(illuminaFields) + 4]string) {
+	line := identifier[1 : len(identifier)-2]
+	fields[tokenOriginal] = originalName(identifier)
+	fields[tokenMate] = identifier[len(identifier)-1:]
+	if i := strings.IndexByte(line, ' '); i >= 0 {
+		fields[tokenComment] = line[i+1:]
+	}
+	id, _, _ := strings.Cut(fields[tokenComment], " ")
+	id, fields[tokenIndex], _ = strings.Cut(id, "#")
+	if strings.Count(id, ":") == len(illuminaFields)-1 {
+		for i := range len(illuminaFields) - 1 {
+			fields[i], id, _ = strings.Cut(id, ":")
+		}
+		fields[len(illuminaFields)-1] = id
+	}
+	return fields
+}
+
+// render renders the template for an identifier line with a mate
+// suffix, and returns the corrected identifier, or the name of a
+// token for which the line has no field, or "".
+func (t nameTemplate) render(identifier string) (string, string) {
+	fields := nameFields(identifier)
+	n := 0
+	for _, part := range t {
+		switch {
+		case part.token < 0:
+			n += len(part.literal)
+		case fields[part.token] == "":
+			return "", nameTokens[part.token]
+		default:
+			n += len(fields[part.token])
+		}
+	}
+	var b strings.Builder
+	b.Grow(n)
+	for _, part := range t {
+		if part.token < 0 {
+			b.WriteString(part.literal)
+		} else {
+			b.WriteString(fields[part.token])
+		}
+	}
+	return b.String(), ""
+}
+
+// hasComment reports whether an identifier line with a mate suffix
+// has a non-empty comment after its first space.
+func hasComment(identifier string) bool {
+	i := strings.IndexByte(identifier, ' ')
+	return i >= 0 && i+1 < len(identifier)-2
+}
+
+// identifierRuleProblem describes why -id-regex, -id-template,
+// -rewrite, or -name-template cannot correct an identifier line, or
+// why it has no comment to take the corrected identifier from by default, or why
+// what it takes is not an Illumina identifier, unless -no-validate
+// is given, or why it has no barcode for -emit-bc-tag, or no valid
+// UMI for -umi-from, or returns "" if it can be corrected. The
+// identifiers are checked when they are read, so that the problems
+// can be reported with record numbers. It also returns the corrected
+// identifier that correctedIdentifier would return, which it derives
+// along the way, so that correcting the record does not derive it
+// again.
+func identifierRuleProblem(identifier string, opts *options) (id, problem string) {
+	switch {
+	case (opts.idRegex != nil || opts.idTemplate != nil || opts.rewrite != nil || opts.nameTemplate != nil) && isCasava(identifier):
+		return "", fmt.Sprintf("identifier line %s is from Casava 1.8, which -id-regex, -id-template, -rewrite, and -name-template cannot correct", identifier)
+	case opts.idRegex != nil:
+		var ok bool
+		if id, ok = matchIDRegex(identifier, opts); !ok {
+			return "", fmt.Sprintf("identifier line %s does not match -id-regex %s with a non-empty id group", identifier, opts.idRegex)
+		}
+	case opts.idTemplate != nil:
+		var err error
+		if id, err = executeIDTemplate(identifier, opts); err != nil {
+			return "", fmt.Sprintf("identifier line %s: %v", identifier, err)
+		}
+	case opts.rewrite != nil:
+		var ok bool
+		id, ok = rewriteIdentifier(identifier, opts)
+		switch {
+		case !ok && opts.rewriteNoMatch == "error":
+			return "", fmt.Sprintf("identifier line %s does not match -rewrite %s, use -rewrite-nomatch keep to keep it", identifier, opts.rewrite)
+		case ok && id == "":
+			return "", fmt.Sprintf("identifier line %s: -replace gives an empty identifier", identifier)
+		case ok && strings.ContainsAny(id, " \t\r\n"):
+			return "", fmt.Sprintf("identifier line %s: -replace gives identifier %q, which contains white space", identifier, id)
+		}
+	case opts.nameTemplate != nil:
+		var missing string
+		id, missing = opts.nameTemplate.render(identifier)
+		switch {
+		case missing != "":
+			return "", fmt.Sprintf("identifier line %s has no %s for {%s} of -name-template", identifier, missing, missing)
+		case strings.ContainsAny(id, " \t\r\n"):
+			return "", fmt.Sprintf("identifier line %s: -name-template gives identifier %q, which contains white space", identifier, id)
+		}
+	case !opts.stripComment && opts.noComment == "error" && !isCasava(identifier) && !hasComment(identifier):
+		return "", fmt.Sprintf("identifier line %s has no comment to take the corrected identifier from, use -no-comment keep to keep its name", identifier)
+	default:
+		id = correctedIdentifier(identifier, opts)
+		if opts.noValidate || !isCasava(identifier) && (opts.stripComment || !hasComment(identifier)) {
+			break
+		}
+		name, _, _ := strings.Cut(id, " ")
+		if opts.umiFrom == "identifier" && strings.Count(name, ":") == len(illuminaFields) {
+			name = name[:strings.LastIndexByte(name, ':')]
+		}
+		if problem := illuminaProblem(name); problem != "" {
+			return "", fmt.Sprintf("identifier line %s: %s, use -no-validate to accept it", identifier, problem)
+		}
+	}
+	if opts.umiFrom != "" {
+		if problem := umiProblem(identifier, id, opts); problem != "" {
+			return "", problem
+		}
+	}
+	if opts.emitBCTag && opts.noBarcode == "error" {
+		if _, barcode := splitBarcode(identifier, id, opts); barcode == "" {
+			return "", fmt.Sprintf("identifier line %s has no barcode for -emit-bc-tag, give one with -barcode, or use -no-barcode omit to leave the tag out", identifier)
+		}
+	}
+	return id, ""
+}
+
+// illuminaFields are the fields of an Illumina identifier, of which
+// those from the lane on must be numeric, so that tools such as
+// Picard MarkDuplicates can parse the tile and the x and y
+// coordinates for optical duplicate marking.
+var illuminaFields = [...]string{"instrument", "run", "flowcell", "lane", "tile", "x", "y"}
+
+// illuminaProblem describes what is wrong with a corrected identifier
+// that must be an Illumina identifier, such as
+// HSQ1004:134:C0D8DACXX:1:1101:1000:2000, or returns "" if it is one.
+func illuminaProblem(id string) string {
+	if n := strings.Count(id, ":") + 1; n != len(illuminaFields) {
+		return fmt.Sprintf("corrected identifier %s has %d colon-separated fields instead of the %d of %s", id, n, len(illuminaFields), strings.Join(illuminaFields[:], ":"))
+	}
+	for i, field := range strings.SplitN(id, ":", len(illuminaFields)) {
+		if i < 3 {
+			continue
+		}
+		if i == len(illuminaFields)-1 {
+			// the index of Illumina 1.4 to 1.7, as in 2000#ATCACG
+			field, _, _ = strings.Cut(field, "#")
+		}
+		if field == "" || strings.ContainsFunc(field, func(r rune) bool { return r < '0' || r > '9' }) {
+			return fmt.Sprintf("corrected identifier %s has a non-numeric %s field %q", id, illuminaFields[i], field)
+		}
+	}
+	return ""
+}
+
+// originalName returns the name of an identifier line with a mate
+// suffix, up to its first space, without its initial @ sign and
+// without a mate suffix of its own, such as ERR194147.1 for
+// @ERR194147.1 HSQ1004:134:C0D8DACXX:1:1101:1000:2000/1.
+func originalName(identifier string) string {
+	name := identifier[1 : len(identifier)-2]
+	if i := strings.IndexByte(identifier, ' '); i >= 0 {
+		name = identifier[1:i]
+	}
+	if suffix := identifier[len(identifier)-2:]; strings.HasSuffix(name, suffix) {
+		name = strings.TrimSuffix(name, suffix)
+	}
+	return name
+}
+
+// splitBarcode splits the barcode off the corrected identifier of an
+// identifier line for -casava18 and -emit-bc-tag, and returns the
+// identifier without it, and the barcode: the -barcode, or otherwise
+// the index of an Illumina 1.4 to 1.7 identifier such as
+// HSQ1004:134:C0D8DACXX:1:1101:1000:2000#ATCACG, or the fourth field
+// of the comment of a Casava 1.8 identifier line, which is left out,
+// or "" if there is none.
+func splitBarcode(identifier, id string, opts *options) (string, string) {
+	var index string
+	if isCasava(identifier) {
+		id, _, _ = strings.Cut(id, " ")
+		_, comment, _ := strings.Cut(identifier, " ")
+		if fields := strings.SplitN(comment, ":", 4); len(fields) == 4 {
+			// up to a UMI that may follow
+			index, _, _ = strings.Cut(fields[3], " ")
+		}
+	} else {
+		id, index, _ = strings.Cut(id, "#")
+	}
+	if opts.barcode != "" {
+		index = opts.barcode
+	}
+	return id, index
+}
+
+// splitUMI takes the UMI out of the corrected identifier of an
+// identifier line for -umi-from, and returns the identifier without
+// it, and the UMI, or "" if there is none. With -umi-from identifier,
+// it is the eighth field of the identifier, as in
+// HSQ1004:134:C0D8DACXX:1:1101:1000:2000:ACGTACGT, which is only
+// removed with -remove-umi, and with -umi-from comment, the last of
+// several words of the comment, as in
+// @HSQ1004:134:C0D8DACXX:1:1101:1000:2000 1:N:0:ATCACG ACGTACGT,
+// which is always removed, as the identifier would otherwise have a
+// space in it.
+func splitUMI(identifier, id string, opts *options) (string, string) {
+	switch opts.umiFrom {
+	case "identifier":
+		name, rest := id, ""
+		if i := strings.IndexByte(id, ' '); i >= 0 {
+			name, rest = id[:i], id[i:]
+		}
+		if strings.Count(name, ":") != len(illuminaFields) {
+			return id, ""
+		}
+		i := strings.LastIndexByte(name, ':')
+		if opts.removeUMI {
+			id = name[:i] + rest
+		}
+		return id, name[i+1:]
+	case "comment":
+		i := strings.IndexByte(identifier, ' ')
+		if i < 0 {
+			return id, ""
+		}
+		comment := identifier[i+1:]
+		if !isCasava(identifier) {
+			comment = comment[:len(comment)-2]
+		}
+		j := strings.LastIndexByte(comment, ' ')
+		if j < 0 {
+			return id, ""
+		}
+		umi := comment[j+1:]
+		return strings.TrimSuffix(id, " "+umi), umi
+	}
+	return id, ""
+}
+
+// umiProblem describes what is wrong with the UMI of an identifier
+// line for -umi-from, given its corrected identifier, or returns "" if
+// it is a non-empty sequence of A, C, G, T, and N.
+func umiProblem(identifier, id string, opts *options) string {
+	_, umi := splitUMI(identifier, id, opts)
+	if umi == "" {
+		return fmt.Sprintf("identifier line %s has no UMI in its %s", identifier, opts.umiFrom)
+	}
+	if strings.ContainsFunc(umi, func(r rune) bool { return !strings.ContainsRune("ACGTN", r) }) {
+		return fmt.Sprintf("identifier line %s has UMI %q, which is not a sequence of A, C, G, T, and N", identifier, umi)
+	}
+	return ""
+}
+
+// casava18Comment returns the comment of a Casava 1.8 identifier line
+// for -casava18, such as 1:N:0:ATCACG, with the number of the mate,
+// no filter flag and control bits, and the barcode.
+func casava18Comment(mate byte, barcode string) string {
+	return string(mate) + ":N:0:" + barcode
+}
+
+// isCasava reports whether a well-formed identifier line is one that
+// Casava 1.8 writes, as it then lacks a mate suffix.
+func isCasava(identifier string) bool {
+	return !strings.HasSuffix(identifier, "/1") && !strings.HasSuffix(identifier, "/2")
+}
+
+// mateNumber returns the number of the mate of a well-formed
+// identifier line, as '1' or '2', from its mate suffix, or from the
+// start of its comment for Casava 1.8.
+func mateNumber(identifier string) byte {
+	if isCasava(identifier) {
+		return identifier[strings.IndexByte(identifier, ' ')+1]
+	}
+	return identifier[len(identifier)-1]
+}
+
+// casavaIdentifier returns the corrected identifier of a Casava 1.8
+// identifier line, which is the line as it is without its initial @
+// sign, or just its name with -strip-comment.
+func casavaIdentifier(identifier string, opts *options) string {
+	if opts.stripComment {
+		return identifier[1:strings.IndexByte(identifier, ' ')]
+	}
+	return identifier[1:]
+}
+
+// printCasava logs that an input has Casava 1.8 identifier lines,
+// once its first record shows it.
+func printCasava(name string, opts *options) {
+	how := "passing them through unchanged"
+	if opts.stripComment {
+		how = "stripping their comments"
+	}
+	fmt.Fprintf(os.Stderr, "%s has Casava 1.8 identifiers, %s\n", name, how)
+}
@@ -0,0 +1,501 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/exascience/correct-platinum-fastq-sequence-identifier/fastq"
+)
+
+func TestRewrite(t *testing.T) {
+	tests := []struct {
+		name, rewrite, replace, noMatch string
+		identifier                      string
+		want                            string
+		problem                         bool
+	}{
+		{"counter", `^(\S+)#\d+`, "sample1:$1", "error", "@READ17#3/1", "sample1:READ17", false},
+		{"named groups", `^(?P<run>\w+)\.(?P<n>\d+) `, "${run}_${n}", "error", "@ERR194147.1 HSQ1004:134:C0D8DACXX:1:1101:1000:2000/2", "ERR194147_1", false},
+		{"mate suffix", `^(\w+)/(\d)$`, "$1-$2", "error", "@READ17/2", "READ17-2", false},
+		{"no match", `^x`, "$0", "error", "@READ17/1", "", true},
+		{"no match kept", `^x`, "$0", "keep", "@READ17 comment/1", "READ17 comment", false},
+		{"empty", `^(\w*)#`, "$1", "error", "@#1/1", "", true},
+		{"white space", `^(\S+) (\S+)/1$`, "$1 $2", "error", "@a b/1", "", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			opts := &options{rewrite: regexp.MustCompile(test.rewrite), replace: test.replace, rewriteNoMatch: test.noMatch, noComment: "error"}
+			id, problem := identifierRuleProblem(test.identifier, opts)
+			if (problem != "") != test.problem {
+				t.Fatalf("identifierRuleProblem(%q) = %q", test.identifier, problem)
+			}
+			if problem != "" {
+				return
+			}
+			if id != test.want {
+				t.Errorf("identifierRuleProblem(%q) gives identifier %q, want %q", test.identifier, id, test.want)
+			}
+			r := correctRecord(fastq.Record{Identifier: test.identifier}, opts)
+			if r.Identifier != test.want {
+				t.Errorf("corrected identifier of %q is %q, want %q", test.identifier, r.Identifier, test.want)
+			}
+			if r.Mate != test.identifier[len(test.identifier)-1] {
+				t.Errorf("mate of %q is %c", test.identifier, r.Mate)
+			}
+		})
+	}
+}
+
+func TestRewriteShortLine(t *testing.T) {
+	opts := &options{rewrite: regexp.MustCompile(`^x`), replace: "$0"}
+	for _, identifier := range []string{"", "@", "@x", "@/"} {
+		rewriteIdentifier(identifier, opts)
+	}
+}
+
+// TestKeepMateSuffix runs both modes on the mate files of a pair, on
+// their own and with -paired, and checks that the corrected
+// identifiers end with the /1 or /2 of their file with
+// -keep-mate-suffix, and have no mate suffix without it.
+func TestKeepMateSuffix(t *testing.T) {
+	dir := t.TempDir()
+	inputs := []string{
+		writeFixture(t, dir, "in_1.fastq", platinumMates(300, '1')),
+		writeFixture(t, dir, "in_2.fastq", platinumMates(300, '2')),
+	}
+	for _, keep := range []bool{false, true} {
+		for _, paired := range []bool{false, true} {
+			for _, mode := range []string{"seq", "par"} {
+				out := t.TempDir()
+				outputs := []string{filepath.Join(out, "out_1.fastq"), filepath.Join(out, "out_2.fastq")}
+				args := []string{mode}
+				if keep {
+					args = append(args, "-keep-mate-suffix")
+				}
+				what := fmt.Sprintf("%s, -keep-mate-suffix %v, -paired %v", mode, keep, paired)
+				if paired {
+					args = append(append(append(args, "-paired"), inputs...), outputs...)
+					if status, stderr := runProgram(t, args...); status != 0 {
+						t.Fatalf("%s: %s", what, stderr)
+					}
+				} else {
+					for i, in := range inputs {
+						if status, stderr := runProgram(t, append(args, in, outputs[i])...); status != 0 {
+							t.Fatalf("%s: %s", what, stderr)
+						}
+					}
+				}
+				var names [2][]string
+				for i, output := range outputs {
+					for _, r := range readRecords(t, output) {
+						id := r.Identifier
+						suffix := fmt.Sprintf("/%d", i+1)
+						if keep {
+							if !strings.HasSuffix(id, suffix) {
+								t.Fatalf("%s: %s in %s does not end with %s", what, id, output, suffix)
+							}
+							id = strings.TrimSuffix(id, suffix)
+						}
+						if strings.Contains(id, "/") || strings.Contains(id, " ") {
+							t.Fatalf("%s: %s in %s is not corrected", what, r.Identifier, output)
+						}
+						names[i] = append(names[i], id)
+					}
+				}
+				if !slices.Equal(names[0], names[1]) || len(names[0]) != 300 {
+					t.Errorf("%s: the mates do not have the same names", what)
+				}
+			}
+		}
+	}
+}
+
+func TestKeepOriginal(t *testing.T) {
+	tests := []struct {
+		name, identifier string
+		opts             options
+		want             string
+	}{
+		{"comment", "@ERR194147.1 HSQ1004:134:C0D8DACXX:1:1101:1000:2000/1", options{keepOriginal: true}, "HSQ1004:134:C0D8DACXX:1:1101:1000:2000 ERR194147.1"},
+		{"tab", "@ERR194147.1 HSQ1004:134:C0D8DACXX:1:1101:1000:2000/2", options{keepOriginal: true, tabComment: true}, "HSQ1004:134:C0D8DACXX:1:1101:1000:2000\tERR194147.1"},
+		{"mate suffix", "@ERR194147.1 HSQ1004:134:C0D8DACXX:1:1101:1000:2000/2", options{keepOriginal: true, keepMateSuffix: true}, "HSQ1004:134:C0D8DACXX:1:1101:1000:2000/2 ERR194147.1"},
+		{"name with a mate suffix", "@ERR194147.1/2 HSQ1004:134:C0D8DACXX:1:1101:1000:2000/2", options{keepOriginal: true}, "HSQ1004:134:C0D8DACXX:1:1101:1000:2000 ERR194147.1"},
+		{"prefix and suffix", "@ERR194147.1 HSQ1004:134:C0D8DACXX:1:1101:1000:2000/1", options{keepOriginal: true, keepMateSuffix: true, prefix: "S1:", suffix: "_c"}, "S1:HSQ1004:134:C0D8DACXX:1:1101:1000:2000_c/1 ERR194147.1"},
+		{"casava", "@HSQ1004:134:C0D8DACXX:1:1101:1000:2000 1:N:0:ATCACG", options{keepOriginal: true}, "HSQ1004:134:C0D8DACXX:1:1101:1000:2000 1:N:0:ATCACG"},
+	}
+	for _, test := range tests {
+		if r := correctRecord(fastq.Record{Identifier: test.identifier}, &test.opts); r.Identifier != test.want {
+			t.Errorf("%s: corrected identifier of %q is %q, want %q", test.name, test.identifier, r.Identifier, test.want)
+		}
+	}
+}
+
+// TestRestoreOriginal runs both modes with -keep-original-as-comment
+// and -keep-mate-suffix on a fixture in testdata, and checks that
+// swapping the name and the comment of each identifier line, as the
+// README shows, restores the fixture byte for byte.
+func TestRestoreOriginal(t *testing.T) {
+	in := filepath.Join("testdata", "lf.fastq")
+	want, err := os.ReadFile(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mode := range []string{"seq", "par"} {
+		out := filepath.Join(t.TempDir(), "out.fastq")
+		if status, stderr := runProgram(t, mode, "-keep-original-as-comment", "-keep-mate-suffix", in, out); status != 0 {
+			t.Fatalf("%s: %s", mode, stderr)
+		}
+		got, err := os.ReadFile(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if first := "@HSQ1004:134:C0D8DACXX:1:1101:1017:2031/1 ERR194147.1\n"; !bytes.HasPrefix(got, []byte(first)) {
+			t.Errorf("%s: the output does not start with %q", mode, first)
+		}
+		lines := strings.SplitAfter(string(got), "\n")
+		for i := 0; i+4 <= len(lines); i += 4 {
+			name, comment, _ := strings.Cut(strings.TrimSuffix(lines[i], "\n"), " ")
+			lines[i] = "@" + comment + " " + name[1:] + "\n"
+		}
+		if restored := strings.Join(lines, ""); restored != string(want) {
+			t.Errorf("%s: restored %q, want %q", mode, restored, want)
+		}
+	}
+}
+
+func TestIlluminaProblem(t *testing.T) {
+	tests := []struct {
+		id, want string
+	}{
+		{"HSQ1004:134:C0D8DACXX:1:1101:1000:2000", ""},
+		{"HSQ1004:134:C0D8DACXX:1:1101:1000:2000#ATCACG", ""},
+		{"length=101", "corrected identifier length=101 has 1 colon-separated fields instead of the 7 of instrument:run:flowcell:lane:tile:x:y"},
+		{"HSQ1004:134:1101:1000:2000", "corrected identifier HSQ1004:134:1101:1000:2000 has 5 colon-separated fields instead of the 7 of instrument:run:flowcell:lane:tile:x:y"},
+		{"HSQ1004:134:C0D8DACXX:1:1101:1000:2000:ACGT", "corrected identifier HSQ1004:134:C0D8DACXX:1:1101:1000:2000:ACGT has 8 colon-separated fields instead of the 7 of instrument:run:flowcell:lane:tile:x:y"},
+		{"HSQ1004:134:C0D8DACXX:A:1101:1000:2000", `corrected identifier HSQ1004:134:C0D8DACXX:A:1101:1000:2000 has a non-numeric lane field "A"`},
+		{"HSQ1004:134:C0D8DACXX:1::1000:2000", `corrected identifier HSQ1004:134:C0D8DACXX:1::1000:2000 has a non-numeric tile field ""`},
+		{"HSQ1004:134:C0D8DACXX:1:1101:1000:2000x", `corrected identifier HSQ1004:134:C0D8DACXX:1:1101:1000:2000x has a non-numeric y field "2000x"`},
+	}
+	for _, test := range tests {
+		if got := illuminaProblem(test.id); got != test.want {
+			t.Errorf("illuminaProblem(%q) = %q, want %q", test.id, got, test.want)
+		}
+	}
+}
+
+// TestValidate runs both modes on a good fixture, and on files whose
+// comments are not Illumina identifiers at a later record, and checks
+// that those fail with the record number and the offending value,
+// unless -no-validate is given.
+func TestValidate(t *testing.T) {
+	dir := t.TempDir()
+	good, err := os.ReadFile(filepath.Join("testdata", "lf.fastq"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	replaceThird := func(identifier string) []byte {
+		lines := strings.SplitAfter(string(good), "\n")
+		lines[8] = identifier + "\n"
+		return []byte(strings.Join(lines, ""))
+	}
+	tests := []struct {
+		name string
+		data []byte
+		err  string
+	}{
+		{"good", good, ""},
+		{"length comment", replaceThird("@ERR194147.3 length=101/1"), "record 3: identifier line @ERR194147.3 length=101/1: corrected identifier length=101 has 1 colon-separated fields instead of the 7 of instrument:run:flowcell:lane:tile:x:y, use -no-validate to accept it\n"},
+		{"five fields", replaceThird("@ERR194147.3 HSQ1004:134:1101:1051:2093/1"), "record 3: identifier line @ERR194147.3 HSQ1004:134:1101:1051:2093/1: corrected identifier HSQ1004:134:1101:1051:2093 has 5 colon-separated fields instead of the 7 of instrument:run:flowcell:lane:tile:x:y, use -no-validate to accept it\n"},
+	}
+	for _, test := range tests {
+		in := writeFixture(t, dir, strings.ReplaceAll(test.name, " ", "_")+".fastq", test.data)
+		for _, mode := range []string{"seq", "par"} {
+			for _, noValidate := range []bool{false, true} {
+				outdir := t.TempDir()
+				args := []string{mode}
+				if noValidate {
+					args = append(args, "-no-validate")
+				}
+				status, stderr := runProgram(t, append(args, in, filepath.Join(outdir, "out.fastq"))...)
+				what := fmt.Sprintf("%s, %s, -no-validate %v", test.name, mode, noValidate)
+				if test.err == "" || noValidate {
+					if status != 0 {
+						t.Errorf("%s: %s", what, stderr)
+					}
+					continue
+				}
+				if status != 1 || !strings.HasSuffix(stderr, test.err) {
+					t.Errorf("%s: exit status %d: %s, want %q", what, status, stderr, test.err)
+				}
+				if entries, _ := os.ReadDir(outdir); len(entries) > 0 {
+					t.Errorf("%s: the output was left behind", what)
+				}
+			}
+		}
+	}
+}
+
+func TestCasava18(t *testing.T) {
+	tests := []struct {
+		name, identifier string
+		opts             options
+		want             string
+	}{
+		{"first mate", "@ERR194147.1 HSQ1004:134:C0D8DACXX:1:1101:1000:2000/1", options{casava18: true}, "HSQ1004:134:C0D8DACXX:1:1101:1000:2000 1:N:0:"},
+		{"second mate", "@ERR194147.1 HSQ1004:134:C0D8DACXX:1:1101:1000:2000/2", options{casava18: true}, "HSQ1004:134:C0D8DACXX:1:1101:1000:2000 2:N:0:"},
+		{"barcode", "@ERR194147.1 HSQ1004:134:C0D8DACXX:1:1101:1000:2000/2", options{casava18: true, barcode: "ATCACG"}, "HSQ1004:134:C0D8DACXX:1:1101:1000:2000 2:N:0:ATCACG"},
+		{"index", "@ERR194147.1 HSQ1004:134:C0D8DACXX:1:1101:1000:2000#ATCACG/2", options{casava18: true}, "HSQ1004:134:C0D8DACXX:1:1101:1000:2000 2:N:0:ATCACG"},
+		{"tab", "@ERR194147.1 HSQ1004:134:C0D8DACXX:1:1101:1000:2000/1", options{casava18: true, tabComment: true}, "HSQ1004:134:C0D8DACXX:1:1101:1000:2000\t1:N:0:"},
+		{"casava input", "@HSQ1004:134:C0D8DACXX:1:1101:1000:2000 2:N:0:ATCACG", options{casava18: true}, "HSQ1004:134:C0D8DACXX:1:1101:1000:2000 2:N:0:ATCACG"},
+	}
+	for _, test := range tests {
+		if r := correctRecord(fastq.Record{Identifier: test.identifier}, &test.opts); r.Identifier != test.want {
+			t.Errorf("%s: corrected identifier of %q is %q, want %q", test.name, test.identifier, r.Identifier, test.want)
+		}
+	}
+}
+
+// TestCasava18Paired runs both modes with -paired and -casava18, into
+// two outputs and interleaved, and checks that each mate has its own
+// number as the first field of its comment.
+func TestCasava18Paired(t *testing.T) {
+	dir := t.TempDir()
+	inputs := []string{
+		writeFixture(t, dir, "in_1.fastq", platinumMates(300, '1')),
+		writeFixture(t, dir, "in_2.fastq", platinumMates(300, '2')),
+	}
+	for _, mode := range []string{"seq", "par"} {
+		out := t.TempDir()
+		outputs := []string{filepath.Join(out, "out_1.fastq"), filepath.Join(out, "out_2.fastq")}
+		args := append([]string{mode, "-paired", "-casava18", "-barcode", "ATCACG"}, inputs...)
+		if status, stderr := runProgram(t, append(args, outputs...)...); status != 0 {
+			t.Fatalf("%s: %s", mode, stderr)
+		}
+		interleaved := filepath.Join(out, "interleaved.fastq")
+		if status, stderr := runProgram(t, append(args, "-interleave", interleaved)...); status != 0 {
+			t.Fatalf("%s, -interleave: %s", mode, stderr)
+		}
+		check := func(name string, r fastq.Record, mate int) {
+			if _, comment, _ := strings.Cut(r.Identifier, " "); comment != fmt.Sprintf("%d:N:0:ATCACG", mate) {
+				t.Fatalf("%s: %s in %s is not mate %d", mode, r.Identifier, name, mate)
+			}
+		}
+		for i, output := range outputs {
+			records := readRecords(t, output)
+			if len(records) != 300 {
+				t.Fatalf("%s: %s has %d records, want 300", mode, output, len(records))
+			}
+			for _, r := range records {
+				check(output, r, i+1)
+			}
+		}
+		records := readRecords(t, interleaved)
+		if len(records) != 600 {
+			t.Fatalf("%s: %s has %d records, want 600", mode, interleaved, len(records))
+		}
+		for i, r := range records {
+			check(interleaved, r, i%2+1)
+		}
+	}
+}
+
+func TestSplitBarcode(t *testing.T) {
+	tests := []struct {
+		name, identifier string
+		opts             options
+		id, barcode      string
+		want             string
+	}{
+		{"index", "@ERR194147.1 HSQ1004:134:C0D8DACXX:1:1101:1000:2000#ATCACG/1", options{emitBCTag: true}, "HSQ1004:134:C0D8DACXX:1:1101:1000:2000", "ATCACG", "HSQ1004:134:C0D8DACXX:1:1101:1000:2000 BC:Z:ATCACG"},
+		{"tab", "@ERR194147.1 HSQ1004:134:C0D8DACXX:1:1101:1000:2000#ATCACG/1", options{emitBCTag: true, tabComment: true}, "HSQ1004:134:C0D8DACXX:1:1101:1000:2000", "ATCACG", "HSQ1004:134:C0D8DACXX:1:1101:1000:2000\tBC:Z:ATCACG"},
+		{"-barcode", "@ERR194147.1 HSQ1004:134:C0D8DACXX:1:1101:1000:2000#ATCACG/1", options{emitBCTag: true, barcode: "GGCTAC"}, "HSQ1004:134:C0D8DACXX:1:1101:1000:2000", "GGCTAC", "HSQ1004:134:C0D8DACXX:1:1101:1000:2000 BC:Z:GGCTAC"},
+		{"casava", "@HSQ1004:134:C0D8DACXX:1:1101:1000:2000 1:N:0:ATCACG", options{emitBCTag: true}, "HSQ1004:134:C0D8DACXX:1:1101:1000:2000", "ATCACG", "HSQ1004:134:C0D8DACXX:1:1101:1000:2000 BC:Z:ATCACG"},
+		{"casava with a UMI", "@HSQ1004:134:C0D8DACXX:1:1101:1000:2000 1:N:0:ATCACG ACGTACGT", options{emitBCTag: true, tabComment: true}, "HSQ1004:134:C0D8DACXX:1:1101:1000:2000", "ATCACG", "HSQ1004:134:C0D8DACXX:1:1101:1000:2000\tBC:Z:ATCACG"},
+		{"omitted", "@ERR194147.1 HSQ1004:134:C0D8DACXX:1:1101:1000:2000/1", options{emitBCTag: true, noBarcode: "omit"}, "HSQ1004:134:C0D8DACXX:1:1101:1000:2000", "", "HSQ1004:134:C0D8DACXX:1:1101:1000:2000"},
+	}
+	for _, test := range tests {
+		id, barcode := splitBarcode(test.identifier, correctedIdentifier(test.identifier, &test.opts), &test.opts)
+		if id != test.id || barcode != test.barcode {
+			t.Errorf("%s: splitBarcode(%q) = %q, %q, want %q, %q", test.name, test.identifier, id, barcode, test.id, test.barcode)
+		}
+		if _, problem := identifierRuleProblem(test.identifier, &test.opts); problem != "" {
+			t.Errorf("%s: %s", test.name, problem)
+		}
+		if r := correctRecord(fastq.Record{Identifier: test.identifier}, &test.opts); r.Identifier != test.want {
+			t.Errorf("%s: corrected identifier of %q is %q, want %q", test.name, test.identifier, r.Identifier, test.want)
+		}
+	}
+}
+
+// TestNoBarcode runs both modes with -emit-bc-tag on a fixture in
+// testdata without barcodes, and checks that it fails with the first
+// record number, or with -no-barcode omit, is corrected without tags.
+func TestNoBarcode(t *testing.T) {
+	in := filepath.Join("testdata", "lf.fastq")
+	want, err := os.ReadFile(filepath.Join("testdata", "lf.corrected.fastq"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mode := range []string{"seq", "par"} {
+		outdir := t.TempDir()
+		status, stderr := runProgram(t, mode, "-emit-bc-tag", in, filepath.Join(outdir, "out.fastq"))
+		if want := "record 1: identifier line @ERR194147.1 HSQ1004:134:C0D8DACXX:1:1101:1017:2031/1 has no barcode for -emit-bc-tag, give one with -barcode, or use -no-barcode omit to leave the tag out\n"; status != 1 || !strings.HasSuffix(stderr, want) {
+			t.Errorf("%s: exit status %d: %s, want %q", mode, status, stderr, want)
+		}
+		if entries, _ := os.ReadDir(outdir); len(entries) > 0 {
+			t.Errorf("%s: the output was left behind", mode)
+		}
+
+		out := filepath.Join(outdir, "omitted.fastq")
+		if status, stderr := runProgram(t, mode, "-emit-bc-tag", "-no-barcode", "omit", in, out); status != 0 {
+			t.Fatalf("%s, -no-barcode omit: %s", mode, stderr)
+		}
+		if got, err := os.ReadFile(out); err != nil || !bytes.Equal(got, want) {
+			t.Errorf("%s, -no-barcode omit: got %q, %v", mode, got, err)
+		}
+	}
+}
+
+func TestUMIProblem(t *testing.T) {
+	tests := []struct {
+		name, identifier, umiFrom string
+		want                      string
+	}{
+		{"identifier", "@ERR194147.1 HSQ1004:134:C0D8DACXX:1:1101:1000:2000:ACGTN/1", "identifier", ""},
+		{"comment", "@HSQ1004:134:C0D8DACXX:1:1101:1000:2000 1:N:0:ATCACG ACGTACGT", "comment", ""},
+		{"no field", "@ERR194147.1 HSQ1004:134:C0D8DACXX:1:1101:1000:2000/1", "identifier", "identifier line @ERR194147.1 HSQ1004:134:C0D8DACXX:1:1101:1000:2000/1 has no UMI in its identifier"},
+		{"empty field", "@ERR194147.1 HSQ1004:134:C0D8DACXX:1:1101:1000:2000:/1", "identifier", "identifier line @ERR194147.1 HSQ1004:134:C0D8DACXX:1:1101:1000:2000:/1 has no UMI in its identifier"},
+		{"no word", "@HSQ1004:134:C0D8DACXX:1:1101:1000:2000 1:N:0:ATCACG", "comment", "identifier line @HSQ1004:134:C0D8DACXX:1:1101:1000:2000 1:N:0:ATCACG has no UMI in its comment"},
+		{"not ACGTN", "@ERR194147.1 HSQ1004:134:C0D8DACXX:1:1101:1000:2000:ACGU/1", "identifier", `identifier line @ERR194147.1 HSQ1004:134:C0D8DACXX:1:1101:1000:2000:ACGU/1 has UMI "ACGU", which is not a sequence of A, C, G, T, and N`},
+		{"lower case", "@HSQ1004:134:C0D8DACXX:1:1101:1000:2000 1:N:0:ATCACG acgt", "comment", `identifier line @HSQ1004:134:C0D8DACXX:1:1101:1000:2000 1:N:0:ATCACG acgt has UMI "acgt", which is not a sequence of A, C, G, T, and N`},
+	}
+	for _, test := range tests {
+		opts := &options{umiFrom: test.umiFrom}
+		if got := umiProblem(test.identifier, correctedIdentifier(test.identifier, opts), opts); got != test.want {
+			t.Errorf("%s: umiProblem(%q) = %q, want %q", test.name, test.identifier, got, test.want)
+		}
+	}
+}
+
+// TestUMIPaired runs both modes with -paired, -umi-from identifier,
+// -remove-umi, and -emit-rx-tag on mates with the same UMI, and
+// checks that both mates get the same name and RX:Z comment, and
+// that an invalid UMI fails the input with its record number.
+func TestUMIPaired(t *testing.T) {
+	dir := t.TempDir()
+	const pairs = 300
+	umis := make([]string, pairs)
+	for i := range umis {
+		for j := range 8 {
+			umis[i] += string("ACGT"[i>>(2*j)&3])
+		}
+	}
+	withUMIs := func(mate byte, bad int) []byte {
+		lines := strings.SplitAfter(string(platinumMates(pairs, mate)), "\n")
+		for i := 0; i+4 <= len(lines); i += 4 {
+			umi := umis[i/4]
+			if i/4+1 == bad {
+				umi = "ACGTX"
+			}
+			lines[i] = strings.TrimSuffix(lines[i], "/"+string(mate)+"\n") + ":" + umi + "/" + string(mate) + "\n"
+		}
+		return []byte(strings.Join(lines, ""))
+	}
+	inputs := []string{
+		writeFixture(t, dir, "in_1.fastq", withUMIs('1', 0)),
+		writeFixture(t, dir, "in_2.fastq", withUMIs('2', 0)),
+	}
+	bad := writeFixture(t, dir, "bad_2.fastq", withUMIs('2', 200))
+	for _, mode := range []string{"seq", "par"} {
+		out := t.TempDir()
+		outputs := []string{filepath.Join(out, "out_1.fastq"), filepath.Join(out, "out_2.fastq")}
+		args := []string{mode, "-paired", "-umi-from", "identifier", "-remove-umi", "-emit-rx-tag"}
+		if status, stderr := runProgram(t, append(append(args, inputs...), outputs...)...); status != 0 {
+			t.Fatalf("%s: %s", mode, stderr)
+		}
+		mates := [2][]fastq.Record{readRecords(t, outputs[0]), readRecords(t, outputs[1])}
+		if len(mates[0]) != pairs || len(mates[1]) != pairs {
+			t.Fatalf("%s: got %d and %d mates, want %d", mode, len(mates[0]), len(mates[1]), pairs)
+		}
+		for i := range pairs {
+			mate1, mate2 := mates[0][i].Identifier, mates[1][i].Identifier
+			if mate1 != mate2 || !strings.HasSuffix(mate1, " RX:Z:"+umis[i]) {
+				t.Fatalf("%s: pair %d: %s and %s, want RX:Z:%s", mode, i+1, mate1, mate2, umis[i])
+			}
+			if name, _, _ := strings.Cut(mate1, " "); illuminaProblem(name) != "" {
+				t.Fatalf("%s: pair %d: the UMI was not removed from %s", mode, i+1, name)
+			}
+		}
+
+		out = t.TempDir()
+		status, stderr := runProgram(t, append(args, inputs[0], bad, filepath.Join(out, "out_1.fastq"), filepath.Join(out, "out_2.fastq"))...)
+		if want := `has UMI "ACGTX", which is not a sequence of A, C, G, T, and N`; status != 1 || !strings.Contains(stderr, "record 200: identifier line @ERR194147.200 ") || !strings.Contains(stderr, want) {
+			t.Errorf("%s: exit status %d: %s, want record 200 and %q", mode, status, stderr, want)
+		}
+	}
+}
+
+func TestNameTemplate(t *testing.T) {
+	const identifier = "@ERR194147.1 HSQ1004:134:C0D8DACXX:1:1101:1000:2000#ATCACG/2"
+	tests := []struct {
+		template, want string
+	}{
+		{"{instrument}:{run}:{flowcell}:{lane}:{tile}:{x}:{y}", "HSQ1004:134:C0D8DACXX:1:1101:1000:2000"},
+		{"NA12878_{flowcell}.{lane}:{tile}:{x}:{y}", "NA12878_C0D8DACXX.1:1101:1000:2000"},
+		{"{original}/{mate}", "ERR194147.1/2"},
+		{"{index}-{comment}", "ATCACG-HSQ1004:134:C0D8DACXX:1:1101:1000:2000#ATCACG"},
+		{"literal", "literal"},
+	}
+	for _, test := range tests {
+		tmpl, err := parseNameTemplate(test.template)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, missing := tmpl.render(identifier); got != test.want || missing != "" {
+			t.Errorf("%q renders %q, %q, want %q", test.template, got, missing, test.want)
+		}
+	}
+	if _, err := parseNameTemplate("{tile}{"); err == nil || err.Error() != `template "{tile}{" has a { without a }` {
+		t.Errorf("parseNameTemplate of an unclosed token: %v", err)
+	}
+	tmpl, err := parseNameTemplate("{flowcell}:{index}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, missing := tmpl.render("@ERR194147.1 length=101/1"); got != "" || missing != "flowcell" {
+		t.Errorf("got %q, %q, want the missing flowcell", got, missing)
+	}
+	if got, missing := tmpl.render("@ERR194147.1 HSQ1004:134:C0D8DACXX:1:1101:1000:2000/1"); got != "" || missing != "index" {
+		t.Errorf("got %q, %q, want the missing index", got, missing)
+	}
+}
+
+// TestNameTemplateOutput runs both modes with -name-template on a
+// fixture in testdata, and checks the output byte for byte, and that
+// an unknown token is a usage error before the input is opened.
+func TestNameTemplateOutput(t *testing.T) {
+	want, err := os.ReadFile(filepath.Join("testdata", "lf.name-template.fastq"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mode := range []string{"seq", "par"} {
+		out := filepath.Join(t.TempDir(), "out.fastq")
+		if status, stderr := runProgram(t, mode, "-name-template", "NA12878_{flowcell}.{lane}:{tile}:{x}:{y}", filepath.Join("testdata", "lf.fastq"), out); status != 0 {
+			t.Fatalf("%s: %s", mode, stderr)
+		}
+		if got, err := os.ReadFile(out); err != nil || !bytes.Equal(got, want) {
+			t.Errorf("%s: got %q, %v", mode, got, err)
+		}
+
+		status, stderr := runProgram(t, mode, "-name-template", "{flowcell}:{lane}:{tiles}", filepath.Join(t.TempDir(), "missing.fastq"), filepath.Join(t.TempDir(), "out.fastq"))
+		if want := `invalid value "{flowcell}:{lane}:{tiles}" for flag -name-template: template "{flowcell}:{lane}:{tiles}" has unknown token {tiles}, must be one of {instrument}, {run}, {flowcell}, {lane}, {tile}, {x}, {y}, {original}, {comment}, {mate}, {index}` + "\n"; status != 2 || !strings.HasPrefix(stderr, want) {
+			t.Errorf("%s: exit status %d: %s, want %q", mode, status, stderr, want)
+		}
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// a job corrects one input file into one output file
+type job struct {
+	in, out string
+	// where the job was specified, for error messages
+	origin string
+}
+
+// label identifies a job in error messages.
+func (j job) label() string {
+	if j.origin != "" {
+		return j.origin
+	}
+	return j.in
+}
+
+// splitPair splits an in:out pair given on the command line. The
+// colons that separate the scheme of a URL from the rest, and a
+// host from a port, and the :: before the member of a ZIP archive,
+// do not separate pairs.
+func splitPair(arg string) (job, bool) {
+	for i := 0; i < len(arg); i++ {
+		if arg[i] != ':' {
+			continue
+		}
+		if strings.HasPrefix(arg[i:], zipMemberSeparator) {
+			// the member of a ZIP archive
+			i++
+			continue
+		}
+		if strings.HasPrefix(arg[i:], "://") {
+			// skip the host of the URL, including a port
+			if slash := strings.IndexByte(arg[i+3:], '/'); slash >= 0 {
+				i += 3 + slash
+				continue
+			}
+			return job{}, false
+		}
+		in, out := arg[:i], arg[i+1:]
+		if in == "" || out == "" {
+			return job{}, false
+		}
+		return job{in: in, out: out}, true
+	}
+	return job{}, false
+}
+
+// parseInterspersed parses the flags in args, which may be mixed
+// with positional arguments, and returns the positional arguments.
+// All arguments after "--" are positional.
+func parseInterspersed(flags *flag.FlagSet, args []string) (positional []string, err error) {
+	for len(args) > 0 {
+		if err := flags.Parse(args); err != nil {
+			return nil, err
+		}
+		rest := flags.Args()
+		if consumed := len(args) - len(rest); consumed > 0 && args[consumed-1] == "--" {
+			return append(positional, rest...), nil
+		}
+		if len(rest) == 0 {
+			break
+		}
+		positional = append(positional, rest[0])
+		args = rest[1:]
+	}
+	return positional, nil
+}
+
+// outdirJobs creates a job for each input, writing to a file with
+// the same base name in outdir.
+func outdirJobs(inputs []string, outdir string) ([]job, error) {
+	if len(inputs) == 0 {
+		return nil, errors.New("-outdir requires at least one input")
+	}
+	jobs := make([]job, len(inputs))
+	for i, in := range inputs {
+		if isStdio(in) {
+			return nil, errors.New("-outdir cannot be used with standard input")
+		}
+		jobs[i] = job{in: in, out: filepath.Join(outdir, filepath.Base(in))}
+	}
+	return jobs, nil
+}
+
+// fastqExtensions and compressionExtensions determine which file
+// names look like fastq files in recursive mode.
+var (
+	fastqExtensions       = []string{".fastq", ".fq"}
+	compressionExtensions = []string{".gz", ".bz2", ".xz", ".zst"}
+)
+
+// isFastqName reports whether a file name has a fastq extension,
+// possibly followed by a compression extension.
+func isFastqName(name string) bool {
+	ext := filepath.Ext(name)
+	if slices.Contains(compressionExtensions, ext) {
+		name = strings.TrimSuffix(name, ext)
+		ext = filepath.Ext(name)
+	}
+	return slices.Contains(fastqExtensions, ext)
+}
+
+// recursiveJobs creates a job for each fastq file in the tree
+// under inroot, writing to the same relative path under outroot.
+// It creates the output directories as needed, except in a dry
+// run. Paths that cannot be read are reported without stopping
+// the walk. Symbolic links to files are followed, but symbolic
+// links to directories are not, to avoid loops.
+func recursiveJobs(inroot, outroot string, opts *options) (jobs []job, skipped, failed int) {
+	report := func(path string, err error) {
+		fmt.Fprintf(os.Stderr, "correct-platinum-fastq-sequence-identifier: %s: %v\n", path, err)
+		failed++
+	}
+	walkErr := filepath.WalkDir(inroot, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			report(path, err)
+			return nil
+		}
+		if entry.IsDir() {
+			return nil
+		}
+		if entry.Type()&fs.ModeSymlink != 0 {
+			info, err := os.Stat(path)
+			if err != nil {
+				report(path, err)
+				return nil
+			}
+			if info.IsDir() {
+				fmt.Fprintln(os.Stderr, "Skipping symbolic link to a directory:", path)
+				skipped++
+				return nil
+			}
+		}
+		if !isFastqName(entry.Name()) {
+			skipped++
+			return nil
+		}
+		rel, err := filepath.Rel(inroot, path)
+		if err != nil {
+			report(path, err)
+			return nil
+		}
+		out := filepath.Join(outroot, rel)
+		if !opts.dryRun {
+			if err := os.MkdirAll(filepath.Dir(out), 0777); err != nil {
+				report(path, err)
+				return nil
+			}
+		}
+		jobs = append(jobs, job{in: path, out: out, origin: path})
+		return nil
+	})
+	if walkErr != nil {
+		report(inroot, walkErr)
+	}
+	return jobs, skipped, failed
+}
+
+// parseJobs determines the jobs from the positional command line
+// arguments: either at most one input and one output, or any
+// number of in:out pairs.
+func parseJobs(args []string) ([]job, error) {
+	pairs := len(args) > 0
+	for _, arg := range args {
+		if _, ok := splitPair(arg); !ok {
+			pairs = false
+			break
+		}
+	}
+	if !pairs {
+		if len(args) > 2 {
+			return nil, fmt.Errorf("expected an input and an output, or in:out pairs, but got %d arguments", len(args))
+		}
+		j := job{in: "-", out: "-"}
+		if len(args) > 0 {
+			j.in = args[0]
+		}
+		if len(args) > 1 {
+			j.out = args[1]
+		}
+		return []job{j}, nil
+	}
+	jobs := make([]job, len(args))
+	for i, arg := range args {
+		jobs[i], _ = splitPair(arg)
+	}
+	return jobs, nil
+}
+
+// readManifest reads jobs from a manifest file with one in/out
+// pair per line, separated by a tab. Empty lines and lines
+// starting with # are ignored. Malformed rows are returned as
+// errors that name the row, next to the valid jobs.
+func readManifest(name string) (jobs []job, errs []error, err error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() { _ = file.Close() }()
+	scanner := bufio.NewScanner(file)
+	for row := 1; scanner.Scan(); row++ {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		origin := fmt.Sprintf("%s:%d", name, row)
+		columns := strings.Split(line, "\t")
+		if len(columns) != 2 || columns[0] == "" || columns[1] == "" {
+			errs = append(errs, fmt.Errorf("%s: expected an input and an output separated by a tab", origin))
+			continue
+		}
+		jobs = append(jobs, job{in: columns[0], out: columns[1], origin: origin})
+	}
+	return jobs, errs, scanner.Err()
+}
+
+// runJobs performs the jobs with the given correction function,
+// at most parallelism at a time, and reports each job that
+// failed. Unless failFast is set, a failed job does not prevent
+// the following ones from running. It returns the number of
+// failed jobs.
+func runJobs(jobs []job, parallelism int, failFast bool, correct func(infastq, outfastq string, opts *options) error, opts *options) (failed int) {
+	errs := make([]error, len(jobs))
+	var wg sync.WaitGroup
+	var stop atomic.Bool
+	slots := make(chan struct{}, max(parallelism, 1))
+	started := 0
+	for i, j := range jobs {
+		slots <- struct{}{}
+		if stop.Load() {
+			break
+		}
+		started++
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			if errs[i] = correct(j.in, j.out, opts); errs[i] != nil && failFast {
+				stop.Store(true)
+			}
+		}()
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err == nil {
+			continue
+		}
+		failed++
+		if len(jobs) > 1 || jobs[i].origin != "" {
+			fmt.Fprintf(os.Stderr, "correct-platinum-fastq-sequence-identifier: %s: %v\n", jobs[i].label(), err)
+		} else {
+			fmt.Fprintln(os.Stderr, "correct-platinum-fastq-sequence-identifier:", err)
+		}
+	}
+	if skipped := len(jobs) - started; skipped > 0 {
+		fmt.Fprintln(os.Stderr, "correct-platinum-fastq-sequence-identifier: skipped", skipped, "remaining jobs after a failure")
+	}
+	if len(jobs) > 1 {
+		fmt.Fprintf(os.Stderr, "Corrected %d of %d files\n", started-failed, len(jobs))
+	}
+	return failed
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// TestRecursive corrects a tree with nested fastq files, another
+// file, a symbolic link to a parent directory, a symbolic link
+// loop, a dangling link, and, unless the tests run as root, a file
+// that cannot be read. It checks the outputs, the report of each
+// path, and the summary.
+func TestRecursive(t *testing.T) {
+	dir := t.TempDir()
+	data := platinumFastq(200)
+	reference := filepath.Join(dir, "reference.fastq")
+	if status, stderr := runProgram(t, "seq", writeFixture(t, dir, "in.fastq", data), reference); status != 0 {
+		t.Fatal(stderr)
+	}
+	want, err := os.ReadFile(reference)
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := filepath.Join(dir, "in")
+	if err := os.MkdirAll(filepath.Join(in, "sub", "deeper"), 0o777); err != nil {
+		t.Fatal(err)
+	}
+	fastqs := []string{"a.fastq", filepath.Join("sub", "b.fq.gz"), filepath.Join("sub", "deeper", "c.fastq")}
+	writeFixture(t, in, fastqs[0], data)
+	writeFixture(t, in, fastqs[1], gzipped(t, data))
+	writeFixture(t, in, fastqs[2], data)
+	writeFixture(t, in, "README.txt", []byte("not fastq\n"))
+	for link, target := range map[string]string{
+		filepath.Join("sub", "up"): "..",
+		"loop.fastq":               "loop.fastq",
+		"gone.fastq":               "missing.fastq",
+	} {
+		if err := os.Symlink(target, filepath.Join(in, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	found, wantFailedJobs := len(fastqs), 0
+	locked := writeFixture(t, in, "locked.fastq", data)
+	if os.Geteuid() == 0 {
+		// root reads the file regardless of its permissions
+		if err := os.Remove(locked); err != nil {
+			t.Fatal(err)
+		}
+	} else {
+		if err := os.Chmod(locked, 0); err != nil {
+			t.Fatal(err)
+		}
+		found++
+		wantFailedJobs++
+	}
+	prefix := "correct-platinum-fastq-sequence-identifier: "
+	for _, mode := range []string{"seq", "par"} {
+		out := filepath.Join(t.TempDir(), "out")
+		status, stderr := runProgram(t, mode, "-recursive", in, out)
+		if status != 1 {
+			t.Errorf("%s: got exit status %d, want 1: %s", mode, status, stderr)
+		}
+		notices := []string{
+			fmt.Sprintf("%s%s: stat %[2]s: %v\n", prefix, filepath.Join(in, "loop.fastq"), syscall.ELOOP),
+			fmt.Sprintf("%s%s: stat %[2]s: %v\n", prefix, filepath.Join(in, "gone.fastq"), syscall.ENOENT),
+			"Skipping symbolic link to a directory: " + filepath.Join(in, "sub", "up") + "\n",
+			fmt.Sprintf("Found %d fastq files, skipped 2 other files, failed to read 2 paths\n", found),
+			fmt.Sprintf("Corrected %d of %d files\n", len(fastqs), found),
+		}
+		if wantFailedJobs > 0 {
+			notices = append(notices, prefix+locked+": open "+locked+": permission denied\n")
+		}
+		for _, notice := range notices {
+			if !strings.Contains(stderr, notice) {
+				t.Errorf("%s: stderr %q does not contain %q", mode, stderr, notice)
+			}
+		}
+		for _, name := range fastqs {
+			if got := readDecompressed(t, filepath.Join(out, name)); !bytes.Equal(got, want) {
+				t.Errorf("%s: %s is not corrected as a single file", mode, name)
+			}
+		}
+		for _, name := range []string{"README.txt", "loop.fastq", "gone.fastq", "locked.fastq", filepath.Join("sub", "up")} {
+			if _, err := os.Lstat(filepath.Join(out, name)); !os.IsNotExist(err) {
+				t.Errorf("%s: got an output for %s", mode, name)
+			}
+		}
+	}
+}
@@ -12,121 +12,518 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
-	"compress/gzip"
 	"context"
 	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"regexp"
 	"runtime"
+	"runtime/debug"
+	"slices"
+	"strconv"
 	"strings"
+	"text/template"
+	"time"
 
+	"github.com/exascience/correct-platinum-fastq-sequence-identifier/fastq"
 	"github.com/exascience/pargo/pipeline"
 )
 
-func check(err error) {
-	if err != nil {
-		panic(err)
+// closeOnReturn closes c, and stores its error in err unless err
+// already holds an earlier error. It is meant to be deferred.
+func closeOnReturn(c io.Closer, err *error) {
+	if cerr := c.Close(); *err == nil {
+		*err = cerr
 	}
 }
 
-func assert(b bool) {
-	if !b {
-		panic("assertion failed")
+// options that apply to both the sequential and the parallel
+// mode.
+type options struct {
+	dryRun    bool
+	workers   int
+	batchSize int
+	// the maximum number of records per output file, or 0 for a
+	// single output file
+	chunkSize int
+	// the fields of the identifiers to split the output by, or
+	// none for a single output
+	splitBy []string
+	// the maximum number of split outputs that are open at the
+	// same time
+	maxOpenFiles  int
+	compression   string
+	compressLevel int
+	zstdLevel     int
+	progress      *progressWriter
+	// compress gzip output that is not compressed in batches with
+	// as many goroutines as there are workers
+	parallelGzip bool
+	// the quality encoding to convert from, or "" to keep the
+	// qualities as they are
+	encoding string
+	// the conversion of the qualities, if any
+	convertQuality *qualityConversion
+	// drop records that Illumina 1.5 marks as filtered
+	dropBQuality bool
+	// drop records with fewer bases than this
+	minLength int
+	// drop records with a larger fraction of N bases than this
+	maxNFraction float64
+	// drop records with a lower mean quality than this, given the
+	// offset of the quality encoding of the inputs
+	minMeanQuality float64
+	qualityOffset  byte
+	// the file to write statistics of the inputs and outputs to,
+	// or "" for none
+	stats string
+	// only process this many records after the skipped ones, or
+	// all of them if 0
+	firstN int
+	// the number of records to skip at the start of each input,
+	// before the ones to process
+	skipN int
+	// keep this fraction of the records, chosen with the seed
+	subsample float64
+	seed      uint64
+	// write md5 sidecar files of the outputs, and of their
+	// uncompressed content
+	writeMD5, writeMD5Uncompressed bool
+	// the hash algorithm of the checksum of each output to print,
+	// one of checksumHashes, or "" for none
+	checksum string
+	// the checksum that the input must have, if any
+	expectedChecksum *expectedChecksum
+	// check that sequences only contain IUPAC nucleotide codes
+	validateSequence bool
+	// the quality encoding to check the qualities against,
+	// "auto" to detect it, or "none"
+	qualityEncoding string
+	// the number of records to detect the quality encoding from
+	detectQualityRecords int
+	// fail on invalid records instead of warning about them
+	strict bool
+	// the regular expression that captures the corrected identifier,
+	// or nil to take it from the comment
+	idRegex *regexp.Regexp
+	// the template that gives the corrected identifier, or nil
+	idTemplate *template.Template
+	// the template of -name-template, or nil
+	nameTemplate nameTemplate
+	// the regular expression of -rewrite, or nil, the replacement
+	// that gives the corrected identifier from its matches, and what
+	// to do with identifier lines that it does not match, "error" or
+	// "keep"
+	rewrite        *regexp.Regexp
+	replace        string
+	rewriteNoMatch string
+	// take the identifier line up to the first space as the
+	// corrected identifier
+	stripComment bool
+	// keep the mate suffix of the identifier line at the end of
+	// the corrected identifier
+	keepMateSuffix bool
+	// accept corrected identifiers that are not Illumina identifiers
+	noValidate bool
+	// append the original name of each record as the comment of
+	// the corrected identifier
+	keepOriginal bool
+	// write Casava 1.8 identifier lines, with this barcode in
+	// their comments, if any
+	casava18 bool
+	barcode  string
+	// append the barcode as a BC:Z SAM tag comment, and what to do
+	// with records without one: "error", or "omit" to leave the tag
+	// out
+	emitBCTag bool
+	noBarcode string
+	// where to take the UMI of each record from, "identifier" or
+	// "comment", or "" for nowhere, whether to remove it from the
+	// identifier, and whether to append it as an RX:Z SAM tag
+	umiFrom   string
+	removeUMI bool
+	emitRXTag bool
+	// separate the added comments with a tab instead of a space
+	tabComment bool
+	// what to do with identifier lines without a comment to take
+	// the corrected identifier from: "error", or "keep" to keep
+	// their name without the mate suffix
+	noComment string
+	// replace existing outputs
+	force bool
+	// create the missing parent directories of the outputs
+	mkdirs bool
+	// write the outputs in place instead of to temporary files
+	noAtomic bool
+	// do not fail on inputs that hold no records
+	allowEmpty bool
+	// prepended to each corrected identifier
+	prefix string
+	// appended to each corrected identifier, before any mate suffix
+	suffix string
+	// accept records whose sequence and qualities are wrapped over
+	// several lines
+	multiline bool
+	// the format of the outputs, one of outputFormats, and for
+	// SAM, the read group header line and its identifier, if any
+	outputFormat           string
+	readGroup, readGroupID string
+	// the output to write a sample of the records to for quality
+	// control, the fraction of records to sample, and the seed of
+	// the sampling
+	qcOut    string
+	qcSample float64
+	qcSeed   uint64
+	// the checkpoint file to record progress in, the time between
+	// checkpoints, and whether to resume from the checkpoint
+	checkpoint         string
+	checkpointInterval time.Duration
+	resume             bool
+	// if not nil, opens the member of an archive that is being
+	// corrected, instead of opening the input by name
+	member func(name string, threads int) (*input, error)
+	// if not nil, creates the outputs instead of createFile, such
+	// as the named pipes of exec mode
+	create func(name string) (io.Writer, []io.Closer, error)
+}
+
+// newScanner returns a Scanner for an input, which accepts wrapped
+// records with -multiline.
+func (opts *options) newScanner(r io.Reader) *fastq.Scanner {
+	s := fastq.NewScanner(r)
+	if opts.multiline {
+		s.Multiline()
 	}
+	return s
 }
 
-func correctPlatinumFastqSequenceIdentifierSequential(infastq, outfastq string) {
-	fmt.Println("Correcting platinum fastq sequence identifiers sequentially:", infastq, "to", outfastq)
+// open opens an input with openInput, or the archive member that
+// is being corrected, and with -expected-checksum, computes its
+// checksum.
+func (opts *options) open(name string, threads int) (*input, error) {
+	if opts.member != nil {
+		return opts.member(name, threads)
+	}
+	return openCheckedInput(name, threads, opts.expectedChecksum)
+}
 
-	ingz, err := os.Open(infastq)
-	check(err)
-	defer func() { check(ingz.Close()) }()
+// createFile creates an output file with createFile, or with the
+// create function of the options. With -mkdirs, it first creates
+// the missing parent directories of local files, and with
+// -no-atomic, local files are written in place.
+func (opts *options) createFile(name string) (io.Writer, []io.Closer, error) {
+	if opts.create != nil {
+		return opts.create(name)
+	}
+	if err := opts.checkOverwrite(name); err != nil {
+		return nil, nil, err
+	}
+	if err := opts.makeParents(name); err != nil {
+		return nil, nil, err
+	}
+	return createFileInPlace(name, opts.noAtomic)
+}
 
-	outgz, err := os.Create(outfastq)
-	check(err)
-	defer func() { check(outgz.Close()) }()
+// checkOverwrite refuses to replace an existing file without
+// -force. Devices such as /dev/null and named pipes are not
+// replaced, so they may be written to.
+func (opts *options) checkOverwrite(name string) error {
+	if opts.force || isStdio(name) || isURL(name) {
+		return nil
+	}
+	if info, err := os.Stat(name); err == nil && info.Mode().IsRegular() {
+		return fmt.Errorf("%s already exists, use -force to overwrite it", name)
+	}
+	return nil
+}
 
-	input, err := gzip.NewReader(ingz)
-	check(err)
-	defer func() { check(input.Close()) }()
-	output := gzip.NewWriter(outgz)
-	defer func() { check(output.Close()) }()
+// checkSameFiles refuses inputs that are the same file as one of
+// the outputs, of any job, or as the sample of -qc-out, whether by
+// name, symbolic link, or hard link, since replacing the output
+// would destroy the input.
+func checkSameFiles(infastqs, outfastqs []string, opts *options) error {
+	if opts.dryRun {
+		return nil
+	}
+	if opts.qcOut != "" {
+		outfastqs = append(slices.Clip(outfastqs), opts.qcOut)
+	}
+	type file struct {
+		name string
+		info os.FileInfo
+	}
+	var inputs []file
+	for _, infastq := range infastqs {
+		if isStdio(infastq) || isURL(infastq) {
+			continue
+		}
+		if info, err := os.Stat(infastq); err == nil && info.Mode().IsRegular() {
+			inputs = append(inputs, file{infastq, info})
+		}
+	}
+	for _, outfastq := range outfastqs {
+		if len(inputs) == 0 || isStdio(outfastq) || isURL(outfastq) {
+			continue
+		}
+		out, err := os.Stat(outfastq)
+		if err != nil {
+			continue
+		}
+		for _, in := range inputs {
+			if !os.SameFile(in.info, out) {
+				continue
+			}
+			if in.name == outfastq {
+				return fmt.Errorf("%s is both an input and an output", outfastq)
+			}
+			return fmt.Errorf("input %s and output %s are the same file", in.name, outfastq)
+		}
+	}
+	return nil
+}
 
-	in := bufio.NewScanner(input)
-	out := bufio.NewWriter(output)
+// checkOutputs runs checkOverwrite on the outputs of a run, or on
+// their first chunks and lists of chunks, before any input is read,
+// so that a mistaken argument order fails right away, along with
+// their md5 files, the sample of -qc-out, and the file of -stats.
+// The chunks after the first one, and the parts of -split-by, are
+// only checked when they are created.
+func checkOutputs(outfastqs []string, opts *options) error {
+	if opts.dryRun || opts.resume {
+		return nil
+	}
+	for _, outfastq := range outfastqs {
+		names := []string{outfastq}
+		if opts.chunkSize > 0 {
+			names = []string{chunkName(outfastq, 1), manifestName(outfastq)}
+		}
+		_, _, checksums, err := startChecksums(io.Discard, names[0], opts)
+		if err != nil {
+			return err
+		}
+		for _, c := range checksums {
+			if c.sidecar != "" {
+				names = append(names, c.sidecar)
+			}
+		}
+		for _, name := range names {
+			if err := opts.checkOverwrite(name); err != nil {
+				return err
+			}
+		}
+	}
+	for _, name := range []string{opts.qcOut, opts.stats} {
+		if name == "" {
+			continue
+		}
+		if err := opts.checkOverwrite(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	for in.Scan() {
-		line := in.Bytes()
-		assert(line[0] == '@')
-		assert(bytes.HasSuffix(line, []byte("/1")) || bytes.HasSuffix(line, []byte("/2")))
-		check(out.WriteByte('@'))
-		_, err := out.Write(line[bytes.IndexByte(line, ' ')+1 : len(line)-2])
-		check(err)
-		check(out.WriteByte('\n'))
+// makeParents creates the missing parent directories of an output
+// with -mkdirs, unless it is standard output or a URL.
+func (opts *options) makeParents(name string) error {
+	if !opts.mkdirs || isStdio(name) || isURL(name) {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(name), 0777); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return nil
+}
 
-		assert(in.Scan())
-		_, err = out.Write(in.Bytes())
-		check(err)
-		check(out.WriteByte('\n'))
+// openOutput creates the output file, or an output that
+// discards everything written to it in a dry run.
+func openOutput(outfastq string, opts *options) (*output, error) {
+	if opts.dryRun {
+		return discardOutput(), nil
+	}
+	return createOutput(outfastq, opts)
+}
 
-		assert(in.Scan())
-		assert(in.Bytes()[0] == '+')
-		_, err = out.Write([]byte("+\n"))
-		check(err)
+// openBatchOutput is like openOutput, but for output that can be
+// compressed in batches.
+func openBatchOutput(outfastq string, opts *options) (*output, error) {
+	if opts.dryRun {
+		return discardOutput(), nil
+	}
+	return createBatchOutput(outfastq, opts)
+}
 
-		assert(in.Scan())
-		_, err = out.Write(in.Bytes())
-		check(err)
-		check(out.WriteByte('\n'))
+// groupDigits formats n with its digits grouped in threes,
+// separated by spaces.
+func groupDigits(n int64) string {
+	digits := strconv.FormatInt(n, 10)
+	var b strings.Builder
+	for i, d := range digits {
+		if i > 0 && (len(digits)-i)%3 == 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteRune(d)
 	}
+	return b.String()
 }
 
-// an entry in a fastq file
-type record struct {
-	identifier, sequence, qualities string
+// printSummary reports the number of records processed from an
+// input since start, and the resulting throughput.
+func printSummary(infastq string, records int, start time.Time, opts *options) {
+	elapsed := time.Since(start)
+	verb := "Processed"
+	if opts.dryRun {
+		verb = "Checked"
+	}
+	rate := int64(float64(records) / elapsed.Seconds())
+	fmt.Fprintf(os.Stderr, "%s %s records from %s in %.1fs (%s rec/s)\n", verb, groupDigits(int64(records)), infastq, elapsed.Seconds(), groupDigits(rate))
+}
+
+func correctPlatinumFastqSequenceIdentifierSequential(infastq, outfastq string, opts *options) (err error) {
+	start := time.Now()
+	if opts.dryRun {
+		fmt.Fprintln(os.Stderr, "Checking platinum fastq sequence identifiers sequentially:", infastq)
+	} else {
+		fmt.Fprintln(os.Stderr, "Correcting platinum fastq sequence identifiers sequentially:", infastq, "to", outfastq)
+	}
+
+	input, err := opts.open(infastq, 1)
+	if err != nil {
+		return err
+	}
+	defer closeOnReturn(input, &err)
+
+	chunks, err := newChunkedOutput(outfastq, opts.chunkSize, opts, openOutput)
+	if err != nil {
+		return err
+	}
+	defer chunks.finish(&err)
+	qc, err := newQCSample(opts, openOutput)
+	if err != nil {
+		return err
+	}
+	if qc != nil {
+		defer qc.finish(&err)
+	}
+	return correctInputSequential(infastq, input, chunks, qc, start, opts)
+}
+
+// correctInputSequential corrects the records of an input into
+// chunks, and samples them into qc, if any. It reads, filters, and
+// corrects them one at a time, in the same order as par mode.
+func correctInputSequential(infastq string, input *input, chunks *chunkedOutput, qc *qcSample, start time.Time, opts *options) error {
+	src := newInputSource(infastq, input, opts)
+	src.progress = startProgress(infastq, input, start, opts)
+	defer src.progress.cancel()
+
+	w := batchWriter{chunks: chunks}
+	var counts filterCounts
+	for src.Fetch(1) > 0 {
+		b, err := correctBatch(src.Data().(sourceBatch), chunks.compressor, opts)
+		if err != nil {
+			return err
+		}
+		counts.add(b.filterCounts)
+		if err := w.write(b); err != nil {
+			return err
+		}
+		if qc != nil {
+			sample, err := qc.sample(b.records)
+			if err != nil {
+				return err
+			}
+			if err := qc.write(sample); err != nil {
+				return err
+			}
+		}
+	}
+	if err := src.Err(); err != nil {
+		return err
+	}
+	return src.finish(start, counts)
 }
 
 // source, newSource, Close, Err, Fetch, and Data are
 // defined for constructing a parallel pargo pipeline.
 
 type source struct {
-	gz      *os.File
-	reader  *gzip.Reader
-	scanner *bufio.Scanner
-	data    interface{}
-	err     error
+	name    string
+	opts    *options
+	quality *qualityCheck
+	input   *input
+	scanner *fastq.Scanner
+	// the maximum number of records per batch, or 0 to let
+	// the pipeline decide
+	batchSize int
+	// the number of records to skip before the first batch, which
+	// a resumed run already wrote, not counting dropped records
+	skip    int
+	records int
+	// the number of records dropped while skipping those that a
+	// resumed run already wrote
+	dropped int
+	// with -filter-min-mean-quality, the records read ahead until
+	// the quality encoding is detected, since the filter needs it
+	// from the first record on
+	ahead    []aheadRecord
+	stats    *recordStats
+	progress *progressReporter
+	data     interface{}
+	err      error
 }
 
-func newSource(name string) (*source, error) {
-	gz, err := os.Open(name)
-	if err != nil {
-		return nil, err
-	}
-	reader, err := gzip.NewReader(gz)
+// a record that a source read ahead, with its number
+type aheadRecord struct {
+	fastq.Record
+	number int
+}
+
+// the records that a source read for a batch, before they are
+// filtered and corrected in the parallel stage of the pipeline
+type sourceBatch struct {
+	records []fastq.Record
+	// the number of the first record in its input
+	first int
+	// the offset of the quality encoding of the input
+	offset byte
+}
+
+func newSource(name string, opts *options) (*source, error) {
+	input, err := opts.open(name, opts.workers)
 	if err != nil {
-		_ = gz.Close()
 		return nil, err
 	}
-	scanner := bufio.NewScanner(reader)
+	return newInputSource(name, input, opts), nil
+}
+
+// newInputSource returns a source that reads from an input that is
+// already open.
+func newInputSource(name string, input *input, opts *options) *source {
 	return &source{
-		gz:      gz,
-		reader:  reader,
-		scanner: scanner,
-	}, nil
+		name:      name,
+		opts:      opts,
+		quality:   newQualityCheck(name, opts),
+		stats:     newRecordStats(opts),
+		input:     input,
+		scanner:   opts.newScanner(input),
+		batchSize: opts.batchSize,
+	}
 }
 
 func (s *source) Close() error {
-	rerr := s.reader.Close()
-	gerr := s.gz.Close()
-	if rerr != nil {
-		return rerr
-	}
-	if gerr != nil {
-		return gerr
-	}
-	return nil
+	return s.input.Close()
+}
+
+// invalid reports a problem found by one of the optional checks
+// with reportInvalid, and returns whether the record must be
+// rejected, in which case s.err is set.
+func (s *source) invalid(problem string) bool {
+	s.err = reportInvalid(s.name, s.records, problem, s.opts)
+	return s.err != nil
 }
 
 func (s *source) Err() error {
@@ -137,49 +534,122 @@ func (s *source) Prepare(_ context.Context) int {
 	return -1
 }
 
-func (s *source) Fetch(n int) (fetched int) {
-	var data []record
-	s.data = nil
-	for fetched = 0; fetched < n; fetched++ {
-		if !s.scanner.Scan() {
-			s.err = s.scanner.Err()
-			if s.err == nil {
-				s.data = data
-				return
+// next returns the next record after those that -skip-n skips. It
+// returns false at the end of the input, or if the record is
+// malformed, in which case s.err is set. With
+// -filter-min-mean-quality and an encoding to detect, it first reads
+// ahead until the encoding is detected, and fails if the qualities
+// fit both encodings.
+func (s *source) next() (fastq.Record, bool) {
+	if s.opts.minMeanQuality > 0 && s.quality.encoding == "auto" && s.ahead == nil {
+		for s.quality.encoding == "auto" {
+			r, ok := s.read()
+			if !ok {
+				if s.err != nil {
+					return r, false
+				}
+				break
 			}
-			return 0
+			s.ahead = append(s.ahead, aheadRecord{r, s.records})
 		}
-		var r record
-		r.identifier = s.scanner.Text()
-		if r.identifier[0] != '@' {
-			s.err = errors.New("malformed identifier line, missing initial @ sign")
-			return 0
+		if s.quality.ambiguous {
+			s.err = fmt.Errorf("cannot filter by mean quality, the quality encoding is ambiguous, give it with -validate-quality")
+			return fastq.Record{}, false
 		}
-		if !(strings.HasSuffix(r.identifier, "/1") || strings.HasSuffix(r.identifier, "/2")) {
-			s.err = errors.New("malformed identifier line, missing suffix")
-			return 0
+	}
+	if len(s.ahead) > 0 {
+		r := s.ahead[0]
+		s.ahead = s.ahead[1:]
+		s.records = r.number
+		return r.Record, true
+	}
+	return s.read()
+}
+
+// read reads the next record after those that -skip-n skips, and
+// checks it, like next.
+func (s *source) read() (r fastq.Record, ok bool) {
+	for {
+		if s.opts.firstN > 0 && s.records >= s.opts.skipN+s.opts.firstN {
+			// the end of the records to process with -first-n
+			s.quality.detect(s.records)
+			return r, false
 		}
-		if !s.scanner.Scan() {
-			s.err = errors.New("missing sequence line")
-			return 0
+		ok = s.scanner.Scan()
+		s.records = s.scanner.Records()
+		if !ok {
+			if s.err = s.scanner.Err(); s.err == nil {
+				s.quality.detect(s.records)
+			}
+			return r, false
 		}
-		r.sequence = s.scanner.Text()
-		if !s.scanner.Scan() {
-			s.err = errors.New("missing intermediate line")
-			return 0
+		s.progress.setRecords(s.records)
+		// skipped with -skip-n, without any of the optional checks
+		if s.records > s.opts.skipN {
+			break
 		}
-		if s.scanner.Text()[0] != '+' {
-			s.err = errors.New("malformed intermediate line, missing initial + sign")
+	}
+	qualities := s.scanner.Qualities()
+	s.stats.add(s.scanner.Sequence(), qualities)
+	if s.invalid(s.quality.check(s.records, qualities)) {
+		return r, false
+	}
+	r = s.scanner.Record()
+	if s.records == s.opts.skipN+1 && s.scanner.Casava() {
+		printCasava(s.name, s.opts)
+	}
+	var problem string
+	if r.Corrected, problem = identifierRuleProblem(r.Identifier, s.opts); problem != "" {
+		s.err = fmt.Errorf("record %d: %s", s.records, problem)
+		return r, false
+	}
+	if s.opts.validateSequence && s.invalid(invalidBase(r.Sequence)) {
+		return r, false
+	}
+	return r, true
+}
+
+// qualityOffset returns the offset of the quality encoding of the
+// input, as far as it is detected.
+func (s *source) qualityOffset() byte {
+	return inputQualityOffset(s.quality.encoding, s.opts)
+}
+
+func (s *source) Fetch(n int) (fetched int) {
+	if s.batchSize > 0 && n > s.batchSize {
+		n = s.batchSize
+	}
+	s.data = nil
+	for s.skip > 0 {
+		r, ok := s.next()
+		if !ok {
+			if s.err == nil {
+				s.err = fmt.Errorf("cannot resume, the input ends before the %d records already written", s.records-skippedRecords(s.records, s.opts)-s.dropped+s.skip)
+			}
 			return 0
 		}
-		if !s.scanner.Scan() {
-			s.err = errors.New("missing qualities line")
-			return 0
+		if _, kept, _ := filterRecord(r, s.qualityOffset(), s.opts); kept {
+			s.skip--
+		} else {
+			s.dropped++
 		}
-		r.qualities = s.scanner.Text()
-		data = append(data, r)
 	}
-	s.data = data
+	var b sourceBatch
+	for fetched = 0; fetched < n; fetched++ {
+		r, ok := s.next()
+		if !ok {
+			if s.err != nil {
+				return 0
+			}
+			break
+		}
+		if fetched == 0 {
+			b.first = s.records
+		}
+		b.records = append(b.records, r)
+	}
+	b.offset = s.qualityOffset()
+	s.data = b
 	return
 }
 
@@ -187,61 +657,956 @@ func (s *source) Data() interface{} {
 	return s.data
 }
 
-func correctPlatinumFastqSequenceIdentifierParallel(infastq, outfastq string) {
-	fmt.Println("Correcting platinum fastq sequence identifiers in parallel:", infastq, "to", outfastq)
+// finish verifies the input once all its records are written, and
+// reports on them, with what the filters did to them.
+func (s *source) finish(start time.Time, counts filterCounts) error {
+	if err := s.input.verify(); err != nil {
+		return err
+	}
+	s.progress.finish()
+	dropped := s.dropped + counts.dropped
+	printSummary(s.name, s.records, start, s.opts)
+	printEmpty(s.name, s.records, s.opts)
+	printSkipped(s.name, s.records, s.opts)
+	printDropped(s.name, dropped, s.opts)
+	addInputStats(s.name, s.input, s.stats, s.records, dropped, s.opts)
+	printClamped(s.name, counts.clamped, s.opts)
+	return nil
+}
+
+// correctedIdentifier returns the identifier for a record under the
+// active identifier rule, without the -prefix, so that -split-by
+// finds the fields where they are. Identifiers that the rule cannot
+// correct are rejected by identifierRuleProblem beforehand.
+func correctedIdentifier(identifier string, opts *options) string {
+	if isCasava(identifier) {
+		return casavaIdentifier(identifier, opts)
+	}
+	if opts.stripComment {
+		if i := strings.IndexByte(identifier, ' '); i >= 0 {
+			return identifier[1:i]
+		}
+		return identifier[1:]
+	}
+	if opts.idRegex != nil {
+		id, _ := matchIDRegex(identifier, opts)
+		return id
+	}
+	if opts.idTemplate != nil {
+		id, _ := executeIDTemplate(identifier, opts)
+		return id
+	}
+	if opts.rewrite != nil {
+		id, _ := rewriteIdentifier(identifier, opts)
+		return id
+	}
+	if opts.nameTemplate != nil {
+		id, _ := opts.nameTemplate.render(identifier)
+		return id
+	}
+	if !hasComment(identifier) {
+		// with -no-comment keep, the name up to an empty comment
+		if i := strings.IndexByte(identifier, ' '); i >= 0 {
+			return identifier[1:i]
+		}
+		return identifier[1 : len(identifier)-2]
+	}
+	return identifier[strings.IndexByte(identifier, ' ')+1 : len(identifier)-2]
+}
+
+// recordIdentifier returns the corrected identifier of a record,
+// which identifierRuleProblem derived when a source read it, or
+// derives it for records that were not read by a source.
+func recordIdentifier(r fastq.Record, opts *options) string {
+	if r.Corrected != "" {
+		return r.Corrected
+	}
+	return correctedIdentifier(r.Identifier, opts)
+}
 
-	src, err := newSource(infastq)
-	check(err)
-	defer func() { check(src.Close()) }()
+// a batch of corrected records, ready to be written
+type batch struct {
+	records []fastq.Record
+	// the records compressed by the output's batch compressor,
+	// if it has one, and the uncompressed records
+	compressed, plain []byte
+	// the batch of the sampled records for -qc-out, if any
+	sample *batch
+	// what the filters did to the records that the batch was
+	// corrected from
+	filterCounts
+}
 
-	outgz, err := os.Create(outfastq)
-	check(err)
-	defer func() { check(outgz.Close()) }()
+// correctRecord corrects the identifier of a record, adds the
+// -prefix and -suffix to it, and keeps its mate number. With
+// -keep-mate-suffix, the mate suffix of the identifier line is
+// appended as well, unless -strip-comment already kept it, and with
+// -keep-original-as-comment, -casava18, -emit-bc-tag, or
+// -emit-rx-tag, a comment follows, after a tab with -tab-comment.
+// With -umi-from, the UMI is taken out of the identifier first.
+func correctRecord(r fastq.Record, opts *options) fastq.Record {
+	line := r.Identifier
+	id, index, umi := recordIdentifier(r, opts), "", ""
+	if opts.umiFrom != "" {
+		id, umi = splitUMI(line, id, opts)
+	}
+	casava18 := opts.casava18 && !isCasava(line)
+	if casava18 || opts.emitBCTag {
+		id, index = splitBarcode(line, id, opts)
+	}
+	r.Identifier, r.Mate, r.Corrected = opts.prefix+id, mateNumber(line), ""
+	keep := opts.keepMateSuffix && !isCasava(line)
+	if opts.suffix != "" || keep {
+		// before a mate suffix that -strip-comment kept, which
+		// PairName must still find at the end
+		name := r.PairName()
+		rest := r.Identifier[len(name):]
+		if keep {
+			rest = line[len(line)-2:]
+		}
+		r.Identifier = name + opts.suffix + rest
+	}
+	separator := " "
+	if opts.tabComment {
+		separator = "\t"
+	}
+	if opts.keepOriginal && !isCasava(line) {
+		r.Identifier += separator + originalName(line)
+	}
+	if casava18 {
+		r.Identifier += separator + casava18Comment(r.Mate, index)
+	}
+	// SAM tags, which bwa mem -C expects to be separated by tabs
+	var tags []string
+	if opts.emitBCTag && index != "" {
+		tags = append(tags, "BC:Z:"+index)
+	}
+	if opts.emitRXTag {
+		tags = append(tags, "RX:Z:"+umi)
+	}
+	if len(tags) > 0 {
+		r.Identifier += separator + strings.Join(tags, "\t")
+	}
+	return r
+}
 
-	output := gzip.NewWriter(outgz)
-	defer func() { check(output.Close()) }()
+// correctBatch filters the records that a source read for a batch
+// with filterRecords, which corrects them, and formats and
+// compresses them if the output has a batch compressor.
+func correctBatch(in sourceBatch, compressor *batchCompressor, opts *options) (batch, error) {
+	records, counts := filterRecords(in.records, in.offset, opts)
+	b, err := formatBatch(records, compressor, opts)
+	b.filterCounts = counts
+	return b, err
+}
 
-	out := bufio.NewWriter(output)
+// formatBatch formats and compresses a batch of corrected records if
+// the output has a batch compressor.
+func formatBatch(records []fastq.Record, compressor *batchCompressor, opts *options) (batch, error) {
+	b := batch{records: records}
+	if compressor == nil {
+		return b, nil
+	}
+	var plain, compressed bytes.Buffer
+	w := fastq.NewRecordWriter(&plain, opts.outputFormat, opts.readGroupID)
+	for _, r := range records {
+		_ = w.WriteRecord(r)
+	}
+	if err := compressor.compress(&compressed, plain.Bytes()); err != nil {
+		return b, err
+	}
+	b.compressed, b.plain = compressed.Bytes(), plain.Bytes()
+	return b, nil
+}
 
+// batchWriter writes corrected batches to an output in order, and
+// counts the records written, so that write errors can name the
+// records they affect.
+type batchWriter struct {
+	chunks  *chunkedOutput
+	records int
+}
+
+// write writes a batch. The records are filtered after the source
+// reads them, so it cannot end its batches at chunk boundaries, and
+// a batch that crosses one is split, and its parts are formatted
+// again.
+func (w *batchWriter) write(b batch) error {
+	room := w.chunks.room()
+	if len(b.records) <= room {
+		return w.writeBatch(b)
+	}
+	for records := b.records; len(records) > 0; room = w.chunks.room() {
+		n := min(len(records), room)
+		part, err := formatBatch(records[:n], w.chunks.compressor, w.chunks.opts)
+		if err != nil {
+			return err
+		}
+		if err := w.writeBatch(part); err != nil {
+			return err
+		}
+		records = records[n:]
+	}
+	return nil
+}
+
+// writeBatch writes a batch that fits into the current chunk.
+func (w *batchWriter) writeBatch(b batch) error {
+	first := w.records + 1
+	w.records += len(b.records)
+	out, err := w.chunks.next(len(b.records))
+	if err != nil {
+		return err
+	}
+	if b.compressed != nil {
+		if _, err := out.Write(b.compressed); err != nil {
+			return fmt.Errorf("records %d to %d: %w", first, w.records, err)
+		}
+		if out.plain != nil {
+			_, _ = out.plain.Write(b.plain)
+		}
+		out.uncompressed.Add(int64(len(b.plain)))
+	} else {
+		rw := fastq.NewRecordWriter(out, w.chunks.opts.outputFormat, w.chunks.opts.readGroupID)
+		for i, r := range b.records {
+			if err := rw.WriteRecord(r); err != nil {
+				return fmt.Errorf("record %d: %w", first+i, err)
+			}
+		}
+	}
+	if out.flush {
+		if err := out.Flush(); err != nil {
+			return fmt.Errorf("records %d to %d: %w", first, w.records, err)
+		}
+	}
+	return nil
+}
+
+func correctPlatinumFastqSequenceIdentifierParallel(infastq, outfastq string, opts *options) (err error) {
+	start := time.Now()
+	if opts.dryRun {
+		fmt.Fprintln(os.Stderr, "Checking platinum fastq sequence identifiers in parallel:", infastq)
+	} else {
+		fmt.Fprintln(os.Stderr, "Correcting platinum fastq sequence identifiers in parallel:", infastq, "to", outfastq)
+	}
+
+	src, err := newSource(infastq, opts)
+	if err != nil {
+		return err
+	}
+	defer closeOnReturn(src, &err)
+
+	src.progress = startProgress(infastq, src.input, start, opts)
+	defer src.progress.cancel()
+
+	if len(opts.splitBy) > 0 {
+		return correctSplit(src, infastq, outfastq, start, opts)
+	}
+
+	cp, err := newCheckpoint(infastq, outfastq, opts)
+	if err != nil {
+		return err
+	}
+	open := openBatchOutput
+	if cp != nil {
+		defer cp.finish(&err)
+		open = cp.open
+		src.skip = cp.records
+	}
+
+	chunks, err := newChunkedOutput(outfastq, opts.chunkSize, opts, open)
+	if err != nil {
+		return err
+	}
+	defer chunks.finish(&err)
+	if opts.resume {
+		fmt.Fprintf(os.Stderr, "Resuming after %s records from checkpoint %s\n", groupDigits(int64(cp.records)), cp.name)
+	}
+
+	qc, err := newQCSample(opts, openBatchOutput)
+	if err != nil {
+		return err
+	}
+	if qc != nil {
+		defer qc.finish(&err)
+	}
+
+	w := batchWriter{chunks: chunks, records: src.skip}
+	return correctSourceParallel(src, &w, qc, cp, start, opts)
+}
+
+// correctSourceParallel corrects the records of a source with a
+// parallel pipeline, writes them with w, and samples them into qc,
+// if any. With a checkpoint, it saves how many records are safely
+// written after each batch.
+func correctSourceParallel(src *source, w *batchWriter, qc *qcSample, cp *checkpoint, start time.Time, opts *options) error {
+	chunks := w.chunks
+	var counts filterCounts
 	var p pipeline.Pipeline
 	p.Source(src)
 	p.Add(
-		pipeline.LimitedPar(runtime.GOMAXPROCS(0), pipeline.Receive(func(_ int, data interface{}) interface{} {
-			records := data.([]record)
-			for i, r := range records {
-				records[i].identifier = r.identifier[strings.IndexByte(r.identifier, ' ')+1 : len(r.identifier)-2]
+		pipeline.LimitedPar(opts.workers, pipeline.Receive(func(_ int, data interface{}) interface{} {
+			b, err := correctBatch(data.(sourceBatch), chunks.compressor, opts)
+			if err == nil && qc != nil {
+				b.sample, err = qc.sample(b.records)
 			}
-			return records
+			if err != nil {
+				p.SetErr(err)
+			}
+			return b
 		})),
 		pipeline.StrictOrd(pipeline.Receive(func(_ int, data interface{}) interface{} {
-			records := data.([]record)
-			for _, r := range records {
-				check(out.WriteByte('@'))
-				_, err := out.WriteString(r.identifier)
-				check(err)
-				check(out.WriteByte('\n'))
-				_, err = out.WriteString(r.sequence)
-				check(err)
-				_, err = out.WriteString("\n+\n")
-				check(err)
-				_, err = out.WriteString(r.qualities)
-				check(err)
-				check(out.WriteByte('\n'))
+			b := data.(batch)
+			counts.add(b.filterCounts)
+			if err := w.write(b); err != nil {
+				p.SetErr(err)
+				return nil
+			}
+			if qc != nil {
+				if err := qc.write(b.sample); err != nil {
+					p.SetErr(err)
+					return nil
+				}
+			}
+			if cp != nil {
+				if err := cp.save(chunks.out, w.records); err != nil {
+					p.SetErr(fmt.Errorf("%s: %w", cp.name, err))
+				}
 			}
 			return nil
 		})),
 	)
 	p.Run()
-	check(p.Err())
+	if err := p.Err(); err != nil {
+		return err
+	}
+	return src.finish(start, counts)
+}
+
+// fatal reports an error and exits.
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, "correct-platinum-fastq-sequence-identifier:", err)
+	os.Exit(1)
+}
+
+// usageError reports an invalid command line and exits.
+func usageError(flags *flag.FlagSet, message string) {
+	fmt.Fprintln(os.Stderr, program+":", message)
+	flags.Usage()
+	os.Exit(2)
+}
+
+const program = "correct-platinum-fastq-sequence-identifier"
+
+// usage prints how to invoke the program, and all its flags.
+func usage(flags *flag.FlagSet) {
+	w := flags.Output()
+	fmt.Fprintln(w, "Usage:")
+	for _, form := range []string{
+		"seq|par [flags] [in.fastq.gz|-] [out.fastq.gz|-]",
+		"seq|par [flags] in1.fastq.gz:out1.fastq.gz in2.fastq.gz:out2.fastq.gz ...",
+		"seq|par [flags] -outdir dir in1.fastq.gz in2.fastq.gz ...",
+		"seq|par [flags] -concat in1.fastq.gz in2.fastq.gz ... out.fastq.gz",
+		"seq|par [flags] -manifest pairs.tsv",
+		"seq|par [flags] -recursive indir outdir",
+		"seq|par [flags] -paired in_1.fastq.gz in_2.fastq.gz out_1.fastq.gz out_2.fastq.gz",
+		"seq|par [flags] -paired -interleave in_1.fastq.gz in_2.fastq.gz [out.fastq.gz|-]",
+		"par [flags] -deinterleave [in.fastq.gz|-] out_1.fastq.gz out_2.fastq.gz",
+		"exec [flags] -1 in_1.fastq.gz [-2 in_2.fastq.gz] -- command args... {r1} [{r2}]",
+	} {
+		fmt.Fprintln(w, " ", program, form)
+	}
+	fmt.Fprintln(w, "  "+program, "-version")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Moves the Illumina sequence identifiers of Platinum fastq files from the")
+	fmt.Fprintln(w, "comments into the actual identifiers. seq corrects the identifiers")
+	fmt.Fprintln(w, "sequentially, par uses a parallel pipeline. An input or output of - or one")
+	fmt.Fprintln(w, "that is left out means standard input or standard output. exec corrects in")
+	fmt.Fprintln(w, "parallel into named pipes that replace {r1} and {r2} in the command it runs.")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Flags:")
+	flags.PrintDefaults()
+}
+
+// version is set at build time with
+// -ldflags "-X main.version=...".
+var version string
+
+// printVersion prints the version of the program, and the version
+// of Go it was built with.
+func printVersion() {
+	v := version
+	if v == "" {
+		v = "(devel)"
+		if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" {
+			v = info.Main.Version
+		}
+	}
+	fmt.Printf("correct-platinum-fastq-sequence-identifier %s %s %s/%s\n", v, runtime.Version(), runtime.GOOS, runtime.GOARCH)
 }
 
 func main() {
-	switch os.Args[1] {
-	case "seq":
-		correctPlatinumFastqSequenceIdentifierSequential(os.Args[2], os.Args[3])
-	case "par":
-		correctPlatinumFastqSequenceIdentifierParallel(os.Args[2], os.Args[3])
+	var opts options
+	flags := flag.NewFlagSet(program, flag.ContinueOnError)
+	flags.Usage = func() { usage(flags) }
+	flags.BoolFunc("version", "print the version and exit", func(string) error {
+		printVersion()
+		os.Exit(0)
+		return nil
+	})
+	flags.BoolVar(&opts.dryRun, "dry-run", false, "validate the input without writing any output")
+	flags.StringVar(&opts.encoding, "encoding", "", "convert the qualities from this `encoding` to Phred+33; only illumina15, for the Phred+64 of Illumina 1.5, is supported")
+	flags.Func("convert-quality", "convert the qualities between encodings, given as from=`encoding`,to=encoding with phred33 or phred64, clamping those outside the range of the target encoding", func(s string) (err error) {
+		opts.convertQuality, err = parseQualityConversion(s)
+		return err
+	})
+	flags.BoolVar(&opts.dropBQuality, "drop-b-quality", false, "with -encoding illumina15, drop the records whose qualities are all B, which Illumina 1.5 uses to mark filtered reads")
+	flags.IntVar(&opts.minLength, "filter-min-length", 0, "drop the records with fewer than this many bases; 0 keeps them all, and with mate files, a pair is dropped if either mate is too short")
+	flags.Float64Var(&opts.maxNFraction, "filter-max-n-fraction", 1, "drop the records of which more than this `fraction` of the bases are N, such as 0.1; 1 keeps them all, and with mate files, a pair is dropped if either mate has too many")
+	flags.Float64Var(&opts.minMeanQuality, "filter-min-mean-quality", 0, "drop the records whose mean Phred quality is below this `quality`, such as 20, decoded with the encoding of -convert-quality or -validate-quality, which auto detects first by reading up to -detect-quality-records records ahead, or else phred33 with -validate-quality none; with mate files, a pair is dropped if either mate is too low")
+	flags.IntVar(&opts.firstN, "first-n", 0, "only process the first n records of each input, after those that -skip-n skips, such as for a quick test; 0 processes them all")
+	flags.StringVar(&opts.stats, "stats", "", "write statistics of each input and output, such as the numbers of records, the sequence lengths, the qualities, and the compression ratios, to this JSON `file`")
+	flags.IntVar(&opts.skipN, "skip-n", 0, "skip the first n records of each input, such as a known-bad leading region, without checking their identifiers and qualities")
+	flags.Float64Var(&opts.subsample, "subsample", 1, "keep this `fraction` of the records, such as 0.01, chosen pseudo-randomly with -seed from their corrected identifiers, keeping the mates of a pair together")
+	flags.Uint64Var(&opts.seed, "seed", 0, "the seed for -subsample; a different seed keeps different records")
+	flags.BoolVar(&opts.writeMD5, "write-md5", false, "write the md5 checksum of each output to a file with .md5 appended to its name, as md5sum does")
+	flags.BoolVar(&opts.writeMD5Uncompressed, "write-md5-uncompressed", false, "write the md5 checksum of the uncompressed content of each output to a file named after it without the compression extension, with .md5 appended")
+	flags.StringVar(&opts.checksum, "checksum", "", "print the checksum of each output with this `algorithm`, md5 or sha256, computed while it is written, once it is complete")
+	flags.Func("expected-checksum", "fail unless the input, as read before decompression, has this `checksum`, given as md5:hex or sha256:hex: a local file is checked before anything is written, other inputs while they are read, aborting the outputs on a mismatch", func(s string) (err error) {
+		opts.expectedChecksum, err = parseExpectedChecksum(s)
+		return err
+	})
+	flags.BoolVar(&opts.validateSequence, "validate-sequence", false, "warn about sequences with characters other than IUPAC nucleotide codes, . and -")
+	flags.StringVar(&opts.qualityEncoding, "validate-quality", "auto", "warn about qualities outside the range of this `encoding`: phred33 (33 to 126), phred64 (64 to 126), auto to detect it, or none")
+	flags.IntVar(&opts.detectQualityRecords, "detect-quality-records", 10000, "with -validate-quality auto, the number of records to detect the encoding from")
+	flags.StringVar(&opts.noComment, "no-comment", "error", "what to do with identifier lines without a comment to take the corrected identifier from: `error`, or keep to keep the identifier without its mate suffix")
+	flags.Func("id-regex", "take the corrected identifier from what the capture group named id of this `regexp` matches in the identifier line, without its initial @ sign and mate suffix, such as '(?P<id>\\S+)$', instead of from the comment", func(s string) (err error) {
+		opts.idRegex, err = parseIDRegex(s)
+		return err
+	})
+	flags.Func("id-template", "take the corrected identifier from this Go `template`, evaluated with the fields .Original, .Comment, .Suffix, and .ReadNum of the identifier line, such as 'sample1:{{.Comment}}'", func(s string) (err error) {
+		opts.idTemplate, err = parseIDTemplate(s)
+		return err
+	})
+	flags.Func("name-template", "build the corrected identifier from this `template`, in which {instrument}, {run}, {flowcell}, {lane}, {tile}, {x}, and {y} stand for the fields of the Illumina identifier in the comment, and {original}, {comment}, {mate}, and {index} for the original name, the whole comment, the mate number, and the index after a # sign, such as 'sample1:{flowcell}:{lane}:{tile}:{x}:{y}'", func(s string) (err error) {
+		opts.nameTemplate, err = parseNameTemplate(s)
+		return err
+	})
+	flags.Func("rewrite", "take the corrected identifier from this `regexp` matched against the identifier line without its initial @ sign, mate suffix included, as -replace gives it, instead of from the comment", func(s string) (err error) {
+		opts.rewrite, err = regexp.Compile(s)
+		return err
+	})
+	flags.StringVar(&opts.replace, "replace", "", "with -rewrite, the corrected identifier, in which $1 or ${name} stand for what the capture groups of the regexp matched, as in regexp.Expand")
+	flags.StringVar(&opts.rewriteNoMatch, "rewrite-nomatch", "error", "what to do with identifier lines that -rewrite does not match: `error`, or keep to keep the identifier line without its mate suffix")
+	flags.BoolVar(&opts.noValidate, "no-validate", false, "accept corrected identifiers taken from the comment that are not Illumina identifiers instrument:run:flowcell:lane:tile:x:y with numeric lane, tile, x, and y")
+	flags.BoolVar(&opts.keepMateSuffix, "keep-mate-suffix", false, "keep the /1 or /2 mate suffix of the identifier line at the end of the corrected identifier in fastq output, for tools that recognize mates by it")
+	flags.BoolVar(&opts.keepOriginal, "keep-original-as-comment", false, "keep the original name of each record, up to the first space and without a mate suffix, as the comment of the corrected identifier in fastq output, such as ERR194147.1")
+	flags.BoolVar(&opts.stripComment, "strip-comment", false, "instead of taking the corrected identifier from the comment, remove the comment, keeping the identifier line up to the first space as it is")
+	flags.Func("prefix", "prepend this `string` to each corrected identifier, such as a sample name as in SAMPLE1:", func(s string) error {
+		if strings.ContainsAny(s, " \t") {
+			return errors.New("an identifier cannot contain white space")
+		}
+		opts.prefix = s
+		return nil
+	})
+	flags.BoolVar(&opts.casava18, "casava18", false, "write Casava 1.8 identifier lines, with a comment such as 1:N:0:ATCACG that gives the mate, no filter flag and control bits, and the barcode")
+	flags.BoolVar(&opts.emitBCTag, "emit-bc-tag", false, "append the barcode as a BC:Z:barcode comment, which bwa mem -C copies into its records as a SAM tag")
+	flags.StringVar(&opts.noBarcode, "no-barcode", "error", "with -emit-bc-tag, what to do with records without a barcode: `error`, or omit to leave the tag out")
+	flags.StringVar(&opts.umiFrom, "umi-from", "", "take the UMI of each record from the eighth colon-separated field of the `identifier`, or from the last word of the comment, and check that it is a sequence of ACGTN")
+	flags.BoolVar(&opts.removeUMI, "remove-umi", false, "with -umi-from identifier, remove the UMI field from the corrected identifier")
+	flags.BoolVar(&opts.emitRXTag, "emit-rx-tag", false, "with -umi-from, append the UMI as an RX:Z:umi comment, which bwa mem -C copies into its records as a SAM tag")
+	flags.BoolVar(&opts.tabComment, "tab-comment", false, "separate the comments that -emit-bc-tag, -emit-rx-tag, -casava18, and -keep-original-as-comment add with a tab instead of a space")
+	flags.Func("barcode", "with -casava18 or -emit-bc-tag, the barcode `sequence` to put in the comments, instead of the index that Illumina 1.4 to 1.7 identifiers such as ...:2000#ATCACG end with, if any", func(s string) error {
+		if strings.ContainsAny(s, " \t") {
+			return errors.New("a barcode cannot contain white space")
+		}
+		opts.barcode = s
+		return nil
+	})
+	flags.Func("suffix", "append this `string` to each corrected identifier, such as _corrected, before any mate suffix that -strip-comment keeps", func(s string) error {
+		if strings.ContainsAny(s, " \t") {
+			return errors.New("an identifier cannot contain white space")
+		}
+		opts.suffix = s
+		return nil
+	})
+	flags.BoolVar(&opts.multiline, "multiline", false, "accept records whose sequence and qualities are wrapped over several lines, which are written unwrapped")
+	flags.BoolVar(&opts.allowEmpty, "allow-empty", false, "do not fail on inputs that hold no records; without it, the outputs of empty inputs are still written, but the exit status is 3")
+	flags.BoolVar(&opts.strict, "strict", false, "fail on invalid records instead of warning about them")
+	flags.StringVar(&opts.outputFormat, "output-format", "fastq", "output `format`: fastq, or sam or bam for unaligned SAM or BAM records, with the mates of a pair adjacent with -interleave or -interleaved")
+	flags.Func("read-group", "with -output-format sam or bam, a read group header `line` to add, such as '@RG\\tID:foo\\tSM:bar' as for bwa mem -R, whose ID is added to each record", func(s string) (err error) {
+		opts.readGroup, opts.readGroupID, err = parseReadGroup(s)
+		return err
+	})
+	flags.StringVar(&opts.qcOut, "qc-out", "", "also write a sample of the corrected records in fastq format to this `file`, compressed according to its name, such as qc.fastq.gz")
+	flags.Float64Var(&opts.qcSample, "qc-sample", 0.01, "with -qc-out, the `fraction` of records, or pairs in paired modes, to sample")
+	flags.Uint64Var(&opts.qcSeed, "qc-seed", 0, "with -qc-out, the `seed` that decides which records are sampled")
+	flags.StringVar(&opts.checkpoint, "checkpoint", "", "in par mode, periodically record in this `file` how many records are safely written to the output, so that an interrupted run can be resumed")
+	flags.DurationVar(&opts.checkpointInterval, "checkpoint-interval", time.Minute, "time between checkpoints")
+	flags.BoolVar(&opts.resume, "resume", false, "resume the run recorded by -checkpoint, appending to its output")
+	flags.IntVar(&opts.workers, "num-workers", runtime.GOMAXPROCS(0), "number of workers in par mode")
+	flags.IntVar(&opts.chunkSize, "reads-per-chunk", 0, "split each output into numbered chunks of at most this many records, or pairs in paired modes; 0 writes a single file")
+	flags.Func("split-by", "in par mode, write one output per value of the comma-separated identifier `fields`, flowcell and/or lane, named after the output with the values inserted, as in out_C0D8DACXX_L001.fastq.gz", func(s string) (err error) {
+		opts.splitBy, err = parseSplitBy(s)
+		return err
+	})
+	flags.IntVar(&opts.maxOpenFiles, "max-open-files", 64, "with -split-by, the maximum number of outputs that are open at the same time")
+	flags.IntVar(&opts.batchSize, "batch-size", 0, "maximum number of records per batch in par mode; 0 lets the pipeline decide")
+	flags.StringVar(&opts.compression, "compression", "auto", "output compression: "+strings.Join(compressions, ", ")+"; auto uses the file extension")
+	flags.BoolFunc("bgzf", "write the output as BGZF blocks, as bgzip does; same as -compression bgzf", func(string) error {
+		opts.compression = "bgzf"
+		return nil
+	})
+	flags.IntVar(&opts.compressLevel, "compress-level", 6, "compression level for gzip and BGZF output, from 0 (stored) to 9")
+	flags.BoolVar(&opts.parallelGzip, "parallel-gzip", false, "compress gzip output that is written as a single stream, as in seq mode and par mode with -paired, in blocks with -num-workers goroutines")
+	flags.IntVar(&opts.zstdLevel, "zstd-level", 3, "compression level for zstd output, from 1 to 22")
+	jobsInParallel := flags.Int("jobs", 1, "number of in:out pairs to process at the same time")
+	manifest := flags.String("manifest", "", "read tab-separated in/out pairs from this file")
+	paired := flags.Bool("paired", false, "correct two mate files together, and check that their records pair up")
+	deinterleave := flags.Bool("deinterleave", false, "split an interleaved file into one output per mate, and check that the mates alternate")
+	interleaved := flags.Bool("interleaved", false, "the inputs are interleaved, check that the mates alternate, and keep them interleaved")
+	interleave := flags.Bool("interleave", false, "with -paired, interleave the mates into a single output")
+	recursive := flags.Bool("recursive", false, "correct all fastq files in the tree under the input directory into the output directory")
+	concat := flags.Bool("concat", false, "correct all inputs, in order, into a single output, the last argument")
+	flags.BoolVar(&opts.force, "force", false, "overwrite existing outputs, which are otherwise refused before any input is read")
+	flags.BoolVar(&opts.noAtomic, "no-atomic", false, "write the outputs in place instead of to temporary files that are renamed once complete, for file systems that do not support renaming, at the risk of partial outputs when interrupted")
+	flags.BoolVar(&opts.mkdirs, "mkdirs", false, "create the missing parent directories of the outputs")
+	outdir := flags.String("outdir", "", "write the corrected files into this directory, with the same names as the inputs")
+	failFast := flags.Bool("fail-fast", false, "stop after the first failed in/out pair")
+	execInputs := [2]*string{
+		flags.String("1", "", "in exec mode, the `input` to correct into the named pipe that replaces {r1}"),
+		flags.String("2", "", "in exec mode, the mate file of the -1 `input` to correct into the named pipe that replaces {r2}"),
+	}
+	progressFd := flags.Int("progress-fd", -1, "write JSON progress reports to this file descriptor")
+	progressInterval := flags.Duration("progress-interval", 5*time.Second, "time between progress reports")
+	if len(os.Args) < 2 {
+		usageError(flags, "missing mode, expected seq or par")
+	}
+	mode := os.Args[1]
+	switch mode {
+	case "seq", "par", "exec":
+	case "-h", "-help", "--help", "help":
+		flags.SetOutput(os.Stdout)
+		flags.Usage()
+		return
+	case "-version", "--version":
+		printVersion()
+		return
+	default:
+		usageError(flags, fmt.Sprintf("unknown mode %q, expected seq, par, or exec", mode))
+	}
+	// the flag package already reported the error with the usage
+	args, err := parseInterspersed(flags, os.Args[2:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	} else if err != nil {
+		os.Exit(2)
+	}
+	if !slices.Contains(compressions, opts.compression) {
+		usageError(flags, fmt.Sprintf("invalid -compression %q", opts.compression))
+	}
+	if opts.workers < 1 {
+		usageError(flags, fmt.Sprintf("invalid -num-workers %d, must be at least 1", opts.workers))
+	}
+	if _, ok := qualityEncodings[opts.qualityEncoding]; !ok && opts.qualityEncoding != "auto" && opts.qualityEncoding != "none" {
+		usageError(flags, fmt.Sprintf("invalid -validate-quality %q, must be phred33, phred64, auto, or none", opts.qualityEncoding))
+	}
+	if _, ok := checksumHashes[opts.checksum]; !ok && opts.checksum != "" {
+		usageError(flags, fmt.Sprintf("invalid -checksum %q, must be md5 or sha256", opts.checksum))
+	}
+	if opts.noComment != "error" && opts.noComment != "keep" {
+		usageError(flags, fmt.Sprintf("invalid -no-comment %q, must be error or keep", opts.noComment))
+	}
+	switch opts.encoding {
+	case "":
+		if opts.dropBQuality {
+			usageError(flags, "-drop-b-quality requires -encoding illumina15")
+		}
+	case "illumina15":
+		illumina15 := qualityConversion{from: "phred64", to: "phred33"}
+		if opts.convertQuality != nil && *opts.convertQuality != illumina15 {
+			usageError(flags, "-encoding illumina15 converts from phred64 to phred33, which conflicts with -convert-quality")
+		}
+		opts.convertQuality = &illumina15
 	default:
-		fmt.Println("correct-platinum-fastq-sequence-identifier [seq|par] in.fastq.gz out.fastq.gz")
+		usageError(flags, fmt.Sprintf("invalid -encoding %q, must be illumina15", opts.encoding))
+	}
+	// the input is validated before it is converted
+	if opts.convertQuality != nil && opts.qualityEncoding == "auto" {
+		opts.qualityEncoding = opts.convertQuality.from
+	}
+	if opts.skipN < 0 {
+		usageError(flags, fmt.Sprintf("invalid -skip-n %d, must not be negative", opts.skipN))
+	}
+	if opts.firstN < 0 {
+		usageError(flags, fmt.Sprintf("invalid -first-n %d, must not be negative", opts.firstN))
+	}
+	if opts.subsample <= 0 || opts.subsample > 1 {
+		usageError(flags, fmt.Sprintf("invalid -subsample %g, must be above 0 and at most 1", opts.subsample))
+	}
+	if opts.minMeanQuality < 0 {
+		usageError(flags, fmt.Sprintf("invalid -filter-min-mean-quality %g, must not be negative", opts.minMeanQuality))
+	}
+	opts.qualityOffset = inputQualityOffset(opts.qualityEncoding, &opts)
+	if !slices.Contains(outputFormats, opts.outputFormat) {
+		usageError(flags, fmt.Sprintf("invalid -output-format %q, must be fastq, sam, or bam", opts.outputFormat))
+	}
+	if opts.readGroup != "" && opts.outputFormat == "fastq" {
+		usageError(flags, "-read-group requires -output-format sam or bam")
+	}
+	if opts.outputFormat == "bam" {
+		if opts.compression != "auto" && opts.compression != "bgzf" {
+			usageError(flags, fmt.Sprintf("-output-format bam is always BGZF compressed, which conflicts with -compression %s", opts.compression))
+		}
+		opts.compression = "bgzf"
+	}
+	rules := 0
+	for _, set := range []bool{opts.stripComment, opts.idRegex != nil, opts.idTemplate != nil, opts.rewrite != nil, opts.nameTemplate != nil} {
+		if set {
+			rules++
+		}
+	}
+	if rules > 1 {
+		usageError(flags, "-strip-comment, -id-regex, -id-template, -rewrite, and -name-template cannot be combined")
+	}
+	if (opts.rewrite != nil) != (opts.replace != "") {
+		usageError(flags, "-rewrite and -replace must be given together")
+	}
+	if opts.rewriteNoMatch != "error" && opts.rewriteNoMatch != "keep" {
+		usageError(flags, fmt.Sprintf("invalid -rewrite-nomatch %q, must be error or keep", opts.rewriteNoMatch))
+	}
+	if opts.casava18 && (opts.stripComment || opts.keepMateSuffix || opts.keepOriginal) {
+		usageError(flags, "-casava18 cannot be combined with -strip-comment, -keep-mate-suffix, or -keep-original-as-comment")
+	}
+	if opts.barcode != "" && !opts.casava18 && !opts.emitBCTag {
+		usageError(flags, "-barcode requires -casava18 or -emit-bc-tag")
+	}
+	if (opts.emitBCTag || opts.emitRXTag) && (opts.casava18 || opts.keepOriginal) {
+		usageError(flags, "-emit-bc-tag and -emit-rx-tag cannot be combined with -casava18 or -keep-original-as-comment, since bwa mem -C expects the comment to be SAM tags")
+	}
+	if (opts.emitBCTag || opts.emitRXTag) && opts.outputFormat != "fastq" {
+		usageError(flags, "-emit-bc-tag and -emit-rx-tag only apply to fastq output")
+	}
+	if opts.umiFrom != "" && opts.umiFrom != "identifier" && opts.umiFrom != "comment" {
+		usageError(flags, fmt.Sprintf("invalid -umi-from %q, must be identifier or comment", opts.umiFrom))
+	}
+	if opts.removeUMI && opts.umiFrom != "identifier" {
+		usageError(flags, "-remove-umi requires -umi-from identifier")
+	}
+	if opts.emitRXTag && opts.umiFrom == "" {
+		usageError(flags, "-emit-rx-tag requires -umi-from")
+	}
+	if opts.noBarcode != "error" && opts.noBarcode != "omit" {
+		usageError(flags, fmt.Sprintf("invalid -no-barcode %q, must be error or omit", opts.noBarcode))
+	}
+	if opts.keepOriginal && opts.stripComment {
+		usageError(flags, "-keep-original-as-comment cannot be combined with -strip-comment, which already keeps the original name")
+	}
+	if opts.minLength < 0 {
+		usageError(flags, fmt.Sprintf("invalid -filter-min-length %d, must not be negative", opts.minLength))
+	}
+	if opts.maxNFraction < 0 || opts.maxNFraction > 1 {
+		usageError(flags, fmt.Sprintf("invalid -filter-max-n-fraction %g, must be between 0 and 1", opts.maxNFraction))
+	}
+	if opts.detectQualityRecords < 1 {
+		usageError(flags, fmt.Sprintf("invalid -detect-quality-records %d, must be positive", opts.detectQualityRecords))
+	}
+	if opts.chunkSize < 0 {
+		usageError(flags, fmt.Sprintf("invalid -reads-per-chunk %d, must not be negative", opts.chunkSize))
+	}
+	if opts.batchSize < 0 {
+		usageError(flags, fmt.Sprintf("invalid -batch-size %d, must not be negative", opts.batchSize))
+	}
+	if opts.compressLevel < 0 || opts.compressLevel > 9 {
+		usageError(flags, fmt.Sprintf("invalid -compress-level %d, must be between 0 and 9", opts.compressLevel))
+	}
+	if opts.zstdLevel < 1 || opts.zstdLevel > 22 {
+		usageError(flags, fmt.Sprintf("invalid -zstd-level %d, must be between 1 and 22", opts.zstdLevel))
+	}
+	if *progressFd >= 0 {
+		file := os.NewFile(uintptr(*progressFd), "progress")
+		if _, err := file.Stat(); err != nil {
+			usageError(flags, fmt.Sprintf("invalid -progress-fd %d: %v", *progressFd, err))
+		}
+		if *progressInterval <= 0 {
+			usageError(flags, "-progress-interval must be positive")
+		}
+		opts.progress = &progressWriter{w: file, interval: *progressInterval}
+	}
+	if *interleave && !*paired {
+		usageError(flags, "-interleave requires -paired")
+	}
+	if len(opts.splitBy) > 0 {
+		if mode != "par" {
+			usageError(flags, "-split-by is only supported in par mode")
+		}
+		if *paired || *interleaved || *deinterleave || opts.chunkSize > 0 {
+			usageError(flags, "-split-by cannot be combined with -paired, -interleaved, -deinterleave, or -reads-per-chunk")
+		}
+		if opts.maxOpenFiles < 1 {
+			usageError(flags, fmt.Sprintf("invalid -max-open-files %d, must be positive", opts.maxOpenFiles))
+		}
+	}
+	if opts.checkpoint != "" {
+		if mode != "par" {
+			usageError(flags, "-checkpoint is only supported in par mode")
+		}
+		if *paired || *interleaved || *deinterleave || opts.chunkSize > 0 || len(opts.splitBy) > 0 || opts.dryRun || opts.writeMD5 || opts.writeMD5Uncompressed {
+			usageError(flags, "-checkpoint cannot be combined with -paired, -interleaved, -deinterleave, -reads-per-chunk, -split-by, -dry-run, or -write-md5")
+		}
+		if opts.checkpointInterval < 0 {
+			usageError(flags, "-checkpoint-interval must not be negative")
+		}
+	} else if opts.resume {
+		usageError(flags, "-resume requires -checkpoint")
+	}
+	if opts.qcOut != "" {
+		if opts.qcSample <= 0 || opts.qcSample > 1 {
+			usageError(flags, fmt.Sprintf("invalid -qc-sample %g, must be above 0 and at most 1", opts.qcSample))
+		}
+		if isStdio(opts.qcOut) {
+			usageError(flags, "-qc-out cannot be standard output")
+		}
+		if opts.checkpoint != "" || len(opts.splitBy) > 0 || opts.dryRun || *recursive || *manifest != "" || *outdir != "" {
+			usageError(flags, "-qc-out cannot be combined with -checkpoint, -split-by, -dry-run, -recursive, -manifest, or -outdir")
+		}
+	}
+	if opts.expectedChecksum != nil && (mode == "exec" || *paired || *concat || *recursive || *manifest != "" || *outdir != "") {
+		usageError(flags, "-expected-checksum expects a single input, and cannot be combined with exec mode, -paired, -concat, -recursive, -manifest, or -outdir")
+	}
+	if mode == "exec" {
+		if *paired || *interleave || *interleaved || *deinterleave || *recursive || *concat || *manifest != "" || *outdir != "" || opts.chunkSize > 0 || opts.dryRun || opts.writeMD5 || opts.writeMD5Uncompressed {
+			usageError(flags, "exec mode cannot be combined with -paired, -interleave, -interleaved, -deinterleave, -recursive, -concat, -manifest, -outdir, -reads-per-chunk, -dry-run, or -write-md5")
+		}
+		infastqs := []string{*execInputs[0]}
+		if infastqs[0] == "" {
+			usageError(flags, "exec mode expects an input with -1")
+		}
+		if *execInputs[1] != "" {
+			infastqs = append(infastqs, *execInputs[1])
+		}
+		if len(args) == 0 {
+			usageError(flags, "exec mode expects a command after --")
+		}
+		for i, placeholder := range execPlaceholders {
+			used := slices.ContainsFunc(args, func(arg string) bool { return strings.Contains(arg, placeholder) })
+			if used != (i < len(infastqs)) {
+				usageError(flags, fmt.Sprintf("-%d requires %s in the command, and %s requires -%d", i+1, placeholder, placeholder, i+1))
+			}
+		}
+		if err := checkOutputs(nil, &opts); err != nil {
+			fatal(err)
+		}
+		status, err := correctExec(infastqs, args, &opts)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "correct-platinum-fastq-sequence-identifier:", err)
+		} else if err := writeStats(&opts); err != nil {
+			fatal(err)
+		}
+		os.Exit(status)
+	} else if *execInputs[0] != "" || *execInputs[1] != "" {
+		usageError(flags, "-1 and -2 are only supported in exec mode")
+	}
+	if *concat {
+		if *paired || *interleaved || *deinterleave || *recursive || *manifest != "" || *outdir != "" || opts.checkpoint != "" || len(opts.splitBy) > 0 {
+			usageError(flags, "-concat cannot be combined with -paired, -interleaved, -deinterleave, -recursive, -manifest, -outdir, -checkpoint, or -split-by")
+		}
+		if len(args) < 2 {
+			usageError(flags, "-concat expects one or more inputs and an output")
+		}
+		if err := checkSameFiles(args[:len(args)-1], args[len(args)-1:], &opts); err != nil {
+			fatal(err)
+		}
+		if err := checkOutputs(args[len(args)-1:], &opts); err != nil {
+			fatal(err)
+		}
+		if err := correctConcatenated(args[:len(args)-1], args[len(args)-1], mode == "par", &opts); err != nil {
+			fatal(err)
+		}
+		if err := writeStats(&opts); err != nil {
+			fatal(err)
+		}
+		exitIfEmpty()
+		return
+	}
+	if opts.firstN%2 != 0 && (*interleaved || *deinterleave) {
+		usageError(flags, fmt.Sprintf("invalid -first-n %d, interleaved inputs need an even number of records", opts.firstN))
+	}
+	if opts.skipN%2 != 0 && (*interleaved || *deinterleave) {
+		usageError(flags, fmt.Sprintf("invalid -skip-n %d, interleaved inputs need an even number of records", opts.skipN))
+	}
+	if *interleaved {
+		if mode != "par" {
+			usageError(flags, "-interleaved is only supported in par mode")
+		}
+		if *paired || *deinterleave {
+			usageError(flags, "-interleaved cannot be combined with -paired or -deinterleave")
+		}
+	}
+	if *deinterleave {
+		if mode != "par" {
+			usageError(flags, "-deinterleave is only supported in par mode")
+		}
+		if *paired || *interleave || *recursive || *manifest != "" || *outdir != "" {
+			usageError(flags, "-deinterleave cannot be combined with -paired, -interleave, -recursive, -manifest, or -outdir")
+		}
+		if len(args) == 1 && opts.dryRun {
+			args = append(args, "-", "-")
+		}
+		if len(args) != 3 {
+			usageError(flags, "-deinterleave expects one input and two outputs")
+		}
+		if isStdio(args[1]) && isStdio(args[2]) && !opts.dryRun {
+			usageError(flags, "-deinterleave cannot write both outputs to standard output")
+		}
+		if err := checkSameFiles(args[:1], args[1:], &opts); err != nil {
+			fatal(err)
+		}
+		if err := checkOutputs(args[1:], &opts); err != nil {
+			fatal(err)
+		}
+		if err := correctInterleavedParallel(args[0], args[1:], &opts); err != nil {
+			fatal(err)
+		}
+		if err := writeStats(&opts); err != nil {
+			fatal(err)
+		}
+		exitIfEmpty()
+		return
+	}
+	if *paired {
+		if *recursive || *manifest != "" || *outdir != "" {
+			usageError(flags, "-paired cannot be combined with -recursive, -manifest, or -outdir")
+		}
+		outputs := 2
+		if *interleave {
+			outputs = 1
+		}
+		if len(args) == 2 && (opts.dryRun || *interleave) {
+			args = append(args, slices.Repeat([]string{"-"}, outputs)...)
+		}
+		if len(args) != 2+outputs {
+			if *interleave {
+				usageError(flags, "-paired -interleave expects two inputs and one output")
+			}
+			usageError(flags, "-paired expects two inputs and two outputs")
+		}
+		if !*interleave && isStdio(args[2]) && isStdio(args[3]) && !opts.dryRun {
+			usageError(flags, "-paired cannot write both outputs to standard output, use -interleave")
+		}
+		correctPaired := correctPairedParallel
+		if mode == "seq" {
+			correctPaired = correctPairedSequential
+		}
+		if err := checkSameFiles(args[:2], args[2:], &opts); err != nil {
+			fatal(err)
+		}
+		if err := checkOutputs(args[2:], &opts); err != nil {
+			fatal(err)
+		}
+		if err := correctPaired(args[0], args[1], args[2:], &opts); err != nil {
+			fatal(err)
+		}
+		if err := writeStats(&opts); err != nil {
+			fatal(err)
+		}
+		exitIfEmpty()
+		return
+	}
+	var jobs []job
+	var archives []string
+	failed := 0
+	if *recursive {
+		if len(args) != 2 || *manifest != "" || *outdir != "" {
+			usageError(flags, "-recursive expects an input and an output directory")
+		}
+		var skipped int
+		jobs, skipped, failed = recursiveJobs(args[0], args[1], &opts)
+		fmt.Fprintf(os.Stderr, "Found %d fastq files, skipped %d other files, failed to read %d paths\n", len(jobs), skipped, failed)
+	} else if *manifest != "" {
+		if len(args) > 0 || *outdir != "" {
+			usageError(flags, "-manifest cannot be combined with files on the command line or -outdir")
+		}
+		var errs []error
+		if jobs, errs, err = readManifest(*manifest); err != nil {
+			fatal(err)
+		}
+		for _, err := range errs {
+			fmt.Fprintln(os.Stderr, "correct-platinum-fastq-sequence-identifier:", err)
+		}
+		if failed = len(errs); failed > 0 && *failFast {
+			os.Exit(1)
+		}
+	} else {
+		if *outdir != "" {
+			// archives are corrected separately, as their members
+			// are read
+			args = slices.DeleteFunc(args, func(arg string) bool {
+				if isArchiveName(arg) {
+					archives = append(archives, arg)
+					return true
+				}
+				return false
+			})
+			if len(args) > 0 || len(archives) == 0 {
+				jobs, err = outdirJobs(args, *outdir)
+			}
+		} else {
+			jobs, err = parseJobs(args)
+		}
+		if err != nil {
+			usageError(flags, err.Error())
+		}
+	}
+	if opts.qcOut != "" && len(jobs) != 1 {
+		usageError(flags, "-qc-out expects a single input and output")
+	}
+	if opts.expectedChecksum != nil && len(jobs) != 1 {
+		usageError(flags, "-expected-checksum expects a single input")
+	}
+	if opts.checkpoint != "" {
+		if len(jobs) != 1 || len(archives) > 0 {
+			usageError(flags, "-checkpoint expects a single input and output")
+		}
+		out := jobs[0].out
+		if isStdio(out) || isURL(out) {
+			usageError(flags, "-checkpoint requires the output to be a local file")
+		}
+		// the batches must be independently decodable, so that a
+		// resumed run can append to them
+		if compression := outputCompression(out, &opts); compression != "gzip" && compression != "bgzf" && compression != "none" {
+			usageError(flags, fmt.Sprintf("-checkpoint requires gzip, BGZF, or uncompressed output, not %s", compression))
+		}
+	}
+	infastqs, outfastqs := make([]string, len(jobs)), make([]string, len(jobs))
+	for i, j := range jobs {
+		infastqs[i], outfastqs[i] = j.in, j.out
+	}
+	if err := checkSameFiles(infastqs, outfastqs, &opts); err != nil {
+		fatal(err)
+	}
+	if err := checkOutputs(outfastqs, &opts); err != nil {
+		fatal(err)
+	}
+	correct := correctPlatinumFastqSequenceIdentifierParallel
+	if mode == "seq" {
+		correct = correctPlatinumFastqSequenceIdentifierSequential
+	}
+	if *interleaved {
+		correct = func(infastq, outfastq string, opts *options) error {
+			return correctInterleavedParallel(infastq, []string{outfastq}, opts)
+		}
+	}
+	for _, archive := range archives {
+		if failed += correctArchive(archive, *outdir, *failFast, correct, &opts); failed > 0 && *failFast {
+			os.Exit(1)
+		}
+	}
+	if failed += runJobs(jobs, *jobsInParallel, *failFast, correct, &opts); failed > 0 {
+		os.Exit(1)
+	}
+	if err := writeStats(&opts); err != nil {
+		fatal(err)
 	}
+	exitIfEmpty()
 }
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestMain runs the program instead of the tests if
+// runProgram asks for it.
+func TestMain(m *testing.M) {
+	if os.Getenv("CORRECT_PLATINUM_RUN_PROGRAM") != "" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// runProgram runs the program with the given arguments, and returns
+// its exit status and what it printed to standard error.
+func runProgram(t *testing.T, args ...string) (int, string) {
+	t.Helper()
+	return runProgramInput(t, nil, args...)
+}
+
+// runProgramInput is runProgram with the given standard input.
+func runProgramInput(t *testing.T, stdin []byte, args ...string) (int, string) {
+	t.Helper()
+	status, _, stderr := runProgramOutput(t, stdin, args...)
+	return status, stderr
+}
+
+// runProgramOutput is runProgramInput, but also returns what the
+// program wrote to standard output.
+func runProgramOutput(t *testing.T, stdin []byte, args ...string) (int, []byte, string) {
+	t.Helper()
+	cmd := programCommand(args...)
+	cmd.Stdin = bytes.NewReader(stdin)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		return 0, stdout.Bytes(), stderr.String()
+	case errors.As(err, &exitErr):
+		return exitErr.ExitCode(), stdout.Bytes(), stderr.String()
+	}
+	t.Fatal(err)
+	return 0, nil, ""
+}
+
+// programCommand returns a command that runs the program with the
+// given arguments, for tests that need to control it while it runs.
+func programCommand(args ...string) *exec.Cmd {
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), "CORRECT_PLATINUM_RUN_PROGRAM=1")
+	return cmd
+}
+
+// readDecompressed returns the content of a file, decompressed like
+// an input.
+func readDecompressed(t *testing.T, name string) []byte {
+	t.Helper()
+	in, err := openInput(name, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Close()
+	data, err := io.ReadAll(in)
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	return data
+}
+
+// platinumFastq returns n records of the first mate as the Platinum
+// fastq files have them, with the Illumina identifier in the comment,
+// and random bases and qualities.
+func platinumFastq(n int) []byte {
+	return platinumMates(n, '1')
+}
+
+// platinumMates is platinumFastq for either mate, with the same
+// identifiers for both.
+func platinumMates(n int, mate byte) []byte {
+	rnd := rand.New(rand.NewSource(int64(mate)))
+	var buf bytes.Buffer
+	sequence, qualities := make([]byte, 100), make([]byte, 100)
+	for i := 1; i <= n; i++ {
+		for j := range sequence {
+			sequence[j] = "ACGT"[rnd.Intn(4)]
+			qualities[j] = byte('#' + rnd.Intn(40))
+		}
+		fmt.Fprintf(&buf, "@ERR194147.%d HSQ1004:134:C0D8DACXX:1:%d:%d:%d/%c\n%s\n+\n%s\n", i, 1101+i/1000, 1000+i*7%20000, 2000+i*13%200000, mate, sequence, qualities)
+	}
+	return buf.Bytes()
+}
+
+// writeFixture writes data to a file of that name in dir, and returns
+// its path.
+func writeFixture(t *testing.T, dir, name string, data []byte) string {
+	t.Helper()
+	name = filepath.Join(dir, name)
+	if err := os.WriteFile(name, data, 0o666); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func TestCheckOutputs(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing string
+		opts     options
+		refused  bool
+	}{
+		{"output", "out.fastq.gz", options{}, true},
+		{"forced", "out.fastq.gz", options{force: true}, false},
+		{"first chunk", "out_0001.fastq.gz", options{chunkSize: 10}, true},
+		{"md5", "out.fastq.gz.md5", options{writeMD5: true}, true},
+		{"uncompressed md5", "out.fastq.md5", options{writeMD5Uncompressed: true}, true},
+		{"stats", "stats.json", options{stats: "stats.json"}, true},
+		{"other", "other.fastq.gz", options{writeMD5: true, stats: "stats.json"}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			existing := filepath.Join(dir, test.existing)
+			if err := os.WriteFile(existing, []byte("precious"), 0o666); err != nil {
+				t.Fatal(err)
+			}
+			opts := test.opts
+			if opts.stats != "" {
+				opts.stats = filepath.Join(dir, opts.stats)
+			}
+			err := checkOutputs([]string{filepath.Join(dir, "out.fastq.gz")}, &opts)
+			if (err != nil) != test.refused {
+				t.Fatalf("checkOutputs with %s existing: %v", test.existing, err)
+			}
+			if test.refused && opts.stats != "" {
+				if err := writeStats(&opts); err == nil {
+					t.Error("writeStats replaced an existing file")
+				}
+			}
+			if data, err := os.ReadFile(existing); err != nil || string(data) != "precious" {
+				t.Errorf("%s was changed: %q, %v", test.existing, data, err)
+			}
+		})
+	}
+	// an output that links to the input is refused even with -force
+	for _, link := range []string{"symbolic", "hard"} {
+		for _, force := range []bool{false, true} {
+			dir := t.TempDir()
+			in, out := filepath.Join(dir, "in.fastq.gz"), filepath.Join(dir, "out.fastq.gz")
+			if err := os.WriteFile(in, []byte("precious"), 0o666); err != nil {
+				t.Fatal(err)
+			}
+			makeLink, want := os.Symlink, out+" already exists, use -force to overwrite it"
+			if link == "hard" {
+				makeLink = os.Link
+			}
+			if force {
+				want = "input " + in + " and output " + out + " are the same file"
+			}
+			if err := makeLink(in, out); err != nil {
+				t.Fatal(err)
+			}
+			opts := options{force: force}
+			err := checkOutputs([]string{out}, &opts)
+			if err == nil {
+				err = checkSameFiles([]string{in}, []string{out}, &opts)
+			}
+			if err == nil || err.Error() != want {
+				t.Errorf("%s link, force %v: got %v, want %q", link, force, err, want)
+			}
+		}
+	}
+}
+
+// TestCompressLevel checks that gzip and BGZF outputs at the fastest
+// and the best compression level both hold the records in both
+// modes, and differ in size, and that invalid levels are usage
+// errors.
+func TestCompressLevel(t *testing.T) {
+	in := writeFixture(t, t.TempDir(), "in.fastq", platinumFastq(3000))
+	reference := filepath.Join(t.TempDir(), "reference.fastq")
+	if status, stderr := runProgram(t, "seq", in, reference); status != 0 {
+		t.Fatal(stderr)
+	}
+	want, err := os.ReadFile(reference)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, compression := range []string{"gzip", "bgzf"} {
+		for _, mode := range []string{"seq", "par"} {
+			var sizes []int64
+			for _, level := range []string{"1", "9"} {
+				out := filepath.Join(t.TempDir(), "out.fastq.gz")
+				if status, stderr := runProgram(t, mode, "-compression", compression, "-compress-level", level, in, out); status != 0 {
+					t.Fatalf("%s, %s, level %s: %s", compression, mode, level, stderr)
+				}
+				if got := readDecompressed(t, out); !bytes.Equal(got, want) {
+					t.Errorf("%s, %s, level %s: got %d bytes, want %d", compression, mode, level, len(got), len(want))
+				}
+				info, err := os.Stat(out)
+				if err != nil {
+					t.Fatal(err)
+				}
+				sizes = append(sizes, info.Size())
+			}
+			if sizes[0] <= sizes[1] {
+				t.Errorf("%s, %s: %d bytes at level 1, but %d bytes at level 9", compression, mode, sizes[0], sizes[1])
+			}
+		}
+	}
+	for level, message := range map[string]string{
+		"-1":   "invalid -compress-level -1, must be between 0 and 9",
+		"10":   "invalid -compress-level 10, must be between 0 and 9",
+		"fast": `invalid value "fast" for flag -compress-level`,
+	} {
+		status, stderr := runProgram(t, "seq", "-compress-level", level, in, filepath.Join(t.TempDir(), "out.fastq.gz"))
+		if status != 2 || !strings.Contains(stderr, message) {
+			t.Errorf("level %s: exit status %d: %s, want %q", level, status, stderr, message)
+		}
+	}
+}
+
+// TestStdio pipes plain and gzipped inputs through standard input and
+// output in both modes, with the names given as - or left out, and
+// checks that the output is byte-identical to that of files.
+func TestStdio(t *testing.T) {
+	dir := t.TempDir()
+	data := platinumFastq(3000)
+	for _, input := range [][]byte{data, gzipped(t, data)} {
+		in := writeFixture(t, dir, "in.fastq", input)
+		for _, compression := range []string{"none", "gzip"} {
+			for _, mode := range []string{"seq", "par"} {
+				out := filepath.Join(t.TempDir(), "out.fastq")
+				if status, stderr := runProgram(t, mode, "-compression", compression, in, out); status != 0 {
+					t.Fatalf("%s, %s: %s", compression, mode, stderr)
+				}
+				want, err := os.ReadFile(out)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, names := range [][]string{{"-", "-"}, nil} {
+					args := append([]string{mode, "-compression", compression}, names...)
+					status, got, stderr := runProgramOutput(t, input, args...)
+					if status != 0 {
+						t.Fatalf("%v: %s", args, stderr)
+					}
+					if !bytes.Equal(got, want) {
+						t.Errorf("%v: got %d bytes, want the %d bytes of the file", args, len(got), len(want))
+					}
+				}
+			}
+		}
+	}
+}
+
+// TestMkdirs writes outputs, single and in chunks, to directories
+// that do not exist yet, and checks that they are only created with
+// -mkdirs, and that the errors name the output.
+func TestMkdirs(t *testing.T) {
+	dir := t.TempDir()
+	data := platinumFastq(1000)
+	in := writeFixture(t, dir, "in.fastq", data)
+	reference := filepath.Join(dir, "reference.fastq")
+	if status, stderr := runProgram(t, "seq", in, reference); status != 0 {
+		t.Fatal(stderr)
+	}
+	want := readDecompressed(t, reference)
+	blocker := writeFixture(t, dir, "blocker", nil)
+	for _, mode := range []string{"seq", "par"} {
+		root := t.TempDir()
+		out := filepath.Join(root, "sample", "lane1", "out.fastq.gz")
+		status, stderr := runProgram(t, mode, in, out)
+		if want := "correct-platinum-fastq-sequence-identifier: open " + out + ": no such file or directory\n"; status != 1 || !strings.HasSuffix(stderr, want) {
+			t.Errorf("%s, without -mkdirs: exit status %d: %s, want %q", mode, status, stderr, want)
+		}
+		if entries, _ := os.ReadDir(root); len(entries) > 0 {
+			t.Errorf("%s, without -mkdirs: created %s", mode, entries[0].Name())
+		}
+
+		if status, stderr := runProgram(t, mode, "-mkdirs", in, out); status != 0 {
+			t.Fatalf("%s: %s", mode, stderr)
+		}
+		if got := readDecompressed(t, out); !bytes.Equal(got, want) {
+			t.Errorf("%s: %s is not corrected", mode, out)
+		}
+		chunked := filepath.Join(root, "chunks", "out.fastq.gz")
+		if status, stderr := runProgram(t, mode, "-mkdirs", "-reads-per-chunk", "600", in, chunked); status != 0 {
+			t.Fatalf("%s, chunks: %s", mode, stderr)
+		}
+		var got []byte
+		for i := 1; i <= 2; i++ {
+			got = append(got, readDecompressed(t, chunkName(chunked, i))...)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s: the chunks in %s are not corrected", mode, filepath.Dir(chunked))
+		}
+
+		failed := filepath.Join(blocker, "lane1", "out.fastq.gz")
+		status, stderr = runProgram(t, mode, "-mkdirs", in, failed)
+		if want := "correct-platinum-fastq-sequence-identifier: " + failed + ": mkdir " + blocker + ": not a directory\n"; status != 1 || !strings.HasSuffix(stderr, want) {
+			t.Errorf("%s, file in the way: exit status %d: %s, want %q", mode, status, stderr, want)
+		}
+	}
+}
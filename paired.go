@@ -0,0 +1,550 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/exascience/correct-platinum-fastq-sequence-identifier/fastq"
+	"github.com/exascience/pargo/pipeline"
+)
+
+// a mateSource is a pipeline source whose batches are mateBatch
+// values.
+type mateSource interface {
+	pipeline.Source
+	io.Closer
+	// the sources of the underlying inputs
+	inputs() []*source
+}
+
+// a mateBatch holds the first mates of a batch of pairs, and the
+// second mates at the same positions, as their sources read them.
+// Whether the corrected identifiers of the mates match is only
+// checked when the batch is filtered, in the parallel stage of the
+// pipeline.
+type mateBatch struct {
+	mates [2]sourceBatch
+	// the names of the inputs of the mates, which are the same if
+	// they are interleaved
+	names       [2]string
+	interleaved bool
+}
+
+// pairedSource reads the records of two mate files in lockstep,
+// and verifies that the first file holds the /1 mates and the
+// second the /2 mates.
+type pairedSource struct {
+	names   [2]string
+	sources [2]*source
+	data    interface{}
+	err     error
+}
+
+func newPairedSource(name1, name2 string, opts *options) (*pairedSource, error) {
+	s := &pairedSource{names: [2]string{name1, name2}}
+	for i, name := range s.names {
+		src, err := newSource(name, opts)
+		if err != nil {
+			if i > 0 {
+				_ = s.sources[0].Close()
+			}
+			return nil, err
+		}
+		s.sources[i] = src
+	}
+	return s, nil
+}
+
+func (s *pairedSource) inputs() []*source {
+	return s.sources[:]
+}
+
+func (s *pairedSource) Close() error {
+	err1 := s.sources[0].Close()
+	if err2 := s.sources[1].Close(); err1 == nil {
+		err1 = err2
+	}
+	return err1
+}
+
+func (s *pairedSource) Err() error {
+	return s.err
+}
+
+func (s *pairedSource) Prepare(_ context.Context) int {
+	return -1
+}
+
+// mismatch reports a record in one input without a mate in the
+// other input.
+func (s *pairedSource) mismatch(i int, r fastq.Record) error {
+	other := s.sources[1-i]
+	return fmt.Errorf("record %d: %s in %s has no mate, %s has only %d records", s.sources[i].records, r.Identifier, s.names[i], s.names[1-i], other.records)
+}
+
+func (s *pairedSource) Fetch(n int) (fetched int) {
+	if batchSize := s.sources[0].batchSize; batchSize > 0 && n > batchSize {
+		n = batchSize
+	}
+	b := mateBatch{names: s.names}
+	s.data = nil
+	for fetched = 0; fetched < n; fetched++ {
+		var mates [2]fastq.Record
+		var ok [2]bool
+		for i, src := range s.sources {
+			if mates[i], ok[i] = src.next(); src.err != nil {
+				s.err = fmt.Errorf("%s: %w", s.names[i], src.err)
+				return 0
+			}
+		}
+		if ok[0] != ok[1] {
+			if ok[0] {
+				s.err = s.mismatch(0, mates[0])
+			} else {
+				s.err = s.mismatch(1, mates[1])
+			}
+			return 0
+		}
+		if !ok[0] {
+			break
+		}
+		// the same file given twice has matching identifiers, but
+		// not the expected mate numbers
+		for i, mate := range [2]byte{'1', '2'} {
+			if mateNumber(mates[i].Identifier) != mate {
+				s.err = fmt.Errorf("record %d: expected mate %c in %s, but got %s", s.sources[i].records, mate, s.names[i], mates[i].Identifier)
+				return 0
+			}
+		}
+		for i := range b.mates {
+			if fetched == 0 {
+				b.mates[i].first = s.sources[i].records
+			}
+			b.mates[i].records = append(b.mates[i].records, mates[i])
+		}
+	}
+	for i, src := range s.sources {
+		b.mates[i].offset = src.qualityOffset()
+	}
+	s.data = b
+	return
+}
+
+func (s *pairedSource) Data() interface{} {
+	return s.data
+}
+
+// matesMatch reports whether two records have the same corrected
+// identifier, apart from their mate suffixes, given the records and
+// their corrections.
+func matesMatch(mates, corrected [2]fastq.Record, opts *options) bool {
+	if opts.umiFrom != "" {
+		_, umi1 := splitUMI(mates[0].Identifier, recordIdentifier(mates[0], opts), opts)
+		_, umi2 := splitUMI(mates[1].Identifier, recordIdentifier(mates[1], opts), opts)
+		if umi1 != umi2 {
+			return false
+		}
+	}
+	return corrected[0].PairName() == corrected[1].PairName()
+}
+
+// mismatch reports the pair at position j of the batch, whose mates
+// do not match.
+func (b *mateBatch) mismatch(j int) error {
+	mate1, mate2 := b.mates[0].records[j].Identifier, b.mates[1].records[j].Identifier
+	if b.interleaved {
+		return fmt.Errorf("record %d: mates do not match: %s, but %s", b.mates[1].first+2*j, mate1, mate2)
+	}
+	return fmt.Errorf("record %d: mates do not match: %s in %s, but %s in %s", b.mates[1].first+j, mate1, b.names[0], mate2, b.names[1])
+}
+
+// filter filters the pairs of the batch, and corrects the mates of
+// those that are kept, in the order of filterRecord, and fails if
+// the mates of a pair do not match. A pair is only kept as a whole,
+// and dropped if either mate fails dropRecord. It returns the
+// corrected mates that are kept, and what the filters did to each
+// mate.
+func (b *mateBatch) filter(opts *options) (kept [2][]fastq.Record, counts [2]filterCounts, err error) {
+	for j := range b.mates[0].records {
+		var mates, corrected [2]fastq.Record
+		dropped := false
+		for i := range mates {
+			mates[i] = b.mates[i].records[j]
+			corrected[i] = mates[i]
+			if dropRecord(mates[i].Sequence, mates[i].Qualities, b.mates[i].offset, opts) {
+				dropped = true
+			} else {
+				counts[i].clamped += convertQualities(&corrected[i], opts)
+			}
+			corrected[i] = correctRecord(corrected[i], opts)
+		}
+		if !matesMatch(mates, corrected, opts) {
+			return kept, counts, b.mismatch(j)
+		}
+		if dropped || !subsampled(corrected[0], opts) {
+			counts[0].dropped++
+			counts[1].dropped++
+			continue
+		}
+		for i := range kept {
+			kept[i] = append(kept[i], corrected[i])
+		}
+	}
+	return kept, counts, nil
+}
+
+// interleave merges the records of two mate batches, so that each
+// record of the first is followed by its mate.
+func interleave(mates [2][]fastq.Record) []fastq.Record {
+	records := make([]fastq.Record, 0, len(mates[0])+len(mates[1]))
+	for i := range mates[0] {
+		records = append(records, mates[0][i], mates[1][i])
+	}
+	return records
+}
+
+// interleavedSource reads the records of an interleaved file, and
+// verifies that they strictly alternate between first and second
+// mates.
+type interleavedSource struct {
+	name   string
+	source *source
+	data   interface{}
+	err    error
+}
+
+func newInterleavedSource(name string, opts *options) (*interleavedSource, error) {
+	src, err := newSource(name, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &interleavedSource{name: name, source: src}, nil
+}
+
+func (s *interleavedSource) inputs() []*source {
+	return []*source{s.source}
+}
+
+func (s *interleavedSource) Close() error {
+	return s.source.Close()
+}
+
+func (s *interleavedSource) Err() error {
+	return s.err
+}
+
+func (s *interleavedSource) Prepare(_ context.Context) int {
+	return -1
+}
+
+func (s *interleavedSource) Fetch(n int) (fetched int) {
+	if s.source.batchSize > 0 && n > s.source.batchSize {
+		n = s.source.batchSize
+	}
+	b := mateBatch{names: [2]string{s.name, s.name}, interleaved: true}
+	s.data = nil
+	for fetched = 0; fetched < n; fetched++ {
+		mate1, ok := s.source.next()
+		if !ok {
+			if s.err = s.source.err; s.err != nil {
+				return 0
+			}
+			break
+		}
+		if mateNumber(mate1.Identifier) != '1' {
+			s.err = fmt.Errorf("record %d: expected a first mate, but got %s", s.source.records, mate1.Identifier)
+			return 0
+		}
+		first := s.source.records
+		mate2, ok := s.source.next()
+		if !ok {
+			if s.err = s.source.err; s.err == nil {
+				s.err = fmt.Errorf("record %d: %s has no mate, the input ends", s.source.records, mate1.Identifier)
+			}
+			return 0
+		}
+		if mateNumber(mate2.Identifier) != '2' {
+			s.err = fmt.Errorf("record %d: expected the second mate of %s, but got %s", s.source.records, mate1.Identifier, mate2.Identifier)
+			return 0
+		}
+		if fetched == 0 {
+			b.mates[0].first, b.mates[1].first = first, s.source.records
+		}
+		b.mates[0].records = append(b.mates[0].records, mate1)
+		b.mates[1].records = append(b.mates[1].records, mate2)
+	}
+	b.mates[0].offset = s.source.qualityOffset()
+	b.mates[1].offset = b.mates[0].offset
+	s.data = b
+	return
+}
+
+func (s *interleavedSource) Data() interface{} {
+	return s.data
+}
+
+// correctPairedSequential corrects two mate files together, one
+// pair at a time, and fails if their records do not pair up. With
+// two outputs, each mate file is written to its own output. With a
+// single output, the mates are interleaved into it.
+func correctPairedSequential(infastq1, infastq2 string, outfastqs []string, opts *options) (err error) {
+	start := time.Now()
+	if opts.dryRun {
+		fmt.Fprintln(os.Stderr, "Checking paired platinum fastq sequence identifiers sequentially:", infastq1, "and", infastq2)
+	} else {
+		fmt.Fprintln(os.Stderr, "Correcting paired platinum fastq sequence identifiers sequentially:", infastq1, "and", infastq2, "to", strings.Join(outfastqs, " and "))
+	}
+
+	src, err := newPairedSource(infastq1, infastq2, opts)
+	if err != nil {
+		return err
+	}
+	defer closeOnReturn(src, &err)
+	infastqs := []string{infastq1, infastq2}
+	for i, s := range src.sources {
+		s.progress = startProgress(infastqs[i], s.input, start, opts)
+		defer s.progress.cancel()
+	}
+
+	chunkSize := opts.chunkSize
+	if len(outfastqs) == 1 {
+		chunkSize *= 2
+	}
+	writers := make([]batchWriter, len(outfastqs))
+	for i, outfastq := range outfastqs {
+		if writers[i].chunks, err = newChunkedOutput(outfastq, chunkSize, opts, openOutput); err != nil {
+			return err
+		}
+		defer writers[i].chunks.finish(&err)
+	}
+	qc, err := newQCSample(opts, openOutput)
+	if err != nil {
+		return err
+	}
+	if qc != nil {
+		defer qc.finish(&err)
+	}
+
+	compressors := batchCompressors(writers)
+	var counts [2]filterCounts
+	for src.Fetch(1) > 0 {
+		b := src.Data().(mateBatch)
+		batches, err := correctMateBatch(&b, compressors, qc, &counts, opts)
+		if err != nil {
+			return err
+		}
+		if err := writeMateBatches(batches, writers, qc); err != nil {
+			return err
+		}
+	}
+	if err := src.Err(); err != nil {
+		return err
+	}
+	return finishMates(src, infastqs, start, counts, opts)
+}
+
+// correctPairedParallel corrects two mate files together, and
+// fails if their records do not pair up. With two outputs, each
+// mate file is written to its own output. With a single output,
+// the mates are interleaved into it.
+func correctPairedParallel(infastq1, infastq2 string, outfastqs []string, opts *options) (err error) {
+	start := time.Now()
+	if opts.dryRun {
+		fmt.Fprintln(os.Stderr, "Checking paired platinum fastq sequence identifiers in parallel:", infastq1, "and", infastq2)
+	} else {
+		fmt.Fprintln(os.Stderr, "Correcting paired platinum fastq sequence identifiers in parallel:", infastq1, "and", infastq2, "to", strings.Join(outfastqs, " and "))
+	}
+
+	src, err := newPairedSource(infastq1, infastq2, opts)
+	if err != nil {
+		return err
+	}
+	defer closeOnReturn(src, &err)
+	return correctMates(src, []string{infastq1, infastq2}, outfastqs, start, opts)
+}
+
+// correctInterleavedParallel corrects an interleaved file, and
+// fails if its records do not strictly alternate between mates.
+// With two outputs, the mates are split into separate outputs.
+func correctInterleavedParallel(infastq string, outfastqs []string, opts *options) (err error) {
+	start := time.Now()
+	if opts.dryRun {
+		fmt.Fprintln(os.Stderr, "Checking interleaved platinum fastq sequence identifiers in parallel:", infastq)
+	} else {
+		fmt.Fprintln(os.Stderr, "Correcting interleaved platinum fastq sequence identifiers in parallel:", infastq, "to", strings.Join(outfastqs, " and "))
+	}
+
+	src, err := newInterleavedSource(infastq, opts)
+	if err != nil {
+		return err
+	}
+	defer closeOnReturn(src, &err)
+	return correctMates(src, []string{infastq}, outfastqs, start, opts)
+}
+
+// correctMates corrects the mates from src, which reads from the
+// given inputs, into one output per mate, or into a single
+// interleaved output.
+func correctMates(src mateSource, infastqs, outfastqs []string, start time.Time, opts *options) (err error) {
+	for i, s := range src.inputs() {
+		s.progress = startProgress(infastqs[i], s.input, start, opts)
+		defer s.progress.cancel()
+	}
+
+	// with chunks, each chunk holds the same pairs in all outputs
+	chunkSize := opts.chunkSize
+	if len(outfastqs) == 1 {
+		chunkSize *= 2
+	}
+	writers := make([]batchWriter, len(outfastqs))
+	for i, outfastq := range outfastqs {
+		if writers[i].chunks, err = newChunkedOutput(outfastq, chunkSize, opts, openBatchOutput); err != nil {
+			return err
+		}
+		defer writers[i].chunks.finish(&err)
+	}
+	qc, err := newQCSample(opts, openBatchOutput)
+	if err != nil {
+		return err
+	}
+	if qc != nil {
+		defer qc.finish(&err)
+	}
+
+	compressors := batchCompressors(writers)
+	var counts [2]filterCounts
+	var p pipeline.Pipeline
+	p.Source(src)
+	p.Add(
+		pipeline.LimitedPar(opts.workers, pipeline.Receive(func(_ int, data interface{}) interface{} {
+			b := data.(mateBatch)
+			var batchCounts [2]filterCounts
+			batches, err := correctMateBatch(&b, compressors, qc, &batchCounts, opts)
+			if err != nil {
+				p.SetErr(err)
+				return nil
+			}
+			return mateBatches{batches, batchCounts}
+		})),
+		pipeline.StrictOrd(pipeline.Receive(func(_ int, data interface{}) interface{} {
+			if data == nil {
+				return nil
+			}
+			b := data.(mateBatches)
+			for i := range counts {
+				counts[i].add(b.counts[i])
+			}
+			if err := writeMateBatches(b.batches, writers, qc); err != nil {
+				p.SetErr(err)
+			}
+			return nil
+		})),
+	)
+	p.Run()
+	if err := p.Err(); err != nil {
+		return err
+	}
+	return finishMates(src, infastqs, start, counts, opts)
+}
+
+// the batches of the outputs of mates, with what the filters did to
+// each mate
+type mateBatches struct {
+	batches []batch
+	counts  [2]filterCounts
+}
+
+// batchCompressors returns the batch compressors of writers, so
+// that the parallel stage can format batches without touching the
+// writers, which the ordered stage updates.
+func batchCompressors(writers []batchWriter) []*batchCompressor {
+	compressors := make([]*batchCompressor, len(writers))
+	for i := range writers {
+		compressors[i] = writers[i].chunks.compressor
+	}
+	return compressors
+}
+
+// correctMateBatch filters and corrects a batch of mates, and
+// formats it into a batch for each output, either a single
+// interleaved batch or one batch per mate, compressed with that
+// output's compressor, and samples it into qc, if any, in the first
+// batch. It adds what the filters did to counts.
+func correctMateBatch(b *mateBatch, compressors []*batchCompressor, qc *qcSample, counts *[2]filterCounts, opts *options) ([]batch, error) {
+	mates, filtered, err := b.filter(opts)
+	if err != nil {
+		return nil, err
+	}
+	for i := range counts {
+		counts[i].add(filtered[i])
+	}
+	batches := make([]batch, len(compressors))
+	for i, compressor := range compressors {
+		records := mates[i]
+		if len(compressors) == 1 {
+			records = interleave(mates)
+		}
+		if batches[i], err = formatBatch(records, compressor, opts); err != nil {
+			return nil, err
+		}
+	}
+	if qc != nil {
+		if batches[0].sample, err = qc.sampleMates(batches); err != nil {
+			return nil, err
+		}
+	}
+	return batches, nil
+}
+
+// writeMateBatches writes the batches of correctMateBatch, in order.
+func writeMateBatches(batches []batch, writers []batchWriter, qc *qcSample) error {
+	for i := range writers {
+		if err := writers[i].write(batches[i]); err != nil {
+			return err
+		}
+	}
+	if qc != nil {
+		return qc.write(batches[0].sample)
+	}
+	return nil
+}
+
+// finishMates verifies the inputs of src once all pairs are
+// written, and reports on them, with what the filters did to the
+// mates from each input.
+func finishMates(src mateSource, infastqs []string, start time.Time, counts [2]filterCounts, opts *options) error {
+	inputs := src.inputs()
+	if len(inputs) == 1 {
+		// both mates are from the interleaved input
+		counts[0].add(counts[1])
+	}
+	for _, s := range inputs {
+		if err := s.input.verify(); err != nil {
+			return err
+		}
+	}
+
+	records, dropped := 0, 0
+	for i, s := range inputs {
+		s.progress.finish()
+		records += s.records
+		dropped += counts[i].dropped
+	}
+	printSummary(strings.Join(infastqs, " and "), records, start, opts)
+	for i, s := range inputs {
+		printEmpty(infastqs[i], s.records, opts)
+		printSkipped(infastqs[i], s.records, opts)
+	}
+	printDropped(strings.Join(infastqs, " and "), dropped, opts)
+	for i, s := range inputs {
+		addInputStats(infastqs[i], s.input, s.stats, s.records, counts[i].dropped, opts)
+	}
+	for i := range inputs {
+		printClamped(infastqs[i], counts[i].clamped, opts)
+	}
+	return nil
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/exascience/correct-platinum-fastq-sequence-identifier/fastq"
+)
+
+// testMates returns a batch of n pairs with Illumina identifiers in
+// the comments, starting at record number first.
+func testMates(n, first int, interleaved bool) mateBatch {
+	b := mateBatch{names: [2]string{"in_1.fastq", "in_2.fastq"}, interleaved: interleaved}
+	stride := 1
+	if interleaved {
+		b.names[1] = b.names[0]
+		stride = 2
+	}
+	b.mates[0].first, b.mates[1].first = first, first+stride-1
+	for i := range b.mates {
+		b.mates[i].offset = 33
+		for j := range n {
+			b.mates[i].records = append(b.mates[i].records, fastq.Record{
+				Identifier: fmt.Sprintf("@ERR194147.%d HSQ1004:134:C0D8DACXX:1:1101:%d:2000/%d", j, 1000+j, i+1),
+				Sequence:   "ACGTACGTAC",
+				Qualities:  "IIIIIIIIII",
+			})
+		}
+	}
+	return b
+}
+
+func TestMateBatchFilter(t *testing.T) {
+	tests := []struct {
+		name   string
+		opts   options
+		change func(b *mateBatch)
+		kept   int
+		err    string
+	}{
+		{"kept", options{maxNFraction: 1, subsample: 1}, func(b *mateBatch) {}, 100, ""},
+		{"first mate dropped", options{maxNFraction: 0.5, subsample: 1}, func(b *mateBatch) {
+			b.mates[0].records[3].Sequence = "NNNNNNACGT"
+		}, 99, ""},
+		{"second mate dropped", options{maxNFraction: 1, minLength: 10, subsample: 1}, func(b *mateBatch) {
+			b.mates[1].records[7].Sequence = "ACGT"
+		}, 99, ""},
+		{"subsample", options{maxNFraction: 1, subsample: 0.5, seed: 3}, func(b *mateBatch) {}, -1, ""},
+		{"mismatch", options{maxNFraction: 1, subsample: 1}, func(b *mateBatch) {
+			b.mates[1].records[5].Identifier = "@ERR194147.5 HSQ1004:134:C0D8DACXX:1:1101:9999:2000/2"
+		}, 0, "mates do not match"},
+		{"mismatch of dropped pair", options{maxNFraction: 1, minLength: 10, subsample: 1}, func(b *mateBatch) {
+			b.mates[0].records[5].Sequence = "ACGT"
+			b.mates[1].records[5].Identifier = "@ERR194147.5 HSQ1004:134:C0D8DACXX:1:1101:9999:2000/2"
+		}, 0, "mates do not match"},
+	}
+	for _, test := range tests {
+		for _, interleaved := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s, interleaved %v", test.name, interleaved), func(t *testing.T) {
+				b := testMates(100, 10, interleaved)
+				test.change(&b)
+				kept, counts, err := b.filter(&test.opts)
+				if test.err != "" {
+					if err == nil || !strings.Contains(err.Error(), test.err) {
+						t.Fatalf("got %v, want %q", err, test.err)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(kept[0]) != len(kept[1]) || test.kept >= 0 && len(kept[0]) != test.kept {
+					t.Fatalf("kept %d and %d mates, want %d", len(kept[0]), len(kept[1]), test.kept)
+				}
+				for i := range counts {
+					if counts[i].dropped != 100-len(kept[0]) {
+						t.Errorf("mate %d: %d dropped, want %d", i+1, counts[i].dropped, 100-len(kept[0]))
+					}
+				}
+				for j := range kept[0] {
+					if kept[0][j].PairName() != kept[1][j].PairName() || kept[0][j].Mate != '1' || kept[1][j].Mate != '2' {
+						t.Fatalf("pair %d: %s and %s", j, kept[0][j].Identifier, kept[1][j].Identifier)
+					}
+					if strings.Contains(kept[0][j].Identifier, " ") {
+						t.Fatalf("pair %d: %s is not corrected", j, kept[0][j].Identifier)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestMateBatchMismatchRecord(t *testing.T) {
+	for _, test := range []struct {
+		interleaved bool
+		want        string
+	}{
+		{false, "record 15: mates do not match: @a/1 in in_1.fastq, but @b/2 in in_2.fastq"},
+		{true, "record 21: mates do not match: @a/1, but @b/2"},
+	} {
+		b := testMates(10, 10, test.interleaved)
+		b.mates[0].records[5].Identifier, b.mates[1].records[5].Identifier = "@a/1", "@b/2"
+		if err := b.mismatch(5); err.Error() != test.want {
+			t.Errorf("interleaved %v: %q, want %q", test.interleaved, err, test.want)
+		}
+	}
+}
+
+// TestPairedMismatch runs both modes on mate files whose records do
+// not pair up.
+func TestPairedMismatch(t *testing.T) {
+	dir := t.TempDir()
+	mates1, mates2 := platinumMates(1000, '1'), platinumMates(1000, '2')
+	mate1 := writeFixture(t, dir, "in_1.fastq", mates1)
+	mate2 := writeFixture(t, dir, "in_2.fastq", mates2)
+	short1 := writeFixture(t, dir, "short_1.fastq", mates1[:bytes.Index(mates1, []byte("@ERR194147.500 "))])
+	short2 := writeFixture(t, dir, "short_2.fastq", mates2[:bytes.Index(mates2, []byte("@ERR194147.500 "))])
+	// the 100th mate is on another tile
+	other := writeFixture(t, dir, "other_2.fastq", bytes.Replace(mates2, []byte("@ERR194147.100 HSQ1004:134:C0D8DACXX:1:1101:"), []byte("@ERR194147.100 HSQ1004:134:C0D8DACXX:1:1102:"), 1))
+	tests := []struct {
+		name   string
+		inputs []string
+		err    string
+	}{
+		{"pairs", []string{mate1, mate2}, ""},
+		{"second file shorter", []string{mate1, short2}, "record 500: @ERR194147.500 "},
+		{"second file shorter", []string{mate1, short2}, "/1 in " + mate1 + " has no mate, " + short2 + " has only 499 records"},
+		{"first file shorter", []string{short1, mate2}, "/2 in " + mate2 + " has no mate, " + short1 + " has only 499 records"},
+		{"swapped", []string{mate2, mate1}, "record 1: expected mate 1 in " + mate2},
+		{"same file twice", []string{mate1, mate1}, "record 1: expected mate 2 in " + mate1},
+		{"different pair", []string{mate1, other}, "record 100: mates do not match"},
+	}
+	for _, test := range tests {
+		for _, mode := range []string{"seq", "par"} {
+			out := t.TempDir()
+			args := append([]string{mode, "-paired"}, test.inputs...)
+			status, stderr := runProgram(t, append(args, filepath.Join(out, "out_1.fastq"), filepath.Join(out, "out_2.fastq"))...)
+			if test.err == "" {
+				if status != 0 {
+					t.Errorf("%s, %s: %s", test.name, mode, stderr)
+				}
+				continue
+			}
+			if status == 0 || !strings.Contains(stderr, test.err) {
+				t.Errorf("%s, %s: exit status %d: %s, want %q", test.name, mode, status, stderr, test.err)
+			}
+			if entries, _ := os.ReadDir(out); len(entries) > 0 {
+				t.Errorf("%s, %s: the outputs were left behind", test.name, mode)
+			}
+		}
+	}
+}
+
+// readRecords returns the records of a fastq file with four lines
+// per record. Unlike a scanner, it accepts identifiers without a mate
+// suffix, as they are corrected by default.
+func readRecords(t *testing.T, name string) []fastq.Record {
+	t.Helper()
+	lines := strings.Split(strings.TrimSuffix(string(readDecompressed(t, name)), "\n"), "\n")
+	if len(lines)%4 != 0 {
+		t.Fatalf("%s: %d lines are not a number of records", name, len(lines))
+	}
+	records := make([]fastq.Record, len(lines)/4)
+	for i := range records {
+		records[i] = fastq.Record{Identifier: lines[4*i], Sequence: lines[4*i+1], Qualities: lines[4*i+3]}
+	}
+	return records
+}
+
+// TestInterleave interleaves two mate files whose pairs are spread
+// over several batches, the last one partial, and checks that each
+// first mate is followed by its second mate, both corrected as they
+// are on their own, with the same identifier.
+func TestInterleave(t *testing.T) {
+	dir := t.TempDir()
+	const pairs = 250
+	inputs := []string{
+		writeFixture(t, dir, "in_1.fastq", platinumMates(pairs, '1')),
+		writeFixture(t, dir, "in_2.fastq", platinumMates(pairs, '2')),
+	}
+	var mates [2][]fastq.Record
+	for i, in := range inputs {
+		out := filepath.Join(dir, fmt.Sprintf("reference_%d.fastq", i+1))
+		if status, stderr := runProgram(t, "seq", in, out); status != 0 {
+			t.Fatal(stderr)
+		}
+		mates[i] = readRecords(t, out)
+	}
+	for _, mode := range []string{"seq", "par"} {
+		out := filepath.Join(t.TempDir(), "out.fastq")
+		if status, stderr := runProgram(t, mode, "-paired", "-interleave", "-batch-size", "100", inputs[0], inputs[1], out); status != 0 {
+			t.Fatalf("%s: %s", mode, stderr)
+		}
+		records := readRecords(t, out)
+		if len(records) != 2*pairs {
+			t.Fatalf("%s: got %d records, want %d", mode, len(records), 2*pairs)
+		}
+		for i := range pairs {
+			mate1, mate2 := records[2*i], records[2*i+1]
+			if mate1 != mates[0][i] || mate2 != mates[1][i] {
+				t.Fatalf("%s: pair %d: got %v and %v, want %v and %v", mode, i+1, mate1, mate2, mates[0][i], mates[1][i])
+			}
+			if mate1.Identifier != mate2.Identifier {
+				t.Fatalf("%s: pair %d: %s and %s are not mates", mode, i+1, mate1.Identifier, mate2.Identifier)
+			}
+		}
+	}
+}
+
+// interleavedFastq interleaves the records of two fastq files with
+// four lines per record.
+func interleavedFastq(mates1, mates2 []byte) []byte {
+	var buf bytes.Buffer
+	lines1, lines2 := bytes.SplitAfter(mates1, []byte("\n")), bytes.SplitAfter(mates2, []byte("\n"))
+	for i := 0; i+4 <= len(lines1) && i+4 <= len(lines2); i += 4 {
+		buf.Write(bytes.Join(lines1[i:i+4], nil))
+		buf.Write(bytes.Join(lines2[i:i+4], nil))
+	}
+	return buf.Bytes()
+}
+
+// TestInterleavedSource fetches the pairs of interleaved files in
+// batches, and checks the numbers of their records, or the record
+// that lacks a mate.
+func TestInterleavedSource(t *testing.T) {
+	dir := t.TempDir()
+	const pairs = 250
+	data := interleavedFastq(platinumMates(pairs, '1'), platinumMates(pairs, '2'))
+	lines := bytes.SplitAfter(data, []byte("\n"))
+	without := func(record int) []byte {
+		return bytes.Join(slices.Delete(slices.Clone(lines), 4*(record-1), 4*record), nil)
+	}
+	tests := []struct {
+		name string
+		data []byte
+		err  string
+	}{
+		{"valid", data, ""},
+		{"missing second mate", without(300), "record 300: expected the second mate of @ERR194147.150 HSQ1004:134:C0D8DACXX:1:1101:2050:3950/1, but got @ERR194147.151 HSQ1004:134:C0D8DACXX:1:1101:2057:3963/1"},
+		{"missing first mate", without(299), "record 299: expected a first mate, but got @ERR194147.150 HSQ1004:134:C0D8DACXX:1:1101:2050:3950/2"},
+		{"missing last mate", without(2 * pairs), "record 499: @ERR194147.250 HSQ1004:134:C0D8DACXX:1:1101:2750:5250/1 has no mate, the input ends"},
+	}
+	for _, test := range tests {
+		s, err := newInterleavedSource(writeFixture(t, dir, "in.fastq", test.data), &options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var batches []mateBatch
+		for s.Fetch(100) > 0 {
+			batches = append(batches, s.Data().(mateBatch))
+		}
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if test.err != "" {
+			if err := s.Err(); err == nil || err.Error() != test.err {
+				t.Errorf("%s: got %v, want %q", test.name, err, test.err)
+			}
+			continue
+		}
+		if err := s.Err(); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if len(batches) != 3 {
+			t.Fatalf("%s: got %d batches, want 3", test.name, len(batches))
+		}
+		for i, b := range batches {
+			n := min(100, pairs-100*i)
+			if len(b.mates[0].records) != n || len(b.mates[1].records) != n {
+				t.Errorf("%s: batch %d has %d and %d mates, want %d", test.name, i, len(b.mates[0].records), len(b.mates[1].records), n)
+			}
+			if b.mates[0].first != 200*i+1 || b.mates[1].first != 200*i+2 {
+				t.Errorf("%s: batch %d starts at records %d and %d, want %d and %d", test.name, i, b.mates[0].first, b.mates[1].first, 200*i+1, 200*i+2)
+			}
+			for j := range b.mates[0].records {
+				if mate1, mate2 := b.mates[0].records[j], b.mates[1].records[j]; mate1.PairName() != mate2.PairName() || mateNumber(mate1.Identifier) != '1' || mateNumber(mate2.Identifier) != '2' {
+					t.Fatalf("%s: batch %d, pair %d: %s and %s", test.name, i, j, mate1.Identifier, mate2.Identifier)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// progressWriter writes progress reports as newline-delimited
+// JSON. It is safe for concurrent use by several jobs.
+type progressWriter struct {
+	mutex    sync.Mutex
+	w        io.Writer
+	interval time.Duration
+}
+
+// a single progress report
+type progressReport struct {
+	Input     string `json:"input"`
+	Records   int64  `json:"records"`
+	BytesRead int64  `json:"bytes_read"`
+	// the size of the input, if known
+	BytesTotal int64 `json:"bytes_total,omitempty"`
+	ElapsedMs  int64 `json:"elapsed_ms"`
+	Done       bool  `json:"done,omitempty"`
+}
+
+func (pw *progressWriter) write(report progressReport) {
+	line, _ := json.Marshal(report)
+	line = append(line, '\n')
+	pw.mutex.Lock()
+	defer pw.mutex.Unlock()
+	// progress reports are best effort, and must not fail a job
+	_, _ = pw.w.Write(line)
+}
+
+// progressReporter periodically reports how far the processing
+// of one input has come. A nil progressReporter does nothing.
+type progressReporter struct {
+	w       *progressWriter
+	infastq string
+	input   *input
+	start   time.Time
+	records atomic.Int64
+	once    sync.Once
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// startProgress starts reporting the progress of processing an
+// input, if requested in the options.
+func startProgress(infastq string, in *input, start time.Time, opts *options) *progressReporter {
+	if opts.progress == nil {
+		return nil
+	}
+	r := &progressReporter{
+		w:       opts.progress,
+		infastq: infastq,
+		input:   in,
+		start:   start,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go func() {
+		defer close(r.done)
+		ticker := time.NewTicker(r.w.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				r.w.write(r.report())
+			case <-r.stop:
+				return
+			}
+		}
+	}()
+	return r
+}
+
+func (r *progressReporter) report() progressReport {
+	return progressReport{
+		Input:      r.infastq,
+		Records:    r.records.Load(),
+		BytesRead:  r.input.bytesRead.Load(),
+		BytesTotal: max(r.input.size, 0),
+		ElapsedMs:  time.Since(r.start).Milliseconds(),
+	}
+}
+
+// setRecords updates the number of records processed so far.
+func (r *progressReporter) setRecords(records int) {
+	if r != nil {
+		r.records.Store(int64(records))
+	}
+}
+
+// cancel stops the periodic reports, for example when the
+// processing failed. It can be called more than once.
+func (r *progressReporter) cancel() {
+	if r != nil {
+		r.once.Do(func() { close(r.stop) })
+		<-r.done
+	}
+}
+
+// finish stops the periodic reports, and writes a final one.
+func (r *progressReporter) finish() {
+	if r != nil {
+		r.cancel()
+		report := r.report()
+		report.Done = true
+		r.w.write(report)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/exascience/correct-platinum-fastq-sequence-identifier/fastq"
+)
+
+// a qcSample writes a fraction of the corrected records to a
+// separate output for quality control, in the same pass as the full
+// output, instead of sampling the full output afterwards. Whether a
+// record is sampled only depends on its corrected identifier and the
+// seed, so the sample is the same in both modes and for any number
+// of workers, and keeps the mates of a pair together, since they
+// have the same corrected identifier.
+type qcSample struct {
+	fraction float64
+	seed     uint64
+	w        batchWriter
+}
+
+// newQCSample creates the output for the sample that the options ask
+// for with open, or returns nil if they ask for none. The sample is
+// always written in fastq format, and compressed according to its
+// own name.
+func newQCSample(opts *options, open func(name string, opts *options) (*output, error)) (*qcSample, error) {
+	if opts.qcOut == "" {
+		return nil, nil
+	}
+	qcOpts := *opts
+	qcOpts.outputFormat, qcOpts.compression = "fastq", "auto"
+	qcOpts.readGroup, qcOpts.readGroupID = "", ""
+	// not the named pipes of exec mode
+	qcOpts.create = nil
+	chunks, err := newChunkedOutput(opts.qcOut, 0, &qcOpts, open)
+	if err != nil {
+		return nil, err
+	}
+	return &qcSample{fraction: opts.qcSample, seed: opts.qcSeed, w: batchWriter{chunks: chunks}}, nil
+}
+
+// sampled decides whether a corrected record belongs to the sample.
+func (q *qcSample) sampled(r fastq.Record) bool {
+	return sampledName(r.PairName(), q.seed, q.fraction)
+}
+
+// sampledName decides whether a pair name belongs to a sample of a
+// fraction of the records, by mapping a seeded FNV-1a hash of it to
+// a number between 0 and 1. The mates of a pair have the same pair
+// name, so they are sampled together.
+func sampledName(name string, seed uint64, fraction float64) bool {
+	h := uint64(14695981039346656037) ^ seed
+	for i := 0; i < len(name); i++ {
+		h ^= uint64(name[i])
+		h *= 1099511628211
+	}
+	// FNV-1a mixes the last bytes, such as those of the y
+	// coordinate, poorly into the high bits
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	return float64(h>>11)/(1<<53) < fraction
+}
+
+// subsampled reports whether -subsample keeps a corrected record,
+// which it decides like sampled, from its pair name, so that both
+// modes keep the same records, and keep the mates of a pair
+// together.
+func subsampled(r fastq.Record, opts *options) bool {
+	return opts.subsample >= 1 || sampledName(r.PairName(), opts.seed, opts.subsample)
+}
+
+// sample selects the sampled records of a batch of corrected
+// records, and formats and compresses them into a batch for the
+// sample output, or returns nil if none are sampled.
+func (q *qcSample) sample(records []fastq.Record) (*batch, error) {
+	var sampled []fastq.Record
+	for _, r := range records {
+		if q.sampled(r) {
+			sampled = append(sampled, r)
+		}
+	}
+	if len(sampled) == 0 {
+		return nil, nil
+	}
+	b, err := formatBatch(sampled, q.w.chunks.compressor, q.w.chunks.opts)
+	return &b, err
+}
+
+// sampleMates is sample for the batches of the outputs of mates,
+// either a single interleaved batch or one batch per mate, whose
+// sampled pairs are interleaved.
+func (q *qcSample) sampleMates(batches []batch) (*batch, error) {
+	records := batches[0].records
+	if len(batches) == 2 {
+		records = interleave([2][]fastq.Record{batches[0].records, batches[1].records})
+	}
+	return q.sample(records)
+}
+
+// write writes a batch of sampled records, if any.
+func (q *qcSample) write(b *batch) error {
+	if b == nil {
+		return nil
+	}
+	if err := q.w.write(*b); err != nil {
+		return fmt.Errorf("%s: %w", q.w.chunks.name, err)
+	}
+	return nil
+}
+
+// finish closes the sample output, or aborts it if err holds an
+// error, and reports how many records were sampled. It is meant to
+// be deferred.
+func (q *qcSample) finish(err *error) {
+	if q.w.chunks.finish(err); *err == nil {
+		fmt.Fprintf(os.Stderr, "Sampled %s records into %s\n", groupDigits(int64(q.w.records)), q.w.chunks.name)
+	}
+}
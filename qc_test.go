@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSampledName(t *testing.T) {
+	const n = 100000
+	tests := []struct {
+		fraction float64
+		seed     uint64
+	}{
+		{0, 0},
+		{0.01, 0},
+		{0.1, 1},
+		{0.5, 42},
+		{1, 0},
+	}
+	for _, test := range tests {
+		sampled := 0
+		for i := range n {
+			name := fmt.Sprintf("HSQ1004:134:C0D8DACXX:1:%d:%d:%d", 1101+i/10000, 1000+i%100, 2000+i)
+			s := sampledName(name, test.seed, test.fraction)
+			if s != sampledName(name, test.seed, test.fraction) {
+				t.Fatalf("%s is sampled differently the second time", name)
+			}
+			if s {
+				sampled++
+			}
+		}
+		// within five standard deviations
+		want := test.fraction * n
+		if d := 5 * math.Sqrt(want*(1-test.fraction)); math.Abs(float64(sampled)-want) > d {
+			t.Errorf("fraction %g, seed %d: sampled %d of %d", test.fraction, test.seed, sampled, n)
+		}
+	}
+}
+
+func TestSampledSeeds(t *testing.T) {
+	same := 0
+	for i := range 1000 {
+		name := fmt.Sprintf("HSQ1004:134:C0D8DACXX:1:1101:1000:%d", i)
+		if sampledName(name, 1, 0.5) == sampledName(name, 2, 0.5) {
+			same++
+		}
+	}
+	if same > 600 {
+		t.Errorf("seeds 1 and 2 agree on %d of 1000 records", same)
+	}
+}
+
+// TestQCSample runs both modes with -qc-out, and checks that they
+// sample the same records, which are also in the full output, and
+// that the sampled pairs keep their mates together.
+func TestQCSample(t *testing.T) {
+	dir := t.TempDir()
+	single := writeFixture(t, dir, "in.fastq", platinumFastq(3000))
+	mate1 := writeFixture(t, dir, "in_1.fastq", platinumMates(3000, '1'))
+	mate2 := writeFixture(t, dir, "in_2.fastq", platinumMates(3000, '2'))
+	tests := []struct {
+		name   string
+		args   []string
+		paired bool
+	}{
+		{"single", []string{"-qc-sample", "0.1", single}, false},
+		{"seed", []string{"-qc-sample", "0.1", "-qc-seed", "5", single}, false},
+		{"subsample", []string{"-qc-sample", "0.2", "-subsample", "0.5", single}, false},
+		{"paired", []string{"-paired", "-qc-sample", "0.1", mate1, mate2}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var samples [2][]byte
+			for i, mode := range []string{"seq", "par"} {
+				out := t.TempDir()
+				qc := filepath.Join(out, "qc.fastq")
+				args := []string{mode, "-qc-out", qc}
+				if mode == "par" {
+					args = append(args, "-batch-size", "100")
+				}
+				args = append(append(args, test.args...), filepath.Join(out, "out_1.fastq"))
+				if test.paired {
+					args = append(args, filepath.Join(out, "out_2.fastq"))
+				}
+				if status, stderr := runProgram(t, args...); status != 0 {
+					t.Fatalf("%s: exit status %d: %s", mode, status, stderr)
+				}
+				samples[i], _ = os.ReadFile(qc)
+				full, _ := os.ReadFile(filepath.Join(out, "out_1.fastq"))
+				lines := bytes.SplitAfter(samples[i], []byte("\n"))
+				if len(lines) < 40 {
+					t.Fatalf("%s: only %d lines sampled", mode, len(lines))
+				}
+				if !test.paired {
+					for j := 0; j+4 <= len(lines); j += 4 {
+						if !bytes.Contains(full, bytes.Join(lines[j:j+4], nil)) {
+							t.Fatalf("%s: sampled record %s is not in the output", mode, lines[j])
+						}
+					}
+					continue
+				}
+				// the sampled mates are interleaved
+				for j := 0; j+8 <= len(lines); j += 8 {
+					if !bytes.Equal(lines[j], lines[j+4]) || !bytes.Contains(full, bytes.Join(lines[j:j+4], nil)) {
+						t.Fatalf("%s: sampled mates %s and %s do not pair up", mode, lines[j], lines[j+4])
+					}
+				}
+			}
+			if !bytes.Equal(samples[0], samples[1]) {
+				t.Errorf("par mode sampled %d bytes, seq mode %d", len(samples[1]), len(samples[0]))
+			}
+		})
+	}
+}
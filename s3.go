@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+// s3PartSize is the size of the parts of a multipart upload. S3
+// allows at most 10000 parts, so this limits outputs to about
+// 312 GiB.
+const s3PartSize = 32 << 20
+
+// s3Client returns the S3 client, configured from the standard
+// environment variables, shared configuration files, and instance
+// profile. The configuration is only loaded once an s3:// URL is
+// used.
+var s3Client = sync.OnceValues(func() (*s3.Client, error) {
+	cfg, err := config.LoadDefaultConfig(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return s3.NewFromConfig(cfg, func(o *s3.Options) {
+		// S3-compatible object stores set with AWS_ENDPOINT_URL
+		// usually do not support virtual-hosted-style buckets
+		if o.BaseEndpoint != nil {
+			o.UsePathStyle = true
+		}
+	}), nil
+})
+
+// isS3URL reports whether a name is an s3:// URL.
+func isS3URL(name string) bool {
+	return strings.HasPrefix(name, "s3://")
+}
+
+// s3Object returns the bucket and key of an s3:// URL.
+func s3Object(u *url.URL) (bucket, key string, err error) {
+	bucket, key = u.Host, strings.TrimPrefix(u.Path, "/")
+	if bucket == "" || key == "" {
+		return "", "", fmt.Errorf("invalid S3 URL %q, expected s3://bucket/key", u.Redacted())
+	}
+	return bucket, key, nil
+}
+
+// openS3 starts downloading an S3 object. An interrupted download
+// is resumed with a range request, as long as the object still
+// has the same ETag.
+func openS3(u *url.URL) (*download, error) {
+	bucket, key, err := s3Object(u)
+	if err != nil {
+		return nil, err
+	}
+	client, err := s3Client()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.GetObject(context.Background(), &s3.GetObjectInput{Bucket: &bucket, Key: &key})
+	if err != nil {
+		return nil, err
+	}
+	etag := aws.ToString(resp.ETag)
+	size := int64(-1)
+	if resp.ContentLength != nil {
+		size = *resp.ContentLength
+	}
+	return &download{
+		open: func(offset int64) (io.ReadCloser, error) {
+			resp, err := client.GetObject(context.Background(), &s3.GetObjectInput{
+				Bucket:  &bucket,
+				Key:     &key,
+				Range:   aws.String(fmt.Sprintf("bytes=%d-", offset)),
+				IfMatch: &etag,
+			})
+			if apiErr := smithy.APIError(nil); errors.As(err, &apiErr) && apiErr.ErrorCode() == "PreconditionFailed" {
+				return nil, errResourceChanged
+			} else if err != nil {
+				return nil, err
+			}
+			return resp.Body, nil
+		},
+		resumable: etag != "",
+		body:      resp.Body,
+		size:      size,
+	}, nil
+}
+
+// s3Upload writes an S3 object with a multipart upload, so that
+// only one part at a time needs to be kept in memory. The object
+// only becomes visible once Close completes the upload, and Abort
+// discards the parts uploaded so far.
+type s3Upload struct {
+	client      *s3.Client
+	bucket, key string
+	uploadID    string
+	part        []byte
+	parts       []types.CompletedPart
+	err         error
+}
+
+// createS3 starts a multipart upload to an s3:// URL.
+func createS3(name string) (*s3Upload, error) {
+	u, err := url.Parse(name)
+	if err != nil {
+		return nil, err
+	}
+	bucket, key, err := s3Object(u)
+	if err != nil {
+		return nil, err
+	}
+	client, err := s3Client()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.CreateMultipartUpload(context.Background(), &s3.CreateMultipartUploadInput{
+		Bucket:            &bucket,
+		Key:               &key,
+		ChecksumAlgorithm: types.ChecksumAlgorithmCrc32,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &s3Upload{
+		client:   client,
+		bucket:   bucket,
+		key:      key,
+		uploadID: aws.ToString(resp.UploadId),
+		part:     make([]byte, 0, s3PartSize),
+	}, nil
+}
+
+func (up *s3Upload) Write(p []byte) (n int, err error) {
+	if up.err != nil {
+		return 0, up.err
+	}
+	for len(p) > 0 {
+		k := copy(up.part[len(up.part):cap(up.part)], p)
+		up.part = up.part[:len(up.part)+k]
+		n += k
+		p = p[k:]
+		if len(up.part) == s3PartSize {
+			if up.err = up.uploadPart(); up.err != nil {
+				return n, up.err
+			}
+		}
+	}
+	return n, nil
+}
+
+func (up *s3Upload) uploadPart() error {
+	number := int32(len(up.parts) + 1)
+	resp, err := up.client.UploadPart(context.Background(), &s3.UploadPartInput{
+		Bucket:            &up.bucket,
+		Key:               &up.key,
+		UploadId:          &up.uploadID,
+		PartNumber:        &number,
+		Body:              bytes.NewReader(up.part),
+		ChecksumAlgorithm: types.ChecksumAlgorithmCrc32,
+	})
+	if err != nil {
+		return err
+	}
+	up.parts = append(up.parts, types.CompletedPart{
+		ETag:          resp.ETag,
+		ChecksumCRC32: resp.ChecksumCRC32,
+		PartNumber:    &number,
+	})
+	up.part = up.part[:0]
+	return nil
+}
+
+// Close uploads the last part and completes the upload, or aborts
+// it if that fails.
+func (up *s3Upload) Close() error {
+	if up.err == nil && (len(up.part) > 0 || len(up.parts) == 0) {
+		up.err = up.uploadPart()
+	}
+	if up.err != nil {
+		_ = up.Abort()
+		return up.err
+	}
+	_, up.err = up.client.CompleteMultipartUpload(context.Background(), &s3.CompleteMultipartUploadInput{
+		Bucket:          &up.bucket,
+		Key:             &up.key,
+		UploadId:        &up.uploadID,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: up.parts},
+	})
+	if up.err != nil {
+		_ = up.Abort()
+		return up.err
+	}
+	up.err = errors.New("s3: upload is closed")
+	return nil
+}
+
+// Abort discards the upload.
+func (up *s3Upload) Abort() error {
+	_, err := up.client.AbortMultipartUpload(context.Background(), &s3.AbortMultipartUploadInput{
+		Bucket:   &up.bucket,
+		Key:      &up.key,
+		UploadId: &up.uploadID,
+	})
+	return err
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// mockS3 is an in-process S3 API with path-style buckets, which
+// supports what s3Upload and openS3 use: multipart uploads and
+// getting objects.
+type mockS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	// the parts of the multipart uploads in progress, by upload ID
+	uploads map[string][][]byte
+	// the number of uploads that were aborted
+	aborted int
+	// fail uploading parts, as if access were denied
+	failParts bool
+}
+
+// newMockS3 starts a mockS3, and sets the environment of the
+// program to use it.
+func newMockS3(t *testing.T) *mockS3 {
+	m := &mockS3{objects: make(map[string][]byte), uploads: make(map[string][][]byte)}
+	server := httptest.NewServer(m)
+	t.Cleanup(server.Close)
+	t.Setenv("AWS_ENDPOINT_URL", server.URL)
+	t.Setenv("AWS_REGION", "us-east-1")
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+	t.Setenv("AWS_MAX_ATTEMPTS", "1")
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+	return m
+}
+
+func (m *mockS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key, query := strings.TrimPrefix(r.URL.Path, "/"), r.URL.Query()
+	uploadID := query.Get("uploadId")
+	switch {
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		uploadID = strconv.Itoa(len(m.uploads) + m.aborted + 1)
+		m.uploads[uploadID] = nil
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>", uploadID)
+	case r.Method == http.MethodPut && uploadID != "":
+		number, _ := strconv.Atoi(query.Get("partNumber"))
+		parts, ok := m.uploads[uploadID]
+		if !ok || number != len(parts)+1 {
+			s3Error(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		if m.failParts {
+			s3Error(w, http.StatusForbidden, "AccessDenied")
+			return
+		}
+		body, err := awsChunked(r)
+		if err != nil {
+			s3Error(w, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		m.uploads[uploadID] = append(parts, body)
+		w.Header().Set("ETag", fmt.Sprintf(`"%d"`, number))
+	case r.Method == http.MethodPost && uploadID != "":
+		parts, ok := m.uploads[uploadID]
+		if !ok {
+			s3Error(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		var complete struct {
+			Parts []struct{ PartNumber int } `xml:"Part"`
+		}
+		if err := xml.NewDecoder(r.Body).Decode(&complete); err != nil || len(complete.Parts) != len(parts) {
+			s3Error(w, http.StatusBadRequest, "InvalidPart")
+			return
+		}
+		m.objects[key] = bytes.Join(parts, nil)
+		delete(m.uploads, uploadID)
+		fmt.Fprintf(w, "<CompleteMultipartUploadResult><Key>%s</Key></CompleteMultipartUploadResult>", key)
+	case r.Method == http.MethodDelete && uploadID != "":
+		if _, ok := m.uploads[uploadID]; !ok {
+			s3Error(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		delete(m.uploads, uploadID)
+		m.aborted++
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodGet:
+		object, ok := m.objects[key]
+		if !ok {
+			s3Error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("ETag", `"object"`)
+		w.Header().Set("Content-Length", strconv.Itoa(len(object)))
+		_, _ = w.Write(object)
+	default:
+		s3Error(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+// object returns the object of a key, if there is one, and the
+// number of uploads that were aborted or are still in progress.
+func (m *mockS3) object(key string) (object []byte, ok bool, aborted, uploads int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	object, ok = m.objects[key]
+	return object, ok, m.aborted, len(m.uploads)
+}
+
+func s3Error(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code></Error>", code)
+}
+
+// awsChunked returns the body of a request, decoding the
+// aws-chunked encoding that the SDK uses to send checksums as
+// trailers.
+func awsChunked(r *http.Request) ([]byte, error) {
+	if !strings.Contains(r.Header.Get("Content-Encoding"), "aws-chunked") {
+		return io.ReadAll(r.Body)
+	}
+	var body []byte
+	br := bufio.NewReader(r.Body)
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, _, _ := strings.Cut(strings.TrimSpace(line), ";")
+		n, err := strconv.ParseInt(size, 16, 64)
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			// the trailers follow
+			return body, nil
+		}
+		chunk := make([]byte, n+2)
+		if _, err := io.ReadFull(br, chunk); err != nil {
+			return nil, err
+		}
+		body = append(body, chunk[:n]...)
+	}
+}
+
+// TestS3 writes outputs to and reads inputs from a mocked S3 API,
+// and checks that failed uploads are aborted without leaving an
+// object behind.
+func TestS3(t *testing.T) {
+	m := newMockS3(t)
+	dir := t.TempDir()
+	data := platinumFastq(1000)
+	in := writeFixture(t, dir, "in.fastq", data)
+	reference := filepath.Join(dir, "reference.fastq")
+	if status, stderr := runProgram(t, "seq", in, reference); status != 0 {
+		t.Fatal(stderr)
+	}
+	want, err := os.ReadFile(reference)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.mu.Lock()
+	m.objects["bucket/in.fastq"] = data
+	m.mu.Unlock()
+
+	for _, mode := range []string{"seq", "par"} {
+		for _, input := range []string{in, "s3://bucket/in.fastq"} {
+			out := "s3://bucket/" + mode + "/out.fastq"
+			if status, stderr := runProgram(t, mode, input, out); status != 0 {
+				t.Fatalf("%s, %s: %s", mode, input, stderr)
+			}
+			if got, _, _, _ := m.object(strings.TrimPrefix(out, "s3://")); !bytes.Equal(got, want) {
+				t.Errorf("%s, %s: uploaded %d bytes, want %d", mode, input, len(got), len(want))
+			}
+		}
+	}
+
+	tests := []struct {
+		name      string
+		input     []byte
+		failParts bool
+		err       string
+	}{
+		{"part upload fails", data, true, "AccessDenied"},
+		{"malformed input", append(data[:len(data):len(data)], "@ERR194147.1001 HSQ1004:134:C0D8DACXX:1:2101:1000:2000/1\nACGT\n"...), false, "record 1001: missing intermediate line"},
+	}
+	for _, test := range tests {
+		for _, mode := range []string{"seq", "par"} {
+			m.mu.Lock()
+			m.failParts, m.aborted = test.failParts, 0
+			m.mu.Unlock()
+			in := writeFixture(t, dir, "failed.fastq", test.input)
+			out := "s3://bucket/failed/" + mode + ".fastq"
+			status, stderr := runProgram(t, mode, in, out)
+			if status == 0 || !strings.Contains(stderr, test.err) {
+				t.Errorf("%s, %s: exit status %d: %s, want %q", test.name, mode, status, stderr, test.err)
+			}
+			_, ok, aborted, uploads := m.object(strings.TrimPrefix(out, "s3://"))
+			if ok {
+				t.Errorf("%s, %s: the failed upload left an object", test.name, mode)
+			}
+			if aborted != 1 || uploads != 0 {
+				t.Errorf("%s, %s: %d uploads aborted, %d left in progress, want 1 and 0", test.name, mode, aborted, uploads)
+			}
+		}
+	}
+}
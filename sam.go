@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// outputFormats lists the valid values for the -output-format flag.
+var outputFormats = []string{"fastq", "sam", "bam"}
+
+// parseReadGroup parses a read group header line given the way bwa
+// mem -R takes it, such as @RG\tID:foo\tSM:bar with literal \t for
+// tabs, and returns the line and the read group identifier.
+func parseReadGroup(s string) (line, id string, err error) {
+	line = strings.ReplaceAll(s, `\t`, "\t")
+	if !strings.HasPrefix(line, "@RG\t") {
+		return "", "", fmt.Errorf("invalid read group %q, must start with @RG\\t", s)
+	}
+	if strings.ContainsAny(line, "\r\n") {
+		return "", "", fmt.Errorf("invalid read group %q, must be a single line", s)
+	}
+	for _, field := range strings.Split(line, "\t")[1:] {
+		if id, ok := strings.CutPrefix(field, "ID:"); ok && id != "" {
+			return line, id, nil
+		}
+	}
+	return "", "", fmt.Errorf("invalid read group %q, lacks an ID field", s)
+}
+
+// samHeader returns the header of each SAM output. The records are
+// not sorted, but the mates of a pair are adjacent.
+func samHeader(opts *options) []byte {
+	var b strings.Builder
+	b.WriteString("@HD\tVN:1.6\tSO:unsorted\tGO:query\n")
+	if opts.readGroup != "" {
+		b.WriteString(opts.readGroup)
+		b.WriteByte('\n')
+	}
+	b.WriteString("@PG\tID:" + program + "\tPN:" + program + "\n")
+	return []byte(b.String())
+}
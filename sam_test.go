@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/exascience/correct-platinum-fastq-sequence-identifier/fastq"
+)
+
+// samFields are the patterns of the 11 mandatory fields of SAM
+// alignment lines, as the SAM specification gives them.
+var samFields = [11]*regexp.Regexp{
+	regexp.MustCompile(`^[!-?A-~]{1,254}$`),
+	regexp.MustCompile(`^[0-9]+$`),
+	regexp.MustCompile(`^(\*|[0-9A-Za-z!#$%&+./:;?@^_|~-][0-9A-Za-z!#$%&*+./:;=?@^_|~-]*)$`),
+	regexp.MustCompile(`^[0-9]+$`),
+	regexp.MustCompile(`^[0-9]+$`),
+	regexp.MustCompile(`^(\*|([0-9]+[MIDNSHPX=])+)$`),
+	regexp.MustCompile(`^(\*|=|[0-9A-Za-z!#$%&+./:;?@^_|~-][0-9A-Za-z!#$%&*+./:;=?@^_|~-]*)$`),
+	regexp.MustCompile(`^[0-9]+$`),
+	regexp.MustCompile(`^-?[0-9]+$`),
+	regexp.MustCompile(`^(\*|[A-Za-z=.]+)$`),
+	regexp.MustCompile(`^[!-~]+$`),
+}
+
+// samTag is the pattern of the optional fields.
+var samTag = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9]:[AifZHB]:[ -~]*$`)
+
+// a parsed SAM alignment line
+type samLine struct {
+	qname     string
+	flag      int
+	seq, qual string
+	tags      []string
+}
+
+// parseSAMLine parses an alignment line strictly: it must have the
+// 11 mandatory fields, each as the SAM specification allows it, as
+// unaligned records have them, and well-formed optional fields.
+func parseSAMLine(line string) (samLine, error) {
+	fields := strings.Split(line, "\t")
+	if len(fields) < len(samFields) {
+		return samLine{}, fmt.Errorf("%d fields, want at least %d", len(fields), len(samFields))
+	}
+	for i, pattern := range samFields {
+		if !pattern.MatchString(fields[i]) {
+			return samLine{}, fmt.Errorf("field %d is %q, which does not match %s", i+1, fields[i], pattern)
+		}
+	}
+	for i, want := range map[int]string{2: "*", 3: "0", 4: "0", 5: "*", 6: "*", 7: "0", 8: "0"} {
+		if fields[i] != want {
+			return samLine{}, fmt.Errorf("field %d of an unaligned record is %q, want %q", i+1, fields[i], want)
+		}
+	}
+	for _, tag := range fields[len(samFields):] {
+		if !samTag.MatchString(tag) {
+			return samLine{}, fmt.Errorf("malformed optional field %q", tag)
+		}
+	}
+	flag, err := strconv.Atoi(fields[1])
+	if err != nil || flag > 0xffff {
+		return samLine{}, fmt.Errorf("invalid flag %s", fields[1])
+	}
+	if seq, qual := fields[9], fields[10]; seq != "*" && qual != "*" && len(seq) != len(qual) {
+		return samLine{}, fmt.Errorf("%d bases but %d qualities", len(seq), len(qual))
+	}
+	return samLine{qname: fields[0], flag: flag, seq: fields[9], qual: fields[10], tags: fields[len(samFields):]}, nil
+}
+
+// TestSAMOutput writes paired SAM output in both modes, parses each
+// line strictly, and checks that the mates alternate with their
+// flags, share their QNAME, and have the read group tag.
+func TestSAMOutput(t *testing.T) {
+	const n = 1500
+	dir := t.TempDir()
+	inputs := [2]string{
+		writeFixture(t, dir, "in_1.fastq", platinumMates(n, '1')),
+		writeFixture(t, dir, "in_2.fastq", platinumMates(n, '2')),
+	}
+	var mates [2][]fastq.Record
+	for i, mate := range []byte{'1', '2'} {
+		s := fastq.NewScanner(bytes.NewReader(platinumMates(n, mate)))
+		for s.Scan() {
+			mates[i] = append(mates[i], s.Record())
+		}
+	}
+	for _, mode := range []string{"seq", "par"} {
+		out := filepath.Join(t.TempDir(), "out.sam")
+		if status, stderr := runProgram(t, mode, "-paired", "-interleave", "-output-format", "sam", "-read-group", `@RG\tID:foo\tSM:bar`, inputs[0], inputs[1], out); status != 0 {
+			t.Fatalf("%s: %s", mode, stderr)
+		}
+		data, err := os.ReadFile(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+		header := []string{"@HD\tVN:1.6\tSO:unsorted\tGO:query", "@RG\tID:foo\tSM:bar", "@PG\tID:" + program + "\tPN:" + program}
+		if len(lines) != len(header)+2*n || strings.Join(lines[:len(header)], "\n") != strings.Join(header, "\n") {
+			t.Fatalf("%s: %d lines, starting with %q", mode, len(lines), lines[:min(len(lines), len(header))])
+		}
+		lines = lines[len(header):]
+		for i := 0; i < n; i++ {
+			var pair [2]samLine
+			for j := range pair {
+				if pair[j], err = parseSAMLine(lines[2*i+j]); err != nil {
+					t.Fatalf("%s: line %d: %v", mode, len(header)+2*i+j+1, err)
+				}
+				r := mates[j][i]
+				if pair[j].flag != []int{77, 141}[j] || pair[j].seq != r.Sequence || pair[j].qual != r.Qualities || len(pair[j].tags) != 1 || pair[j].tags[0] != "RG:Z:foo" {
+					t.Fatalf("%s: record %d of mate %d: %+v", mode, i+1, j+1, pair[j])
+				}
+			}
+			want := strings.TrimSuffix(strings.Fields(mates[0][i].Identifier)[1], "/1")
+			if pair[0].qname != want || pair[1].qname != want {
+				t.Fatalf("%s: pair %d has QNAMEs %s and %s, want %s", mode, i+1, pair[0].qname, pair[1].qname, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestLineEndings runs both modes on the fixtures in testdata that
+// have CRLF line endings, on all lines or some of them, and checks
+// that they have the same output as their LF version.
+func TestLineEndings(t *testing.T) {
+	want, err := os.ReadFile(filepath.Join("testdata", "lf.corrected.fastq"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fixture := range []string{"lf.fastq", "crlf.fastq", "mixed_crlf.fastq"} {
+		for _, mode := range []string{"seq", "par"} {
+			out := filepath.Join(t.TempDir(), "out.fastq")
+			if status, stderr := runProgram(t, mode, filepath.Join("testdata", fixture), out); status != 0 {
+				t.Fatalf("%s, %s: %s", fixture, mode, stderr)
+			}
+			if got, err := os.ReadFile(out); err != nil || !bytes.Equal(got, want) {
+				t.Errorf("%s, %s: got %q, %v", fixture, mode, got, err)
+			}
+		}
+	}
+}
+
+// TestMultiline runs both modes with -multiline on the fixtures in
+// testdata whose sequences and qualities are wrapped over several
+// lines, some of which start with @ or + signs, and checks that they
+// have the same output as the unwrapped fixture.
+func TestMultiline(t *testing.T) {
+	want, err := os.ReadFile(filepath.Join("testdata", "lf.corrected.fastq"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		fixture   string
+		multiline bool
+		failed    bool
+	}{
+		{"lf.fastq", true, false},
+		{"wrapped.fastq", true, false},
+		{"wrapped_crlf.fastq", true, false},
+		{"wrapped.fastq", false, true},
+	}
+	for _, test := range tests {
+		for _, mode := range []string{"seq", "par"} {
+			out := filepath.Join(t.TempDir(), "out.fastq")
+			args := []string{mode}
+			if test.multiline {
+				args = append(args, "-multiline")
+			}
+			status, stderr := runProgram(t, append(args, filepath.Join("testdata", test.fixture), out)...)
+			if (status != 0) != test.failed {
+				t.Fatalf("%s, %s, multiline %v: exit status %d: %s", test.fixture, mode, test.multiline, status, stderr)
+			}
+			if test.failed {
+				continue
+			}
+			if got, err := os.ReadFile(out); err != nil || !bytes.Equal(got, want) {
+				t.Errorf("%s, %s: got %q, %v", test.fixture, mode, got, err)
+			}
+		}
+	}
+}
+
+// TestCasava runs both modes on the fixtures in testdata with Casava
+// 1.8 identifier lines, and checks that their records are passed
+// through unchanged, or without the comment with -strip-comment, and
+// that files that mix both kinds of identifier lines are rejected at
+// the first record that differs.
+func TestCasava(t *testing.T) {
+	casava, err := os.ReadFile(filepath.Join("testdata", "casava.fastq"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrected, err := os.ReadFile(filepath.Join("testdata", "lf.corrected.fastq"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		fixture string
+		args    []string
+		want    []byte
+		log     string
+	}{
+		{"lf.fastq", nil, corrected, ""},
+		{"casava.fastq", nil, casava, " has Casava 1.8 identifiers, passing them through unchanged\n"},
+		{"casava.fastq", []string{"-strip-comment"}, corrected, " has Casava 1.8 identifiers, stripping their comments\n"},
+		{"mixed_casava.fastq", nil, nil, "record 3: identifier line with a mate suffix, but the first record has a Casava 1.8 identifier line\n"},
+		{"mixed_suffix.fastq", nil, nil, "record 3: Casava 1.8 identifier line, but the first record has a mate suffix\n"},
+	}
+	for _, test := range tests {
+		for _, mode := range []string{"seq", "par"} {
+			in, out := filepath.Join("testdata", test.fixture), filepath.Join(t.TempDir(), "out.fastq")
+			args := append(append([]string{mode}, test.args...), in, out)
+			status, stderr := runProgram(t, args...)
+			if test.want == nil {
+				if status != 1 || !strings.HasSuffix(stderr, test.log) {
+					t.Errorf("%v: exit status %d: %s, want %q", args, status, stderr, test.log)
+				}
+				continue
+			}
+			if status != 0 {
+				t.Fatalf("%v: %s", args, stderr)
+			}
+			if test.log != "" && !strings.Contains(stderr, in+test.log) {
+				t.Errorf("%v: stderr %q does not contain %q", args, stderr, in+test.log)
+			}
+			if got, err := os.ReadFile(out); err != nil || !bytes.Equal(got, test.want) {
+				t.Errorf("%v: got %q, %v", args, got, err)
+			}
+		}
+	}
+}
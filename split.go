@@ -0,0 +1,387 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/exascience/correct-platinum-fastq-sequence-identifier/fastq"
+	"github.com/exascience/pargo/pipeline"
+)
+
+// a filePool limits how many of its files are open at the same
+// time. A file that has not been written to for the longest time
+// is closed to make room for another one, and reopened for
+// appending when it is written to again. Like the files of
+// createFile, the files are written to temporary files, which are
+// renamed when they are closed, and removed when they are aborted,
+// unless they are written in place with -no-atomic.
+type filePool struct {
+	max     int
+	inPlace bool
+	// the open files, least recently written first
+	open []*pooledFile
+}
+
+type pooledFile struct {
+	pool *filePool
+	name string
+	// the temporary file, or the file itself if it is written in
+	// place, or "" until it is first opened
+	temp string
+	file *os.File
+}
+
+// create creates a file in the pool, which replaces the file with
+// the same name, if any, once it is closed.
+func (p *filePool) create(name string) (*pooledFile, error) {
+	f := &pooledFile{pool: p, name: name}
+	if err := f.reopen(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (p *filePool) remove(f *pooledFile) {
+	if i := slices.Index(p.open, f); i >= 0 {
+		p.open = slices.Delete(p.open, i, i+1)
+	}
+}
+
+func (f *pooledFile) reopen() error {
+	if len(f.pool.open) >= f.pool.max {
+		evicted := f.pool.open[0]
+		f.pool.open = f.pool.open[1:]
+		file := evicted.file
+		evicted.file = nil
+		if err := file.Close(); err != nil {
+			return err
+		}
+	}
+	var file *os.File
+	var err error
+	switch {
+	case f.temp == "" && f.pool.inPlace:
+		file, err = os.Create(f.name)
+	case f.temp == "":
+		file, err = createTemp(f.name)
+	default:
+		file, err = os.OpenFile(f.temp, os.O_WRONLY|os.O_APPEND, 0)
+	}
+	if err != nil {
+		return err
+	}
+	f.file, f.temp = file, file.Name()
+	f.pool.open = append(f.pool.open, f)
+	return nil
+}
+
+func (f *pooledFile) Write(p []byte) (int, error) {
+	if f.file == nil {
+		if err := f.reopen(); err != nil {
+			return 0, err
+		}
+	} else if last := len(f.pool.open) - 1; f.pool.open[last] != f {
+		f.pool.remove(f)
+		f.pool.open = append(f.pool.open, f)
+	}
+	n, err := f.file.Write(p)
+	return n, tempError(err, f.name)
+}
+
+// release closes the file if it is open, without renaming it.
+func (f *pooledFile) release() error {
+	if f.file == nil {
+		return nil
+	}
+	f.pool.remove(f)
+	file := f.file
+	f.file = nil
+	return file.Close()
+}
+
+// Close closes the file, and renames it to its actual name, or
+// removes it if either fails.
+func (f *pooledFile) Close() error {
+	err := f.release()
+	if err == nil && f.temp != f.name {
+		err = os.Rename(f.temp, f.name)
+	}
+	if err != nil {
+		_ = os.Remove(f.temp)
+	}
+	return err
+}
+
+// Abort closes and removes the file.
+func (f *pooledFile) Abort() error {
+	_ = f.release()
+	if err := os.Remove(f.temp); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// splitFields are the fields of corrected identifiers that outputs
+// can be split by, with their positions in identifiers of the form
+// instrument:run:flowcell:lane:tile:x:y.
+var splitFields = map[string]int{"flowcell": 2, "lane": 3}
+
+// parseSplitBy parses a comma-separated list of split fields.
+func parseSplitBy(s string) ([]string, error) {
+	by := strings.Split(s, ",")
+	for i, field := range by {
+		if _, ok := splitFields[field]; !ok {
+			return nil, fmt.Errorf("unknown field %q, expected flowcell or lane", field)
+		}
+		if slices.Contains(by[:i], field) {
+			return nil, fmt.Errorf("field %q is given twice", field)
+		}
+	}
+	return by, nil
+}
+
+// splitKey returns the part of the file name of the output that a
+// record with the given corrected identifier is written to, which
+// joins the values of the fields selected by by with underscores:
+// flowcells as they are, and lanes as L followed by three digits.
+func splitKey(by []string, identifier string) (string, error) {
+	fields := strings.Split(identifier, ":")
+	values := make([]string, len(by))
+	for i, field := range by {
+		position := splitFields[field]
+		if position >= len(fields) {
+			return "", fmt.Errorf("%s has no %s field", identifier, field)
+		}
+		value := fields[position]
+		switch field {
+		case "flowcell":
+			if value == "" {
+				return "", fmt.Errorf("%s has an empty flowcell field", identifier)
+			}
+			// the flowcell becomes part of a file name
+			if strings.ContainsFunc(value, func(r rune) bool {
+				return !('0' <= r && r <= '9' || 'A' <= r && r <= 'Z' || 'a' <= r && r <= 'z' || r == '-')
+			}) {
+				return "", fmt.Errorf("invalid flowcell %q in %s", value, identifier)
+			}
+			values[i] = value
+		case "lane":
+			lane, err := strconv.Atoi(value)
+			if err != nil || lane < 0 {
+				return "", fmt.Errorf("invalid lane %q in %s", value, identifier)
+			}
+			values[i] = fmt.Sprintf("L%03d", lane)
+		}
+	}
+	return strings.Join(values, "_"), nil
+}
+
+// splitName derives the name of the output for a split key from the
+// name of the complete output, by inserting the key before the
+// fastq and compression extensions: out.fastq.gz becomes
+// out_L001.fastq.gz, or out_C0D8DACXX_L001.fastq.gz.
+func splitName(name, key string) string {
+	base, ext := splitFastqExtensions(name)
+	return base + "_" + key + ext
+}
+
+// a part of a split output, with a writer that counts its records
+type splitPart struct {
+	name string
+	batchWriter
+}
+
+// splitOutput distributes corrected batches over one output per
+// split key, which are only created once the first record for their
+// key is written.
+type splitOutput struct {
+	name       string
+	by         []string
+	opts       *options
+	compressor *batchCompressor
+	files      filePool
+	parts      map[string]*splitPart
+	// the number of records written to all parts so far
+	records int
+}
+
+// newSplitOutput prepares an output split by the fields selected by
+// opts.splitBy, with at most opts.maxOpenFiles files open at the
+// same time.
+func newSplitOutput(name string, opts *options) (*splitOutput, error) {
+	if isStdio(name) && !opts.dryRun {
+		return nil, fmt.Errorf("cannot split the output written to standard output")
+	}
+	s := &splitOutput{
+		name:  name,
+		by:    opts.splitBy,
+		opts:  opts,
+		files: filePool{max: opts.maxOpenFiles, inPlace: opts.noAtomic},
+		parts: make(map[string]*splitPart),
+	}
+	if !opts.dryRun {
+		// the parts are created next to name
+		if err := opts.makeParents(name); err != nil {
+			return nil, err
+		}
+		s.compressor = newBatchCompressor(name, opts)
+	}
+	return s, nil
+}
+
+// open creates the output for a part, with a pooled file unless it
+// is an S3 upload, which does not keep a file open.
+func (s *splitOutput) open(name string, opts *options) (*output, error) {
+	if opts.dryRun || isURL(name) {
+		return openBatchOutput(name, opts)
+	}
+	if err := opts.checkOverwrite(name); err != nil {
+		return nil, err
+	}
+	file, err := s.files.create(name)
+	if err != nil {
+		return nil, err
+	}
+	return newBatchOutput(file, []io.Closer{file}, name, opts)
+}
+
+// a batch of records that all have the same split key
+type splitBatch struct {
+	key string
+	batch
+}
+
+// splitBatch filters the records that a source read for a batch,
+// groups those that are kept by split key, preserving their order,
+// and corrects and possibly compresses each group. It is safe to
+// call concurrently.
+func (s *splitOutput) splitBatch(in sourceBatch) ([]splitBatch, filterCounts, error) {
+	var keys []string
+	var counts filterCounts
+	groups := make(map[string][]fastq.Record)
+	for i, r := range in.records {
+		id := recordIdentifier(r, s.opts)
+		r, kept, clamped := filterRecord(r, in.offset, s.opts)
+		counts.clamped += clamped
+		if !kept {
+			counts.dropped++
+			continue
+		}
+		key, err := splitKey(s.by, id)
+		if err != nil {
+			return nil, counts, fmt.Errorf("record %d: %w", in.first+i, err)
+		}
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], r)
+	}
+	batches := make([]splitBatch, len(keys))
+	for i, key := range keys {
+		b, err := formatBatch(groups[key], s.compressor, s.opts)
+		if err != nil {
+			return nil, counts, err
+		}
+		batches[i] = splitBatch{key, b}
+	}
+	return batches, counts, nil
+}
+
+// write writes the groups of a batch to the outputs for their keys.
+func (s *splitOutput) write(batches []splitBatch) error {
+	for _, b := range batches {
+		s.records += len(b.records)
+		part, ok := s.parts[b.key]
+		if !ok {
+			name := splitName(s.name, b.key)
+			chunks, err := newChunkedOutput(name, 0, s.opts, s.open)
+			if err != nil {
+				return err
+			}
+			part = &splitPart{name: name, batchWriter: batchWriter{chunks: chunks}}
+			s.parts[b.key] = part
+		}
+		if err := part.write(b.batch); err != nil {
+			return fmt.Errorf("%s: %w", part.name, err)
+		}
+	}
+	return nil
+}
+
+// correctSplit is the part of correctPlatinumFastqSequenceIdentifierParallel
+// that corrects the records from src into an output split by
+// opts.splitBy.
+func correctSplit(src *source, infastq, outfastq string, start time.Time, opts *options) (err error) {
+	s, err := newSplitOutput(outfastq, opts)
+	if err != nil {
+		return err
+	}
+	defer s.finish(&err)
+
+	var counts filterCounts
+	var p pipeline.Pipeline
+	p.Source(src)
+	p.Add(
+		pipeline.LimitedPar(opts.workers, pipeline.Receive(func(_ int, data interface{}) interface{} {
+			batches, counts, err := s.splitBatch(data.(sourceBatch))
+			if err != nil {
+				p.SetErr(err)
+				return nil
+			}
+			return splitBatches{batches, counts}
+		})),
+		pipeline.StrictOrd(pipeline.Receive(func(_ int, data interface{}) interface{} {
+			if data == nil {
+				return nil
+			}
+			b := data.(splitBatches)
+			counts.add(b.counts)
+			if err := s.write(b.batches); err != nil {
+				p.SetErr(err)
+			}
+			return nil
+		})),
+	)
+	p.Run()
+	if err := p.Err(); err != nil {
+		return err
+	}
+	return src.finish(start, counts)
+}
+
+// the groups of a batch, with what the filters did to its records
+type splitBatches struct {
+	batches []splitBatch
+	counts  filterCounts
+}
+
+// finish closes all outputs, or aborts them if err holds an error,
+// and then reports the number of records written to each of them.
+// It is meant to be deferred.
+func (s *splitOutput) finish(err *error) {
+	keys := make([]string, 0, len(s.parts))
+	for key := range s.parts {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		s.parts[key].chunks.finish(err)
+	}
+	if *err != nil {
+		return
+	}
+	for _, key := range keys {
+		part := s.parts[key]
+		if s.opts.dryRun {
+			fmt.Fprintf(os.Stderr, "  %s: %s records\n", key, groupDigits(int64(part.records)))
+		} else {
+			fmt.Fprintf(os.Stderr, "  %s: %s records to %s\n", key, groupDigits(int64(part.records)), part.name)
+		}
+	}
+}
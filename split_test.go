@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestFilePool writes to more files than the pool may keep open, in
+// turns, and checks that the pool stays within its limit and that
+// each file is complete once it is closed.
+func TestFilePool(t *testing.T) {
+	dir := t.TempDir()
+	pool := filePool{max: 2}
+	files := make([]*pooledFile, 4)
+	for i := range files {
+		f, err := pool.create(filepath.Join(dir, fmt.Sprintf("part%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[i] = f
+	}
+	for round := range 3 {
+		for i, f := range files {
+			if _, err := fmt.Fprintf(f, "%d.%d\n", i, round); err != nil {
+				t.Fatal(err)
+			}
+			if len(pool.open) > pool.max {
+				t.Fatalf("%d files are open, want at most %d", len(pool.open), pool.max)
+			}
+		}
+	}
+	for i, f := range files {
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+		got, err := os.ReadFile(f.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := fmt.Sprintf("%d.0\n%[1]d.1\n%[1]d.2\n", i); string(got) != want {
+			t.Errorf("%s: got %q, want %q", f.name, got, want)
+		}
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != len(files) {
+		t.Errorf("got %d files, want %d without temporary files", len(entries), len(files))
+	}
+}
+
+// TestSplitByLane splits records from three lanes, which alternate
+// within each batch, with fewer open files allowed than there are
+// lanes, and checks the output and the summary line of each lane.
+func TestSplitByLane(t *testing.T) {
+	dir := t.TempDir()
+	lines := bytes.SplitAfter(platinumFastq(300), []byte("\n"))
+	for i := 0; i < len(lines); i += 4 {
+		lane := fmt.Sprintf(":C0D8DACXX:%d:", i/4%3+1)
+		lines[i] = bytes.Replace(lines[i], []byte(":C0D8DACXX:1:"), []byte(lane), 1)
+	}
+	in := writeFixture(t, dir, "in.fastq", bytes.Join(lines, nil))
+	reference := filepath.Join(dir, "reference.fastq")
+	if status, stderr := runProgram(t, "seq", in, reference); status != 0 {
+		t.Fatal(stderr)
+	}
+	want := make(map[string][]byte)
+	lines = bytes.SplitAfter(readDecompressed(t, reference), []byte("\n"))
+	for i := 0; i+4 <= len(lines); i += 4 {
+		lane := "L00" + strings.Split(string(lines[i]), ":")[3]
+		for _, line := range lines[i : i+4] {
+			want[lane] = append(want[lane], line...)
+		}
+	}
+	for _, name := range []string{"out.fastq", "out.fastq.gz"} {
+		for _, maxOpenFiles := range []string{"1", "2", "64"} {
+			outdir := t.TempDir()
+			out := filepath.Join(outdir, name)
+			status, stderr := runProgram(t, "par", "-split-by", "lane", "-max-open-files", maxOpenFiles, "-batch-size", "10", "-num-workers", "4", in, out)
+			if status != 0 {
+				t.Fatalf("%s, -max-open-files %s: %s", name, maxOpenFiles, stderr)
+			}
+			for lane, data := range want {
+				part := splitName(out, lane)
+				if got := readDecompressed(t, part); !bytes.Equal(got, data) {
+					t.Errorf("%s, -max-open-files %s: %s does not have the records of lane %s", name, maxOpenFiles, part, lane)
+				}
+				if summary := fmt.Sprintf("  %s: 100 records to %s\n", lane, part); !strings.Contains(stderr, summary) {
+					t.Errorf("%s, -max-open-files %s: stderr %q does not contain %q", name, maxOpenFiles, stderr, summary)
+				}
+			}
+			if entries, _ := os.ReadDir(outdir); len(entries) != len(want) {
+				t.Errorf("%s, -max-open-files %s: got %d files, want %d", name, maxOpenFiles, len(entries), len(want))
+			}
+		}
+	}
+	status, stderr := runProgram(t, "par", "-split-by", "lane", "-max-open-files", "0", in, filepath.Join(t.TempDir(), "out.fastq"))
+	if want := "invalid -max-open-files 0, must be positive"; status != 2 || !strings.Contains(stderr, want) {
+		t.Errorf("-max-open-files 0: exit status %d: %s, want %q", status, stderr, want)
+	}
+}
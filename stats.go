@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"sync"
+)
+
+// recordStats accumulates the sequence lengths and qualities of the
+// records of an input for -stats.
+type recordStats struct {
+	records                int64
+	minLength, maxLength   int
+	bases                  int64
+	minQuality, maxQuality byte
+	qualities              int64
+}
+
+// newRecordStats returns the statistics of an input, or nil without
+// -stats, in which case nothing is accumulated.
+func newRecordStats(opts *options) *recordStats {
+	if opts.stats == "" {
+		return nil
+	}
+	return &recordStats{minQuality: 255}
+}
+
+// add accumulates the sequence and the qualities of a record, before
+// -convert-quality converts them.
+func (s *recordStats) add(sequence string, qualities []byte) {
+	if s == nil {
+		return
+	}
+	n := len(sequence)
+	if s.records == 0 || n < s.minLength {
+		s.minLength = n
+	}
+	s.maxLength = max(s.maxLength, n)
+	s.records++
+	s.bases += int64(n)
+	for _, q := range qualities {
+		s.minQuality = min(s.minQuality, q)
+		s.maxQuality = max(s.maxQuality, q)
+		s.qualities += int64(q)
+	}
+}
+
+// statsRange is the minimum, maximum, and mean of a statistic.
+type statsRange struct {
+	Min  int     `json:"min"`
+	Max  int     `json:"max"`
+	Mean float64 `json:"mean"`
+}
+
+// inputStats are the statistics of an input in the -stats file. The
+// quality range is in phred scores, without the offset of the
+// encoding.
+type inputStats struct {
+	Name              string     `json:"name"`
+	Records           int        `json:"records"`
+	SkippedRecords    int        `json:"skipped_records,omitempty"`
+	FilteredRecords   int        `json:"filtered_records"`
+	SequenceLength    statsRange `json:"sequence_length"`
+	Quality           statsRange `json:"quality"`
+	Bytes             int64      `json:"bytes"`
+	UncompressedBytes int64      `json:"uncompressed_bytes"`
+	CompressionRatio  float64    `json:"compression_ratio"`
+}
+
+// outputStats are the statistics of an output in the -stats file.
+type outputStats struct {
+	Name              string  `json:"name"`
+	Bytes             int64   `json:"bytes"`
+	UncompressedBytes int64   `json:"uncompressed_bytes"`
+	CompressionRatio  float64 `json:"compression_ratio"`
+}
+
+// runStats collects the statistics of all inputs and outputs of a
+// run, which may be corrected concurrently with -jobs.
+var runStats struct {
+	mu      sync.Mutex
+	Inputs  []inputStats  `json:"inputs"`
+	Outputs []outputStats `json:"outputs"`
+}
+
+// compressionRatio returns how many times smaller the compressed
+// bytes are than the uncompressed ones, or 0 if there are none.
+func compressionRatio(bytes, uncompressed int64) float64 {
+	if bytes == 0 {
+		return 0
+	}
+	return float64(uncompressed) / float64(bytes)
+}
+
+// addInputStats adds the statistics of an input to the -stats file,
+// from the records that were read from it, skipped ones included,
+// and those that were dropped, skipped ones excluded.
+func addInputStats(name string, in *input, s *recordStats, records, dropped int, opts *options) {
+	if s == nil {
+		return
+	}
+	stats := inputStats{
+		Name:              name,
+		Records:           records,
+		SkippedRecords:    skippedRecords(records, opts),
+		FilteredRecords:   dropped,
+		Bytes:             in.bytesRead.Load(),
+		UncompressedBytes: in.uncompressedRead.Load(),
+	}
+	stats.CompressionRatio = compressionRatio(stats.Bytes, stats.UncompressedBytes)
+	if s.records > 0 {
+		offset := int(opts.qualityOffset)
+		stats.SequenceLength = statsRange{s.minLength, s.maxLength, float64(s.bases) / float64(s.records)}
+		if s.bases > 0 {
+			stats.Quality = statsRange{int(s.minQuality) - offset, int(s.maxQuality) - offset, float64(s.qualities)/float64(s.bases) - float64(offset)}
+		}
+	}
+	runStats.mu.Lock()
+	defer runStats.mu.Unlock()
+	runStats.Inputs = append(runStats.Inputs, stats)
+}
+
+// addOutputStats adds the statistics of a complete output to the
+// -stats file.
+func addOutputStats(out *output) {
+	stats := outputStats{Name: out.name, Bytes: out.bytes.Load(), UncompressedBytes: out.uncompressed.Load()}
+	stats.CompressionRatio = compressionRatio(stats.Bytes, stats.UncompressedBytes)
+	runStats.mu.Lock()
+	defer runStats.mu.Unlock()
+	runStats.Outputs = append(runStats.Outputs, stats)
+}
+
+// writeStats writes the -stats file, if any, once all inputs are
+// corrected.
+func writeStats(opts *options) (err error) {
+	if opts.stats == "" {
+		return nil
+	}
+	if err := opts.checkOverwrite(opts.stats); err != nil {
+		return err
+	}
+	file, closers, err := createFile(opts.stats)
+	if err != nil {
+		return err
+	}
+	out := &output{Writer: bufio.NewWriter(file), closers: closers}
+	defer finishOutput(out, &err)
+	runStats.mu.Lock()
+	defer runStats.mu.Unlock()
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(&runStats)
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"github.com/exascience/correct-platinum-fastq-sequence-identifier/fastq"
+)
+
+// validBases marks the IUPAC nucleotide codes in either case, and
+// . and - for gaps.
+var validBases = func() (valid [256]bool) {
+	for _, c := range []byte("ACGTNRYSWKMBDHV") {
+		valid[c] = true
+		valid[c+'a'-'A'] = true
+	}
+	valid['.'] = true
+	valid['-'] = true
+	return
+}()
+
+// invalidBase describes the first character of a sequence that is
+// not a valid base, or returns "" if there is none.
+func invalidBase(sequence string) string {
+	for i := range len(sequence) {
+		if c := sequence[i]; !validBases[c] {
+			return fmt.Sprintf("invalid base %q at position %d of the sequence", rune(c), i+1)
+		}
+	}
+	return ""
+}
+
+// qualityEncodings are the ranges of the quality bytes of each
+// encoding that -validate-quality can check.
+var qualityEncodings = map[string][2]byte{
+	"phred33": {33, 126},
+	"phred64": {64, 126},
+}
+
+// invalidQuality describes the first byte of the qualities of a
+// record that is outside the range of the encoding, or returns ""
+// if there is none, or the encoding is not checked.
+func invalidQuality(qualities []byte, encoding string) string {
+	bounds, ok := qualityEncodings[encoding]
+	if !ok {
+		return ""
+	}
+	for i, q := range qualities {
+		if q < bounds[0] || q > bounds[1] {
+			return fmt.Sprintf("quality byte %d at position %d is outside the %s range %d to %d", q, i+1, encoding, bounds[0], bounds[1])
+		}
+	}
+	return ""
+}
+
+// a qualityCheck validates the qualities of the records of an
+// input. With the "auto" encoding, it detects the encoding from
+// the range of the qualities of the first records, during which it
+// validates them against the phred33 range, which includes the
+// phred64 range.
+type qualityCheck struct {
+	name     string
+	encoding string
+	// the number of records still to scan for detecting the
+	// encoding
+	remaining int
+	// the range of qualities scanned so far
+	min, max byte
+	// whether the encoding was assumed, since the qualities fit both
+	ambiguous bool
+}
+
+func newQualityCheck(name string, opts *options) *qualityCheck {
+	return &qualityCheck{
+		name:      name,
+		encoding:  opts.qualityEncoding,
+		remaining: opts.detectQualityRecords,
+		min:       255,
+	}
+}
+
+// check validates the qualities of a record, and describes the
+// first invalid byte, if any.
+func (c *qualityCheck) check(record int, qualities []byte) string {
+	if c.encoding != "auto" {
+		return invalidQuality(qualities, c.encoding)
+	}
+	for _, q := range qualities {
+		c.min = min(c.min, q)
+		c.max = max(c.max, q)
+	}
+	if c.remaining--; c.remaining <= 0 {
+		c.detect(record)
+	}
+	return invalidQuality(qualities, "phred33")
+}
+
+// detect settles on an encoding once enough records have been
+// scanned, or the input ends. Qualities below 64 only occur in
+// phred33, and qualities above 74, which would be above Q41 in
+// phred33, are typical of phred64. If all qualities are between 64
+// and 74, the encodings cannot be told apart, and phred33 is
+// assumed with a warning.
+func (c *qualityCheck) detect(record int) {
+	if c.encoding != "auto" || c.min > c.max {
+		return
+	}
+	switch {
+	case c.min < 64:
+		c.encoding = "phred33"
+	case c.max > 74:
+		c.encoding = "phred64"
+	default:
+		c.encoding, c.ambiguous = "phred33", true
+		warn(c.name, record, fmt.Sprintf("all qualities so far are between %d and %d, where phred33 and phred64 overlap, assuming phred33", c.min, c.max))
+	}
+}
+
+// bFiltered reports whether all qualities of a record are B, which
+// marks reads that Illumina 1.5 filtered.
+func bFiltered(qualities string) bool {
+	return len(qualities) > 0 && strings.Count(qualities, "B") == len(qualities)
+}
+
+// dropRecord reports whether a record must be dropped, given its
+// sequence, its qualities, and the offset of their encoding: with
+// -drop-b-quality if it is B-quality filtered, with
+// -filter-min-length if it is shorter than the minimum length, with
+// -filter-max-n-fraction if too many of its bases are N, and with
+// -filter-min-mean-quality if its qualities are too low on average.
+func dropRecord(sequence, qualities string, offset byte, opts *options) bool {
+	return opts.dropBQuality && bFiltered(qualities) || len(sequence) < opts.minLength || tooManyN(sequence, opts.maxNFraction) ||
+		opts.minMeanQuality > 0 && meanQuality(qualities, offset) < opts.minMeanQuality
+}
+
+// meanQuality returns the mean Phred quality of a record, given the
+// offset of the quality encoding, or +Inf if it has no qualities.
+func meanQuality(qualities string, offset byte) float64 {
+	if len(qualities) == 0 {
+		return math.Inf(1)
+	}
+	sum := 0
+	for i := range len(qualities) {
+		sum += int(qualities[i]) - int(offset)
+	}
+	return float64(sum) / float64(len(qualities))
+}
+
+// inputQualityOffset returns the offset of the quality encoding of
+// an input: that of the from encoding of -convert-quality, or of
+// the encoding that -validate-quality gives or detects, or 33 for
+// phred33 if neither says.
+func inputQualityOffset(encoding string, opts *options) byte {
+	if opts.convertQuality != nil {
+		encoding = opts.convertQuality.from
+	}
+	if bounds, ok := qualityEncodings[encoding]; ok {
+		return bounds[0]
+	}
+	return qualityEncodings["phred33"][0]
+}
+
+// filterCounts are the numbers of records that the filters dropped,
+// and of the quality bytes that -convert-quality clamped.
+type filterCounts struct {
+	dropped, clamped int
+}
+
+func (c *filterCounts) add(other filterCounts) {
+	c.dropped += other.dropped
+	c.clamped += other.clamped
+}
+
+// filterRecord drops a record with dropRecord, given the offset of
+// the quality encoding of its input, or else converts its qualities
+// with -convert-quality and corrects it, and drops it if -subsample
+// leaves it out. It returns the corrected record, whether it is
+// kept, and the number of quality bytes clamped. Both modes filter
+// each record with it once its identifier is checked, so that they
+// drop the same records, and fail on the same ones.
+func filterRecord(r fastq.Record, offset byte, opts *options) (fastq.Record, bool, int) {
+	if dropRecord(r.Sequence, r.Qualities, offset, opts) {
+		return r, false, 0
+	}
+	clamped := convertQualities(&r, opts)
+	r = correctRecord(r, opts)
+	return r, subsampled(r, opts), clamped
+}
+
+// filterRecords filters the records of a batch with filterRecord,
+// and returns the corrected records that are kept, in place of the
+// records, and what the filters did.
+func filterRecords(records []fastq.Record, offset byte, opts *options) ([]fastq.Record, filterCounts) {
+	var counts filterCounts
+	kept := records[:0]
+	for _, r := range records {
+		r, ok, clamped := filterRecord(r, offset, opts)
+		counts.clamped += clamped
+		if !ok {
+			counts.dropped++
+			continue
+		}
+		kept = append(kept, r)
+	}
+	return kept, counts
+}
+
+// convertQualities converts the qualities of a record with
+// -convert-quality, if given, and returns the number of bytes that
+// were clamped.
+func convertQualities(r *fastq.Record, opts *options) int {
+	if opts.convertQuality == nil {
+		return 0
+	}
+	qualities := []byte(r.Qualities)
+	clamped := opts.convertQuality.convert(qualities)
+	r.Qualities = string(qualities)
+	return clamped
+}
+
+// tooManyN reports whether more than a fraction of the bases of a
+// sequence are N, in either case.
+func tooManyN(sequence string, fraction float64) bool {
+	if fraction >= 1 {
+		return false
+	}
+	n := strings.Count(sequence, "N") + strings.Count(sequence, "n")
+	return float64(n) > fraction*float64(len(sequence))
+}
+
+// a qualityConversion re-encodes qualities from one of the
+// qualityEncodings to another.
+type qualityConversion struct {
+	from, to string
+}
+
+// parseQualityConversion parses a conversion of the form
+// from=phred64,to=phred33.
+func parseQualityConversion(s string) (*qualityConversion, error) {
+	var c qualityConversion
+	for _, field := range strings.Split(s, ",") {
+		key, encoding, _ := strings.Cut(field, "=")
+		if _, ok := qualityEncodings[encoding]; !ok {
+			return nil, fmt.Errorf("invalid encoding %q in %q, must be phred33 or phred64", encoding, field)
+		}
+		switch key {
+		case "from":
+			c.from = encoding
+		case "to":
+			c.to = encoding
+		default:
+			return nil, fmt.Errorf("invalid %q, expected from=encoding,to=encoding", field)
+		}
+	}
+	if c.from == "" || c.to == "" {
+		return nil, fmt.Errorf("%q lacks from or to, expected from=encoding,to=encoding", s)
+	}
+	if c.from == c.to {
+		return nil, fmt.Errorf("%q converts %s to itself", s, c.from)
+	}
+	return &c, nil
+}
+
+// convert re-encodes qualities in place. Bytes that end up outside
+// the range of the target encoding are clamped to it: qualities
+// above Q62, which Phred+64 cannot represent, become Q62, and bytes
+// below the range of the source encoding, which were already
+// reported as invalid, become Q0. It returns the number of bytes
+// that were clamped.
+func (c *qualityConversion) convert(qualities []byte) (clamped int) {
+	from, to := qualityEncodings[c.from], qualityEncodings[c.to]
+	offset := int(to[0]) - int(from[0])
+	for i, q := range qualities {
+		v := int(q) + offset
+		if v < int(to[0]) || v > int(to[1]) {
+			v = min(max(v, int(to[0])), int(to[1]))
+			clamped++
+		}
+		qualities[i] = byte(v)
+	}
+	return clamped
+}
+
+// printClamped reports the number of quality bytes of an input that
+// -convert-quality clamped, if any.
+func printClamped(infastq string, clamped int, opts *options) {
+	if opts.convertQuality != nil && clamped > 0 {
+		fmt.Fprintf(os.Stderr, "Clamped %s quality bytes outside the %s range from %s\n", groupDigits(int64(clamped)), opts.convertQuality.to, infastq)
+	}
+}
+
+// skippedRecords returns how many of the records read from an input
+// were skipped with -skip-n.
+func skippedRecords(records int, opts *options) int {
+	return min(records, opts.skipN)
+}
+
+// printSkipped reports the number of records skipped at the start
+// of an input with -skip-n.
+func printSkipped(infastq string, records int, opts *options) {
+	if skipped := skippedRecords(records, opts); skipped > 0 {
+		fmt.Fprintf(os.Stderr, "Skipped the first %s records of %s\n", groupDigits(int64(skipped)), infastq)
+	}
+}
+
+// printDropped reports the number of records dropped from an
+// input with -drop-b-quality, one of the -filter flags, or
+// -subsample.
+func printDropped(infastq string, dropped int, opts *options) {
+	var what []string
+	if opts.dropBQuality {
+		what = append(what, "B-quality filtered records")
+	}
+	if opts.minLength > 0 {
+		what = append(what, fmt.Sprintf("records shorter than %d bases", opts.minLength))
+	}
+	if opts.maxNFraction < 1 {
+		what = append(what, fmt.Sprintf("records with more than %g%% N bases", 100*opts.maxNFraction))
+	}
+	if opts.minMeanQuality > 0 {
+		what = append(what, fmt.Sprintf("records with a mean quality below %g", opts.minMeanQuality))
+	}
+	if opts.subsample < 1 {
+		what = append(what, fmt.Sprintf("records outside the %g%% subsample", 100*opts.subsample))
+	}
+	if len(what) == 0 {
+		return
+	}
+	list := what[len(what)-1]
+	if len(what) > 1 {
+		list = strings.Join(what[:len(what)-1], ", ") + " and " + list
+	}
+	fmt.Fprintf(os.Stderr, "Dropped %s %s from %s\n", groupDigits(int64(dropped)), list, infastq)
+}
+
+// emptyInputs counts the inputs that held no records, such as those
+// of a transfer that failed before any data, which make the program
+// exit with exitEmpty unless -allow-empty is given.
+var emptyInputs atomic.Int64
+
+// the exit status when the correction succeeded, but an input was
+// empty
+const exitEmpty = 3
+
+// printEmpty warns about an input that held no records, if it did
+// not, and counts it unless -allow-empty is given. Its output is
+// still written, as a valid empty file.
+func printEmpty(infastq string, records int, opts *options) {
+	if records > 0 {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "correct-platinum-fastq-sequence-identifier: warning: %s is empty, it holds no records\n", infastq)
+	if !opts.allowEmpty {
+		emptyInputs.Add(1)
+	}
+}
+
+// exitIfEmpty exits with exitEmpty if any input was empty without
+// -allow-empty.
+func exitIfEmpty() {
+	if emptyInputs.Load() > 0 {
+		os.Exit(exitEmpty)
+	}
+}
+
+// reportInvalid reports a problem with a record found by one of the
+// optional checks, unless it is "": with -strict as an error, and
+// otherwise as a warning.
+func reportInvalid(name string, record int, problem string, opts *options) error {
+	if problem == "" {
+		return nil
+	}
+	if opts.strict {
+		return fmt.Errorf("record %d: %s", record, problem)
+	}
+	warn(name, record, problem)
+	return nil
+}
+
+// warn reports a problem with a record that does not stop the
+// correction of the input.
+func warn(name string, record int, message string) {
+	fmt.Fprintf(os.Stderr, "correct-platinum-fastq-sequence-identifier: warning: %s: record %d: %s\n", name, record, message)
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDropRecord(t *testing.T) {
+	tests := []struct {
+		name                string
+		sequence, qualities string
+		offset              byte
+		opts                options
+		drop                bool
+	}{
+		{"kept", "ACGT", "IIII", 33, options{maxNFraction: 1, minLength: 4, minMeanQuality: 40}, false},
+		{"B-quality", "ACGT", "BBBB", 64, options{maxNFraction: 1, dropBQuality: true}, true},
+		{"partly B", "ACGT", "BBBh", 64, options{maxNFraction: 1, dropBQuality: true}, false},
+		{"short", "ACG", "III", 33, options{maxNFraction: 1, minLength: 4}, true},
+		{"N fraction", "ANNT", "IIII", 33, options{maxNFraction: 0.25}, true},
+		{"lower case n", "AnGT", "IIII", 33, options{maxNFraction: 0.25}, false},
+		{"mean quality", "ACGT", "+++5", 33, options{maxNFraction: 1, minMeanQuality: 13}, true},
+		{"phred64 mean quality", "ACGT", "JJJT", 64, options{maxNFraction: 1, minMeanQuality: 13}, true},
+		{"phred64 read as phred33", "ACGT", "JJJT", 33, options{maxNFraction: 1, minMeanQuality: 13}, false},
+		{"no qualities", "", "", 33, options{maxNFraction: 0, minMeanQuality: 13}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if drop := dropRecord(test.sequence, test.qualities, test.offset, &test.opts); drop != test.drop {
+				t.Errorf("dropRecord(%q, %q, %d) = %v", test.sequence, test.qualities, test.offset, drop)
+			}
+		})
+	}
+}
+
+// filterFastq returns n records of a mate, with 20 N bases in every
+// nth record, and a mean quality of 5 in every seventh record, whose
+// qualities are otherwise between 20 and 40, encoded with the given
+// offset.
+func filterFastq(n int, mate byte, nth int, offset byte) []byte {
+	var buf bytes.Buffer
+	for i := 1; i <= n; i++ {
+		sequence := []byte(strings.Repeat("ACGT", 25))
+		qualities := make([]byte, len(sequence))
+		for j := range qualities {
+			qualities[j] = offset + byte(20+(i+j)%21)
+			if i%7 == 0 {
+				qualities[j] = offset + 5
+			}
+		}
+		if i%nth == 0 {
+			copy(sequence, strings.Repeat("N", 20))
+		}
+		fmt.Fprintf(&buf, "@ERR194147.%d HSQ1004:134:C0D8DACXX:1:1101:%d:%d/%c\n%s\n+\n%s\n", i, 1000+i, 2000+i, mate, sequence, qualities)
+	}
+	return buf.Bytes()
+}
+
+// TestFilterModes runs seq and par mode with the filters and
+// -subsample, and checks that they write the same records, in small
+// batches and chunks in par mode.
+func TestFilterModes(t *testing.T) {
+	dir := t.TempDir()
+	single := writeFixture(t, dir, "single.fastq", filterFastq(1000, '1', 5, 33))
+	phred64 := writeFixture(t, dir, "phred64.fastq", filterFastq(1000, '1', 5, 64))
+	// all qualities are within both the phred33 and phred64 ranges
+	ambiguous := writeFixture(t, dir, "ambiguous.fastq", bytes.Repeat([]byte("@ERR194147.1 HSQ1004:134:C0D8DACXX:1:1101:1000:2000/1\nACGT\n+\nFGHJ\n"), 10))
+	// the identifier of a record that is dropped is still checked
+	dropped := writeFixture(t, dir, "dropped.fastq", []byte("@ERR194147.1 HSQ1004:134:C0D8DACXX:1:1101:1000:2000/1\nACGT\n+\nIIII\n@ERR194147.2 garbage/1\nNNNN\n+\nIIII\n"))
+	mate1 := writeFixture(t, dir, "in_1.fastq", filterFastq(1000, '1', 5, 33))
+	mate2 := writeFixture(t, dir, "in_2.fastq", filterFastq(1000, '2', 3, 33))
+	tests := []struct {
+		name    string
+		args    []string
+		outputs int
+		// the number of records written to each output, or -1 if
+		// it is not known
+		records int
+		failed  bool
+	}{
+		{"none", []string{single}, 1, 1000, false},
+		{"n fraction", []string{"-filter-max-n-fraction", "0.1", single}, 1, 800, false},
+		{"mean quality", []string{"-filter-min-mean-quality", "20", single}, 1, 858, false},
+		{"phred64 mean quality", []string{"-filter-min-mean-quality", "20", phred64}, 1, 858, false},
+		{"given encoding", []string{"-filter-min-mean-quality", "20", "-validate-quality", "phred64", phred64}, 1, 858, false},
+		{"ambiguous encoding", []string{"-filter-min-mean-quality", "20", ambiguous}, 1, 0, true},
+		{"dropped bad identifier", []string{"-filter-max-n-fraction", "0.1", dropped}, 1, 0, true},
+		{"both", []string{"-filter-max-n-fraction", "0.1", "-filter-min-mean-quality", "20", single}, 1, 686, false},
+		{"subsample", []string{"-subsample", "0.3", "-seed", "7", single}, 1, -1, false},
+		{"chunks", []string{"-filter-max-n-fraction", "0.1", "-subsample", "0.5", "-reads-per-chunk", "100", single}, 1, -1, false},
+		{"skip and first", []string{"-skip-n", "10", "-first-n", "500", "-filter-max-n-fraction", "0.1", single}, 1, 400, false},
+		{"paired", []string{"-paired", "-filter-max-n-fraction", "0.1", mate1, mate2}, 2, 533, false},
+		{"paired subsample", []string{"-paired", "-filter-min-mean-quality", "20", "-subsample", "0.5", mate1, mate2}, 2, -1, false},
+		{"paired chunks", []string{"-paired", "-filter-max-n-fraction", "0.1", "-reads-per-chunk", "50", mate1, mate2}, 2, -1, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var written [2]map[string][]byte
+			for i, mode := range []string{"seq", "par"} {
+				out := filepath.Join(dir, strings.ReplaceAll(test.name, " ", "_"), mode)
+				if err := os.MkdirAll(out, 0o777); err != nil {
+					t.Fatal(err)
+				}
+				args := []string{mode}
+				if mode == "par" {
+					args = append(args, "-batch-size", "37", "-num-workers", "4")
+				}
+				args = append(args, test.args...)
+				for j := range test.outputs {
+					args = append(args, filepath.Join(out, fmt.Sprintf("out_%d.fastq", j+1)))
+				}
+				status, stderr := runProgram(t, args...)
+				if (status != 0) != test.failed {
+					t.Fatalf("%s: exit status %d: %s", mode, status, stderr)
+				}
+				if test.failed {
+					continue
+				}
+				written[i] = readOutputs(t, out)
+				// the manifests of the chunks name them
+				for name, data := range written[i] {
+					written[i][name] = bytes.ReplaceAll(data, []byte(out), nil)
+				}
+			}
+			for name, seq := range written[0] {
+				par, ok := written[1][name]
+				if !ok || !bytes.Equal(seq, par) {
+					t.Errorf("%s: par mode wrote %d bytes, seq mode %d", name, len(par), len(seq))
+				}
+				if records := bytes.Count(seq, []byte("\n")) / 4; test.records >= 0 && records != test.records && !strings.HasSuffix(name, ".tsv") {
+					t.Errorf("%s: %d records, want %d", name, records, test.records)
+				}
+			}
+			if len(written[0]) != len(written[1]) {
+				t.Errorf("seq mode wrote %d files, par mode %d", len(written[0]), len(written[1]))
+			}
+		})
+	}
+}
+
+// readOutputs returns the contents of the files in dir by name.
+func readOutputs(t *testing.T, dir string) map[string][]byte {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outputs := make(map[string][]byte)
+	for _, entry := range entries {
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		outputs[entry.Name()] = data
+	}
+	return outputs
+}
+
+// TestEmptyInput runs both modes on a zero-byte file and a gzip
+// stream without records, and checks that the output is written,
+// empty, with a warning, and with exit status 3 unless -allow-empty
+// is given.
+func TestEmptyInput(t *testing.T) {
+	dir := t.TempDir()
+	inputs := []string{
+		writeFixture(t, dir, "empty.fastq", nil),
+		writeFixture(t, dir, "empty.fastq.gz", gzipped(t, nil)),
+	}
+	for _, in := range inputs {
+		for _, name := range []string{"out.fastq", "out.fastq.gz"} {
+			for _, mode := range []string{"seq", "par"} {
+				for _, allowEmpty := range []bool{false, true} {
+					out := filepath.Join(t.TempDir(), name)
+					args := []string{mode}
+					wantStatus := exitEmpty
+					if allowEmpty {
+						args = append(args, "-allow-empty")
+						wantStatus = 0
+					}
+					status, stderr := runProgram(t, append(args, in, out)...)
+					what := fmt.Sprintf("%s to %s, %s, -allow-empty %v", filepath.Base(in), name, mode, allowEmpty)
+					if status != wantStatus {
+						t.Errorf("%s: got exit status %d, want %d: %s", what, status, wantStatus, stderr)
+					}
+					if warning := "correct-platinum-fastq-sequence-identifier: warning: " + in + " is empty, it holds no records\n"; !strings.Contains(stderr, warning) {
+						t.Errorf("%s: stderr %q does not contain %q", what, stderr, warning)
+					}
+					if got := readDecompressed(t, out); len(got) != 0 {
+						t.Errorf("%s: the output holds %d bytes", what, len(got))
+					}
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// zipMemberSeparator separates a ZIP archive from the name of the
+// member to read from it, as in in.zip::ERR194147_1.fastq.gz.
+const zipMemberSeparator = "::"
+
+// isZipName reports whether a file name has a .zip extension.
+func isZipName(name string) bool {
+	return strings.EqualFold(filepath.Ext(name), ".zip")
+}
+
+// splitZipMember splits an input name into a ZIP archive and the
+// name of a member, if it selects one.
+func splitZipMember(name string) (archive, member string, ok bool) {
+	archive, member, ok = strings.Cut(name, zipMemberSeparator)
+	if !ok || !isZipName(archive) || member == "" {
+		return "", "", false
+	}
+	return archive, member, true
+}
+
+// isZipMember reports whether an input name selects a member of a
+// ZIP archive.
+func isZipMember(name string) bool {
+	_, _, ok := splitZipMember(name)
+	return ok
+}
+
+// openZipMember opens a member of a ZIP archive, which must be a
+// local file, since the directory of a ZIP archive is at its end.
+// The member is streamed without extracting it, and is decompressed
+// like any other input, so that a .fastq.gz member is decompressed
+// as gzip after ZIP has inflated it, if it was deflated at all.
+// ZIP64 archives, which may be larger than 4 GB, are read as well.
+func openZipMember(name, archive, member string, threads int) (*input, error) {
+	if isStdio(archive) || isURL(archive) {
+		return nil, fmt.Errorf("%s: ZIP members can only be read from local files", name)
+	}
+	zr, err := zip.OpenReader(archive)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", archive, err)
+	}
+	for _, f := range zr.File {
+		if f.Name != member {
+			continue
+		}
+		r, err := f.Open()
+		if err != nil {
+			_ = zr.Close()
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		in, err := newInput(r, name, threads)
+		if err != nil {
+			_ = closeAll([]io.Closer{r, zr})
+			return nil, err
+		}
+		in.closers = append(in.closers, r, zr)
+		in.size = int64(f.UncompressedSize64)
+		return in, nil
+	}
+	_ = zr.Close()
+	return nil, fmt.Errorf("%s: %s has no member %s", name, archive, member)
+}
+
+// correctZip corrects the members of a ZIP archive, in the order of
+// its directory, and returns 1 if the archive cannot be read, or 0
+// otherwise.
+func (a *archiveCorrection) correctZip() int {
+	if isStdio(a.archive) || isURL(a.archive) {
+		fmt.Fprintf(os.Stderr, "correct-platinum-fastq-sequence-identifier: %s: ZIP archives can only be read from local files\n", a.archive)
+		return 1
+	}
+	zr, err := zip.OpenReader(a.archive)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "correct-platinum-fastq-sequence-identifier: %s: %v\n", a.archive, err)
+		return 1
+	}
+	defer func() { _ = zr.Close() }()
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		if !a.member(f.Name, int64(f.UncompressedSize64), f.Open) {
+			break
+		}
+	}
+	return 0
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// TestZip corrects the members of a ZIP archive, a deflated fastq
+// file and a stored gzipped one, both selected as inputs and all of
+// them with -outdir, and checks the corrected files.
+func TestZip(t *testing.T) {
+	dir := t.TempDir()
+	mates := [2][]byte{platinumMates(200, '1'), platinumMates(200, '2')}
+	var want [2][]byte
+	for i, data := range mates {
+		reference := filepath.Join(t.TempDir(), "reference.fastq")
+		if status, stderr := runProgram(t, "seq", writeFixture(t, dir, "in.fastq", data), reference); status != 0 {
+			t.Fatal(stderr)
+		}
+		var err error
+		if want[i], err = os.ReadFile(reference); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var archive bytes.Buffer
+	zw := zip.NewWriter(&archive)
+	for _, member := range []struct {
+		name   string
+		method uint16
+		data   []byte
+	}{
+		{"run1/ERR194147_1.fastq", zip.Deflate, mates[0]},
+		{"run1/ERR194147_2.fastq.gz", zip.Store, gzipped(t, mates[1])},
+		{"run1/README.txt", zip.Deflate, []byte("not fastq\n")},
+	} {
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: member.name, Method: member.method})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(member.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	name := writeFixture(t, dir, "delivery.zip", archive.Bytes())
+
+	for _, mode := range []string{"seq", "par"} {
+		for i, member := range []string{"run1/ERR194147_1.fastq", "run1/ERR194147_2.fastq.gz"} {
+			out := filepath.Join(t.TempDir(), "out.fastq")
+			if status, stderr := runProgram(t, mode, name+"::"+member, out); status != 0 {
+				t.Fatalf("%s, %s: %s", mode, member, stderr)
+			}
+			if got, err := os.ReadFile(out); err != nil || !bytes.Equal(got, want[i]) {
+				t.Errorf("%s, %s: got %d bytes, want %d, %v", mode, member, len(got), len(want[i]), err)
+			}
+		}
+
+		outdir := t.TempDir()
+		status, stderr := runProgram(t, mode, "-outdir", outdir, name)
+		if status != 0 {
+			t.Fatalf("%s, -outdir: %s", mode, stderr)
+		}
+		if notice := "Corrected 2 of 2 fastq files in " + name + ", skipped 1 other files\n"; !strings.Contains(stderr, notice) {
+			t.Errorf("%s, -outdir: missing %q in %s", mode, notice, stderr)
+		}
+		outputs := readOutputs(t, outdir)
+		if len(outputs) != 2 || !bytes.Equal(outputs["ERR194147_1.fastq"], want[0]) || !bytes.Equal(readDecompressed(t, filepath.Join(outdir, "ERR194147_2.fastq.gz")), want[1]) {
+			t.Errorf("%s, -outdir: got outputs %q", mode, slices.Sorted(maps.Keys(outputs)))
+		}
+	}
+
+	tests := []struct {
+		input, err string
+	}{
+		{name, "is a ZIP archive, select a member as in " + name + "::name.fastq.gz"},
+		{name + "::run1/missing.fastq", name + " has no member run1/missing.fastq"},
+	}
+	for _, test := range tests {
+		status, stderr := runProgram(t, "seq", test.input, filepath.Join(t.TempDir(), "out.fastq"))
+		if status == 0 || !strings.Contains(stderr, test.err) {
+			t.Errorf("%s: exit status %d: %s, want %q", test.input, status, stderr, test.err)
+		}
+	}
+}